@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip86"
+
+	"github.com/mroxso/okay/relay"
+)
+
+// adminCommand is a single `okay admin` action. It returns the value to
+// print, or nil when there's nothing to show.
+type adminCommand struct {
+	usage string
+	args  int // minimum number of arguments
+	run   func(dbm relay.ManagementStore, args []string) (any, error)
+}
+
+// adminCommands manage the policy tables directly through DBManager, for
+// when no NIP-86 client (or no owner key) is at hand.
+var adminCommands = map[string]adminCommand{
+	"allow-pubkey": {"<pubkey> [reason]", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pubkey, err := parsePubkey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return nil, dbm.AddAllowedPubkey(pubkey, optionalArg(args, 1))
+	}},
+	"disallow-pubkey": {"<pubkey>", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pubkey, err := parsePubkey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return nil, dbm.RemoveAllowedPubkey(pubkey)
+	}},
+	"ban-pubkey": {"<pubkey> [reason]", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pubkey, err := parsePubkey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		// same as the banpubkey management method: a banned pubkey is no
+		// longer allowed, and one that never was is banned all the same
+		allowed, err := dbm.IsAllowedPubkey(pubkey)
+		if err != nil {
+			return nil, err
+		}
+		if allowed {
+			if err := dbm.RemoveAllowedPubkey(pubkey); err != nil {
+				return nil, err
+			}
+		}
+		return nil, dbm.BanPubKey(pubkey, optionalArg(args, 1))
+	}},
+	"unban-pubkey": {"<pubkey>", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pubkey, err := parsePubkey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return nil, dbm.UnbanPubKey(pubkey)
+	}},
+	"list-allowed-pubkeys": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetAllowedPubkeysWithReason()
+	}},
+	"list-banned-pubkeys": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetBannedPubkeys()
+	}},
+
+	"allow-kind": {"<kind>", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		kind, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid kind: %w", err)
+		}
+		return nil, dbm.AllowKind(kind)
+	}},
+	"disallow-kind": {"<kind>", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		kind, err := strconv.Atoi(args[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid kind: %w", err)
+		}
+		return nil, dbm.DisallowKind(kind)
+	}},
+	"list-allowed-kinds": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetAllowedKinds()
+	}},
+	"list-disallowed-kinds": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetDisallowedKinds()
+	}},
+
+	"block-ip": {"<ip> [reason]", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", args[0])
+		}
+		return nil, dbm.BlockIP(ip, optionalArg(args, 1))
+	}},
+	"unblock-ip": {"<ip>", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		ip := net.ParseIP(args[0])
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip %q", args[0])
+		}
+		return nil, dbm.UnblockIP(ip)
+	}},
+	"list-blocked-ips": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetBlockedIPs()
+	}},
+
+	"grant-admin": {"<pubkey> <method,...>", 2, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pubkey, err := parsePubkey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return nil, dbm.GrantAdmin(pubkey, strings.Split(args[1], ","))
+	}},
+	"revoke-admin": {"<pubkey> [method,...]", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pubkey, err := parsePubkey(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var methods []string
+		if len(args) > 1 {
+			methods = strings.Split(args[1], ",")
+		}
+		return nil, dbm.RevokeAdmin(pubkey, methods)
+	}},
+	"list-admins": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetAdmins()
+	}},
+
+	"set-info": {"<name|description|icon> <value>", 2, func(dbm relay.ManagementStore, args []string) (any, error) {
+		switch args[0] {
+		case "name", "description", "icon":
+			return nil, dbm.SetRelayInfo(args[0], args[1])
+		default:
+			return nil, fmt.Errorf("unknown relay info field %q", args[0])
+		}
+	}},
+
+	"allow-event": {"<id> [reason]", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return nil, dbm.AllowEvent(args[0], optionalArg(args, 1))
+	}},
+	"ban-event": {"<id> [reason]", 1, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return nil, dbm.BanEvent(args[0], optionalArg(args, 1))
+	}},
+	"list-moderation": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetEventsNeedingModeration()
+	}},
+	"list-allowed-events": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetAllowedEvents()
+	}},
+	"list-banned-events": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetBannedEvents()
+	}},
+
+	// a running relay picks these up within a minute
+	"add-content-rule": {"<word|regex|domain> <pattern> <reject|shadow_reject|moderate> [reason]", 3, func(dbm relay.ManagementStore, args []string) (any, error) {
+		rule, err := relay.NormalizeContentRule(relay.ContentRule{Type: args[0], Pattern: args[1], Action: args[2], Reason: optionalArg(args, 3)})
+		if err != nil {
+			return nil, err
+		}
+		return nil, dbm.AddContentRule(rule)
+	}},
+	"remove-content-rule": {"<word|regex|domain> <pattern>", 2, func(dbm relay.ManagementStore, args []string) (any, error) {
+		pattern := args[1]
+		if rule, err := relay.NormalizeContentRule(relay.ContentRule{Type: args[0], Pattern: pattern, Action: relay.ContentReject}); err == nil {
+			pattern = rule.Pattern
+		}
+		found, err := dbm.RemoveContentRule(args[0], pattern)
+		if err == nil && !found {
+			err = fmt.Errorf("no %s rule %q", args[0], pattern)
+		}
+		return nil, err
+	}},
+	"list-content-rules": {"", 0, func(dbm relay.ManagementStore, args []string) (any, error) {
+		return dbm.GetContentRules()
+	}},
+}
+
+// runAdmin handles `okay admin [--json] <action> [args...]`.
+func runAdmin(args []string) error {
+	flags := flag.NewFlagSet("admin", flag.ExitOnError)
+	jsonOutput := flags.Bool("json", false, "print results as JSON")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: okay admin [--json] <action> [args...]")
+		fmt.Fprintln(flags.Output(), "actions:")
+		for _, name := range slices.Sorted(maps.Keys(adminCommands)) {
+			fmt.Fprintf(flags.Output(), "  %s %s\n", name, adminCommands[name].usage)
+		}
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing action")
+	}
+	name, rest := flags.Arg(0), flags.Args()[1:]
+	cmd, ok := adminCommands[name]
+	if !ok {
+		flags.Usage()
+		return fmt.Errorf("unknown action %q", name)
+	}
+	if len(rest) < cmd.args {
+		return fmt.Errorf("usage: okay admin %s %s", name, cmd.usage)
+	}
+
+	st, err := openStorage()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	result, err := cmd.run(st.Management(), rest)
+	if err != nil {
+		return err
+	}
+	if result == nil {
+		if *jsonOutput {
+			fmt.Println("true")
+		} else {
+			fmt.Println("ok")
+		}
+		return nil
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+	return printTable(os.Stdout, result)
+}
+
+// printTable renders the list results of the admin actions.
+func printTable(w io.Writer, result any) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	switch rows := result.(type) {
+	case []int:
+		fmt.Fprintln(tw, "KIND")
+		for _, kind := range rows {
+			fmt.Fprintln(tw, kind)
+		}
+	case []nip86.PubKeyReason:
+		fmt.Fprintln(tw, "PUBKEY\tREASON")
+		for _, row := range rows {
+			fmt.Fprintf(tw, "%s\t%s\n", row.PubKey, row.Reason)
+		}
+	case []nip86.IDReason:
+		fmt.Fprintln(tw, "ID\tREASON")
+		for _, row := range rows {
+			fmt.Fprintf(tw, "%s\t%s\n", row.ID, row.Reason)
+		}
+	case []nip86.IPReason:
+		fmt.Fprintln(tw, "IP\tREASON")
+		for _, row := range rows {
+			fmt.Fprintf(tw, "%s\t%s\n", row.IP, row.Reason)
+		}
+	case []relay.AdminMethods:
+		fmt.Fprintln(tw, "PUBKEY\tMETHODS")
+		for _, row := range rows {
+			fmt.Fprintf(tw, "%s\t%s\n", row.PubKey, strings.Join(row.Methods, ","))
+		}
+	default:
+		return fmt.Errorf("can't print %T as a table, use --json", result)
+	}
+	return tw.Flush()
+}
+
+// parsePubkey accepts a hex pubkey or an npub.
+func parsePubkey(value string) (string, error) {
+	if strings.HasPrefix(value, "npub1") {
+		prefix, data, err := nip19.Decode(value)
+		if err != nil || prefix != "npub" {
+			return "", fmt.Errorf("invalid npub %q", value)
+		}
+		return data.(string), nil
+	}
+	if !nostr.IsValid32ByteHex(value) {
+		return "", fmt.Errorf("invalid pubkey %q", value)
+	}
+	return value, nil
+}
+
+func optionalArg(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/mroxso/okay/relay"
+)
+
+func TestAdminBanPubkey(t *testing.T) {
+	st, err := relay.OpenStorage(relay.DatabaseConfig{Backend: relay.BackendMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	dbm := st.Management()
+	ban := adminCommands["ban-pubkey"].run
+
+	// a pubkey that was never allowed
+	stranger, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if _, err := ban(dbm, []string{stranger, "spam"}); err != nil {
+		t.Fatalf("banning an unknown pubkey: %v", err)
+	}
+	if banned, _ := dbm.IsBannedPubkey(stranger); !banned {
+		t.Error("unknown pubkey not banned")
+	}
+
+	// an allowed one loses its allowlist entry
+	friend, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	if err := dbm.AddAllowedPubkey(friend, "friend"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ban(dbm, []string{friend}); err != nil {
+		t.Fatalf("banning an allowed pubkey: %v", err)
+	}
+	if allowed, _ := dbm.IsAllowedPubkey(friend); allowed {
+		t.Error("banned pubkey still allowed")
+	}
+	if banned, _ := dbm.IsBannedPubkey(friend); !banned {
+		t.Error("allowed pubkey not banned")
+	}
+}
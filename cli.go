@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/mroxso/okay/relay"
+)
+
+// maxImportLine is the longest JSONL line import accepts.
+const maxImportLine = 16 * 1024 * 1024
+
+// runCommand runs one of the maintenance subcommands of the server binary.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "export":
+		return exportCommand(args)
+	case "import":
+		return importCommand(args)
+	case "dump":
+		return dumpCommand(args)
+	case "restore":
+		return restoreCommand(args)
+	case "admin":
+		return runAdmin(args)
+	case "rpc":
+		return runRPC(args)
+	case "test-scripts":
+		return testScriptsCommand(args)
+	default:
+		return fmt.Errorf("unknown command, available: export, import, dump, restore, admin, rpc, test-scripts")
+	}
+}
+
+// exportCommand writes the events matching a filter as JSONL, newest first.
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	filterJSON := flags.String("filter", "{}", "nostr filter selecting the events to export")
+	output := flags.String("output", "-", "file to write to, - for stdout")
+	flags.Parse(args)
+
+	var filter nostr.Filter
+	if err := json.Unmarshal([]byte(*filterJSON), &filter); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+
+	w, closeOutput, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer closeOutput()
+
+	st, err := openStorage()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	count, err := st.ExportEvents(context.Background(), w, filter)
+	if err != nil {
+		return err
+	}
+	log.Printf("exported %d events", count)
+	return nil
+}
+
+// importCommand reads JSONL events, verifies them and stores them, either
+// directly or through the relay's full RejectEvent pipeline.
+func importCommand(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	input := flags.String("input", "-", "file to read from, - for stdin")
+	withPolicies := flags.Bool("policies", false, "run events through the relay's policies instead of storing them directly")
+	flags.Parse(args)
+
+	r, closeInput, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	var store func(ctx context.Context, event *nostr.Event) error
+	if *withPolicies {
+		app, err := loadApp()
+		if err != nil {
+			return err
+		}
+		// stops the plugins and scripts the policies started
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), app.Config().ShutdownTimeout)
+			defer cancel()
+			if err := app.Shutdown(ctx); err != nil {
+				log.Printf("Error shutting down: %v", err)
+			}
+		}()
+		store = func(ctx context.Context, event *nostr.Event) error {
+			_, err := app.Relay.AddEvent(ctx, event)
+			return err
+		}
+	} else {
+		st, err := openStorage()
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		store = func(ctx context.Context, event *nostr.Event) error {
+			if nostr.IsReplaceableKind(event.Kind) || nostr.IsAddressableKind(event.Kind) {
+				return st.Events().ReplaceEvent(ctx, event)
+			}
+			return st.Events().SaveEvent(ctx, event)
+		}
+	}
+
+	ctx := context.Background()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+
+	var imported, invalid, rejected, skipped, line int
+	for scanner.Scan() {
+		line++
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var event nostr.Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Printf("line %d: invalid json: %v", line, err)
+			invalid++
+			continue
+		}
+		if !event.CheckID() {
+			log.Printf("line %d: event id doesn't match its content", line)
+			invalid++
+			continue
+		}
+		if ok, err := event.CheckSignature(); !ok {
+			log.Printf("line %d: invalid signature on %s: %v", line, event.ID, err)
+			invalid++
+			continue
+		}
+
+		// ephemeral events are never stored
+		if nostr.IsEphemeralKind(event.Kind) {
+			skipped++
+			continue
+		}
+		if err := store(ctx, &event); err != nil && err != eventstore.ErrDupEvent {
+			log.Printf("line %d: %s not imported: %v", line, event.ID, err)
+			rejected++
+			continue
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read line %d: %w", line+1, err)
+	}
+
+	log.Printf("imported %d events, %d invalid, %d rejected, %d ephemeral skipped", imported, invalid, rejected, skipped)
+	return nil
+}
+
+// dumpCommand writes the policy tables as JSONL.
+func dumpCommand(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	output := flags.String("output", "-", "file to write to, - for stdout")
+	flags.Parse(args)
+
+	w, closeOutput, err := openOutput(*output)
+	if err != nil {
+		return err
+	}
+	defer closeOutput()
+
+	st, err := openStorage()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	count, err := st.Management().DumpPolicyTables(w)
+	if err != nil {
+		return err
+	}
+	log.Printf("dumped %d rows", count)
+	return nil
+}
+
+// restoreCommand loads a dump written by dumpCommand.
+func restoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	input := flags.String("input", "-", "file to read from, - for stdin")
+	flags.Parse(args)
+
+	r, closeInput, err := openInput(*input)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	st, err := openStorage()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	count, err := st.Management().RestorePolicyTables(r)
+	if err != nil {
+		return err
+	}
+	log.Printf("restored %d rows", count)
+	return nil
+}
+
+// testScriptsCommand runs the policy scripts of a directory against stored
+// events and reports what they would do, without changing anything.
+func testScriptsCommand(args []string) error {
+	flags := flag.NewFlagSet("test-scripts", flag.ExitOnError)
+	dir := flags.String("dir", "scripts", "directory with the scripts to test")
+	filterJSON := flags.String("filter", "{}", "nostr filter selecting the events to test against")
+	timeout := flags.Duration("timeout", 0, "time limit of a script run, 0 for the default")
+	maxSteps := flags.Uint64("max-steps", 0, "step limit of a script run, 0 for the default")
+	flags.Parse(args)
+
+	var filter nostr.Filter
+	if err := json.Unmarshal([]byte(*filterJSON), &filter); err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+
+	st, err := openStorage()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	sr, err := relay.NewScriptRunner(st.Management(), relay.ScriptParams{Dir: *dir, Timeout: *timeout, MaxSteps: *maxSteps})
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	failed := 0
+	err = relay.WalkEvents(context.Background(), st.Events(), filter, func(event *nostr.Event) error {
+		decision, err := sr.Check(context.Background(), event)
+		if err != nil {
+			failed++
+			fmt.Printf("error\t%s\t%v\n", event.ID, err)
+		}
+		counts[decision.Action]++
+		if decision.Action != relay.ScriptAccept {
+			fmt.Printf("%s\t%s\t%s: %s\n", decision.Action, event.ID, decision.Script, decision.Message)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("tested %d events: %d accepted, %d rejected, %d flagged, %d with errors",
+		counts[relay.ScriptAccept]+counts[relay.ScriptReject]+counts[relay.ScriptFlag],
+		counts[relay.ScriptAccept], counts[relay.ScriptReject], counts[relay.ScriptFlag], failed)
+	return nil
+}
+
+func openInput(path string) (io.Reader, func(), error) {
+	if path == "-" {
+		return os.Stdin, func() {}, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
+
+func openOutput(path string) (io.Writer, func(), error) {
+	if path == "-" {
+		return os.Stdout, func() {}, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() { f.Close() }, nil
+}
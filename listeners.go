@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mroxso/okay/relay"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// Listener is an open socket and the server that will serve one role on it.
+type Listener struct {
+	Config relay.ListenerConfig
+
+	ln     net.Listener
+	server *http.Server
+}
+
+// String describes the listener for logs.
+func (l *Listener) String() string {
+	s := l.Config.Role + " on " + l.Config.Address
+	if l.Config.TLS.CertFile != "" {
+		s += " (tls)"
+	}
+	return s
+}
+
+// Serve serves requests until Shutdown.
+func (l *Listener) Serve() error {
+	err := l.server.Serve(l.ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", l, err)
+}
+
+// Shutdown stops accepting connections and waits for the plain HTTP
+// requests in flight. Websockets are hijacked, so they're left to Drain.
+func (l *Listener) Shutdown(ctx context.Context) error {
+	return l.server.Shutdown(ctx)
+}
+
+// listenAll opens every configured listener. Nothing is served until Serve
+// is called on them.
+func listenAll(app *relay.App) ([]*Listener, error) {
+	configs := app.Config().AllListeners()
+
+	// with a dedicated admin listener the public ones don't take NIP-86 calls
+	separateAdmin := false
+	for _, cfg := range configs {
+		if cfg.Role == relay.RoleAdmin {
+			separateAdmin = true
+		}
+	}
+
+	var listeners []*Listener
+	for _, cfg := range configs {
+		l, err := openListener(app, cfg, separateAdmin)
+		if err != nil {
+			for _, opened := range listeners {
+				opened.ln.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func openListener(app *relay.App, cfg relay.ListenerConfig, separateAdmin bool) (*Listener, error) {
+	var handler http.Handler
+	switch cfg.Role {
+	case relay.RoleAdmin:
+		handler = onlyManagement(app.Handler)
+	case relay.RoleMetrics:
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", app.Metrics)
+		mux.HandleFunc("/healthz", app.ServeHealthz)
+		mux.HandleFunc("/readyz", app.ServeReadyz)
+		handler = mux
+	default:
+		handler = app.Handler
+		if separateAdmin {
+			handler = withoutManagement(handler)
+		}
+	}
+
+	var tlsConfig *tls.Config
+	if cfg.TLS.CertFile != "" {
+		certs, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+			// websockets need HTTP/1.1
+			NextProtos: []string{"http/1.1"},
+		}
+		handler = behindTLS(handler)
+	}
+
+	ln, err := listen(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+
+	return &Listener{
+		Config: cfg,
+		ln:     ln,
+		server: &http.Server{Handler: handler},
+	}, nil
+}
+
+// listen opens a TCP socket, or a Unix socket for addresses like
+// unix:/run/okay.sock.
+func listen(address string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(address, "unix:")
+	if !ok {
+		return net.Listen("tcp", address)
+	}
+
+	// a socket left behind by a crash would make listening fail, but
+	// never remove anything that isn't a socket
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode()&fs.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// let a reverse proxy running as another user connect; like a TCP port
+	// on localhost, it's reachable by every local user
+	if err := os.Chmod(path, 0o666); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	return ln, nil
+}
+
+func isManagementRequest(r *http.Request) bool {
+	return r.Header.Get("Content-Type") == "application/nostr+json+rpc"
+}
+
+// onlyManagement serves NIP-86 calls (and their CORS preflights) and
+// nothing else.
+func onlyManagement(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isManagementRequest(r) && r.Method != http.MethodOptions {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withoutManagement serves everything but NIP-86 calls.
+func withoutManagement(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isManagementRequest(r) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// behindTLS tells khatru's URL guessing (used to check NIP-42 and NIP-98
+// events) that the request came over TLS, which it can't tell from the host
+// alone when a port is given.
+func behindTLS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("X-Forwarded-Proto", "https")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// certReloader serves a certificate from files and loads them again when
+// they change, so renewed certificates are picked up without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	loadedAt time.Time // modification time of the files loaded
+	checked  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	modTime, err := r.modTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTime); err != nil {
+		return nil, err
+	}
+	r.checked = time.Now()
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		modTime, err := r.modTime()
+		if err != nil {
+			log.Printf("Error checking TLS certificate: %v", err)
+		} else if !modTime.Equal(r.loadedAt) {
+			// a half-written renewal fails to load; keep the old certificate
+			// and try again on the next check
+			if err := r.load(modTime); err != nil {
+				log.Printf("Error reloading TLS certificate: %v", err)
+			} else {
+				log.Printf("reloaded TLS certificate %s", r.certFile)
+			}
+		}
+	}
+	return r.cert, nil
+}
+
+func (r *certReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	r.cert = &cert
+	r.loadedAt = modTime
+	return nil
+}
+
+// modTime returns the newer modification time of the two files.
+func (r *certReloader) modTime() (time.Time, error) {
+	var newest time.Time
+	for _, file := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+
+	"github.com/mroxso/okay/relay"
+)
+
+func newListenerApp(t *testing.T) *relay.App {
+	t.Helper()
+	cfg := relay.DefaultConfig()
+	cfg.Database.Backend = relay.BackendMemory
+	cfg.Key.SecretKey = nostr.GeneratePrivateKey()
+	app, err := relay.New(relay.Options{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		app.Shutdown(ctx)
+	})
+	return app
+}
+
+// serveListener serves l until the test ends.
+func serveListener(t *testing.T, l *Listener) {
+	t.Helper()
+	go l.Serve()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		l.Shutdown(ctx)
+	})
+}
+
+// unixClient is an HTTP client that connects to the socket at path.
+func unixClient(path string) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+// request sends a NIP-11 request, or a NIP-86 call with contentType, and
+// returns the status and body of the response.
+func request(t *testing.T, client *http.Client, url, contentType string) (int, string) {
+	t.Helper()
+	method, accept := http.MethodGet, "application/nostr+json"
+	if contentType != "" {
+		method, accept = http.MethodPost, ""
+	}
+	req, _ := http.NewRequest(method, url, strings.NewReader(`{"method":"supportedmethods","params":[]}`))
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestUnixListenerRoles(t *testing.T) {
+	app := newListenerApp(t)
+	dir := t.TempDir()
+	relayPath := filepath.Join(dir, "relay.sock")
+	adminPath := filepath.Join(dir, "admin.sock")
+
+	// a socket left behind by a crash is replaced
+	stale, err := net.Listen("unix", relayPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(relayPath); err != nil {
+		t.Fatalf("no stale socket: %v", err)
+	}
+
+	relayListener, err := openListener(app, relay.ListenerConfig{Address: "unix:" + relayPath, Role: relay.RoleRelay}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, relayListener)
+	adminListener, err := openListener(app, relay.ListenerConfig{Address: "unix:" + adminPath, Role: relay.RoleAdmin}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, adminListener)
+
+	// with a separate admin listener, NIP-86 calls only go there
+	const rpc = "application/nostr+json+rpc"
+	relayClient, adminClient := unixClient(relayPath), unixClient(adminPath)
+	if code, body := request(t, relayClient, "http://relay/", ""); code != http.StatusOK || !strings.Contains(body, "supported_nips") {
+		t.Errorf("relay listener NIP-11: got %d %s", code, body)
+	}
+	if code, _ := request(t, relayClient, "http://relay/", rpc); code != http.StatusNotFound {
+		t.Errorf("relay listener NIP-86: got %d, want 404", code)
+	}
+	if code, _ := request(t, adminClient, "http://relay/", ""); code != http.StatusNotFound {
+		t.Errorf("admin listener NIP-11: got %d, want 404", code)
+	}
+	// unsigned, so refused, but by the management API
+	if code, body := request(t, adminClient, "http://relay/", rpc); code == http.StatusNotFound || !strings.Contains(body, `"error"`) {
+		t.Errorf("admin listener NIP-86: got %d %s, want a JSON-RPC error", code, body)
+	}
+
+	// anything else in the way is left alone
+	notSocket := filepath.Join(dir, "data")
+	if err := os.WriteFile(notSocket, []byte("keep"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openListener(app, relay.ListenerConfig{Address: "unix:" + notSocket}, false); err == nil || !strings.Contains(err.Error(), "not a socket") {
+		t.Errorf("got %v, want a refusal to replace a file", err)
+	}
+	if data, _ := os.ReadFile(notSocket); string(data) != "keep" {
+		t.Error("file was replaced")
+	}
+}
+
+// writeCert writes a self-signed certificate for 127.0.0.1 with the given
+// serial number, and its key.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSListenerReloadsCertificate(t *testing.T) {
+	app := newListenerApp(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, 1)
+
+	l, err := openListener(app, relay.ListenerConfig{
+		Address: "127.0.0.1:0",
+		Role:    relay.RoleMetrics,
+		TLS:     relay.TLSConfig{CertFile: certFile, KeyFile: keyFile},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveListener(t, l)
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := client.Get("https://" + l.ln.Addr().String() + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.TLS.PeerCertificates[0].SerialNumber.Int64() != 1 {
+		t.Errorf("got %d with certificate %v", resp.StatusCode, resp.TLS.PeerCertificates[0].SerialNumber)
+	}
+
+	// the files are checked again every certCheckInterval
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial := func() int64 {
+		t.Helper()
+		cert, err := certs.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+	renew := func(serial int64) {
+		t.Helper()
+		writeCert(t, certFile, keyFile, serial)
+		later := time.Now().Add(time.Duration(serial) * time.Second)
+		os.Chtimes(certFile, later, later)
+		os.Chtimes(keyFile, later, later)
+	}
+
+	renew(2)
+	if got := serial(); got != 1 {
+		t.Errorf("reloaded before the check interval: serial %d", got)
+	}
+	certs.checked = time.Now().Add(-certCheckInterval)
+	if got := serial(); got != 2 {
+		t.Errorf("after renewal: serial %d, want 2", got)
+	}
+
+	// a half-written renewal keeps the current certificate
+	renew(3)
+	if err := os.WriteFile(keyFile, []byte("-----BEGIN"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(4 * time.Second)
+	os.Chtimes(keyFile, later, later)
+	certs.checked = time.Now().Add(-certCheckInterval)
+	if got := serial(); got != 2 {
+		t.Errorf("after a broken renewal: serial %d, want 2", got)
+	}
+}
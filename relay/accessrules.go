@@ -0,0 +1,125 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// accessRulesReloadInterval is how often the rules are read again, for the
+// changes made by other processes such as `okay admin`.
+const accessRulesReloadInterval = time.Minute
+
+// AccessRules holds the blocked IPs and the kind rules of the management
+// store in memory, so checking a connection or an event doesn't read them
+// from the database. They are read again after every change made through
+// the management API, and every minute.
+type AccessRules struct {
+	dbm     ManagementStore
+	current atomic.Pointer[accessRuleSet]
+}
+
+type accessRuleSet struct {
+	blockedIPs   map[string]struct{}
+	allowedKinds map[int]struct{}
+	deniedKinds  map[int]struct{}
+}
+
+// NewAccessRules loads the rules of dbm.
+func NewAccessRules(dbm ManagementStore) (*AccessRules, error) {
+	ar := &AccessRules{dbm: dbm}
+	if err := ar.Reload(); err != nil {
+		return nil, err
+	}
+	return ar, nil
+}
+
+// Reload reads the rules again.
+func (ar *AccessRules) Reload() error {
+	blocked, err := ar.dbm.GetBlockedIPs()
+	if err != nil {
+		return fmt.Errorf("failed to load blocked IPs: %w", err)
+	}
+	allowed, err := ar.dbm.GetAllowedKinds()
+	if err != nil {
+		return fmt.Errorf("failed to load allowed kinds: %w", err)
+	}
+	denied, err := ar.dbm.GetDisallowedKinds()
+	if err != nil {
+		return fmt.Errorf("failed to load disallowed kinds: %w", err)
+	}
+
+	rules := &accessRuleSet{
+		blockedIPs:   make(map[string]struct{}, len(blocked)),
+		allowedKinds: make(map[int]struct{}, len(allowed)),
+		deniedKinds:  make(map[int]struct{}, len(denied)),
+	}
+	for _, b := range blocked {
+		if ip := net.ParseIP(b.IP); ip != nil {
+			rules.blockedIPs[ip.String()] = struct{}{}
+		}
+	}
+	for _, kind := range allowed {
+		rules.allowedKinds[kind] = struct{}{}
+	}
+	for _, kind := range denied {
+		rules.deniedKinds[kind] = struct{}{}
+	}
+	ar.current.Store(rules)
+	return nil
+}
+
+// reloadAfter reads the rules again when a change succeeded, and returns
+// its error.
+func (ar *AccessRules) reloadAfter(err error) error {
+	if err != nil {
+		return err
+	}
+	if err := ar.Reload(); err != nil {
+		log.Printf("Error reloading access rules: %v", err)
+	}
+	return nil
+}
+
+// Run reads the rules again every minute until ctx is canceled.
+func (ar *AccessRules) Run(ctx context.Context) {
+	ticker := time.NewTicker(accessRulesReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ar.Reload(); err != nil {
+				log.Printf("Error reloading access rules: %v", err)
+			}
+		}
+	}
+}
+
+// BlockedIP tells whether address was blocked.
+func (ar *AccessRules) BlockedIP(address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	_, blocked := ar.current.Load().blockedIPs[ip.String()]
+	return blocked
+}
+
+// KindAllowed tells whether events of kind may be written: not disallowed,
+// and, once kinds are allowed explicitly, one of them.
+func (ar *AccessRules) KindAllowed(kind int) bool {
+	rules := ar.current.Load()
+	if _, denied := rules.deniedKinds[kind]; denied {
+		return false
+	}
+	if len(rules.allowedKinds) == 0 {
+		return true
+	}
+	_, allowed := rules.allowedKinds[kind]
+	return allowed
+}
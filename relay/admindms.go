@@ -0,0 +1,256 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+// Notification types only sent as admin DMs. The others have the names of
+// the webhook notifications.
+const (
+	// NotifyRateLimitOffender is sent when an IP or pubkey keeps being rate
+	// limited.
+	NotifyRateLimitOffender = "ratelimit.offender"
+	// NotifyStorageThreshold is sent when the stored events go over max_events.
+	NotifyStorageThreshold = "storage.threshold"
+)
+
+// adminDMTypes are what admins can get DMs about. Bans are only reported
+// to the admins who didn't make them.
+var adminDMTypes = []string{
+	WebhookModerationFlagged, WebhookPubkeyBanned, WebhookEventBanned, WebhookIPBlocked,
+	NotifyRateLimitOffender, NotifyStorageThreshold,
+}
+
+// adminDMQueue is how many DMs can wait to be sent before new ones are
+// dropped.
+const adminDMQueue = 100
+
+// AdminDMs tells the owner and the admins about what needs their
+// attention with NIP-17 direct messages from the relay key. The gift
+// wraps are stored and broadcast here like any event, so the recipients
+// read them from this relay.
+type AdminDMs struct {
+	dbm    ManagementStore
+	store  eventstore.Store
+	relay  *khatru.Relay
+	key    *RelayKey
+	config func() *Config
+
+	queue chan adminDM
+
+	mu           sync.Mutex
+	offenders    map[string]*offender
+	lastPrune    time.Time
+	overCapacity bool
+}
+
+type adminDM struct {
+	kind string
+	// actor made the change, and isn't told about it
+	actor string
+	text  string
+}
+
+// offender is how often a key was rate limited in the current window.
+type offender struct {
+	count int
+	since time.Time
+}
+
+// NewAdminDMs creates the notifier. config is read on every notification,
+// so it follows config reloads.
+func NewAdminDMs(dbm ManagementStore, store eventstore.Store, relay *khatru.Relay, key *RelayKey, config func() *Config) *AdminDMs {
+	return &AdminDMs{
+		dbm:       dbm,
+		store:     store,
+		relay:     relay,
+		key:       key,
+		config:    config,
+		queue:     make(chan adminDM, adminDMQueue),
+		offenders: make(map[string]*offender),
+	}
+}
+
+// Notify queues a DM to everyone who gets kind, except actor.
+func (dms *AdminDMs) Notify(kind, actor, text string) {
+	if !dms.config().AdminDMs.Enabled {
+		return
+	}
+	select {
+	case dms.queue <- adminDM{kind, actor, text}:
+	default:
+		log.Printf("Error queueing %s DM: queue full", kind)
+	}
+}
+
+// RateLimited counts a rate limited request of key. Once a key reaches
+// rate_limit_offenders within the window, the admins are told.
+func (dms *AdminDMs) RateLimited(key, policy string) {
+	cfg := dms.config().AdminDMs
+	if !cfg.Enabled || cfg.RateLimitOffenders <= 0 || key == "" {
+		return
+	}
+
+	dms.mu.Lock()
+	now := time.Now()
+	if now.Sub(dms.lastPrune) > cfg.RateLimitWindow {
+		for k, o := range dms.offenders {
+			if now.Sub(o.since) > cfg.RateLimitWindow {
+				delete(dms.offenders, k)
+			}
+		}
+		dms.lastPrune = now
+	}
+	o, ok := dms.offenders[key]
+	if !ok || now.Sub(o.since) > cfg.RateLimitWindow {
+		o = &offender{since: now}
+		dms.offenders[key] = o
+	}
+	o.count++
+	report := o.count == cfg.RateLimitOffenders
+	dms.mu.Unlock()
+
+	if report {
+		dms.Notify(NotifyRateLimitOffender, "", fmt.Sprintf("%s was rate limited %d times in %s, last by %s.",
+			key, cfg.RateLimitOffenders, cfg.RateLimitWindow, policy))
+	}
+}
+
+// Preferences returns what pubkey gets DMs about: everything until they
+// choose.
+func (dms *AdminDMs) Preferences(pubkey string) ([]string, error) {
+	types, ok, err := dms.dbm.GetDMPreferences(pubkey)
+	if err != nil || !ok {
+		return slices.Clone(adminDMTypes), err
+	}
+	return types, nil
+}
+
+// SetPreferences sets what pubkey gets DMs about; none stops them.
+func (dms *AdminDMs) SetPreferences(pubkey string, types []string) error {
+	for _, kind := range types {
+		if !slices.Contains(adminDMTypes, kind) {
+			return fmt.Errorf("unknown notification %q, must be one of %s", kind, strings.Join(adminDMTypes, ", "))
+		}
+	}
+	return dms.dbm.SetDMPreferences(pubkey, types)
+}
+
+// Run sends the queued DMs and checks the storage threshold until ctx is
+// canceled.
+func (dms *AdminDMs) Run(ctx context.Context) {
+	timer := time.NewTimer(dms.config().AdminDMs.StorageInterval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case dm := <-dms.queue:
+			dms.send(ctx, dm)
+		case <-timer.C:
+			dms.checkStorage(ctx)
+			timer.Reset(dms.config().AdminDMs.StorageInterval)
+		}
+	}
+}
+
+// recipients are the owner and the admins.
+func (dms *AdminDMs) recipients() ([]string, error) {
+	var pubkeys []string
+	if owner := dms.config().Info.PubKey; owner != "" {
+		pubkeys = append(pubkeys, owner)
+	}
+	admins, err := dms.dbm.GetAdmins()
+	if err != nil {
+		return nil, err
+	}
+	for _, admin := range admins {
+		if !slices.Contains(pubkeys, admin.PubKey) {
+			pubkeys = append(pubkeys, admin.PubKey)
+		}
+	}
+	return pubkeys, nil
+}
+
+func (dms *AdminDMs) send(ctx context.Context, dm adminDM) {
+	recipients, err := dms.recipients()
+	if err != nil {
+		log.Printf("Error listing %s DM recipients: %v", dm.kind, err)
+		return
+	}
+	for _, pubkey := range recipients {
+		if pubkey == dm.actor || pubkey == dms.key.PublicKey {
+			continue
+		}
+		types, err := dms.Preferences(pubkey)
+		if err != nil {
+			log.Printf("Error loading DM preferences of %s: %v", pubkey, err)
+			continue
+		}
+		if !slices.Contains(types, dm.kind) {
+			continue
+		}
+
+		wrap, err := dms.key.DirectMessage(pubkey, dm.text)
+		if err != nil {
+			log.Printf("Error writing %s DM to %s: %v", dm.kind, pubkey, err)
+			continue
+		}
+		if err := dms.store.SaveEvent(ctx, wrap); err != nil {
+			log.Printf("Error storing %s DM to %s: %v", dm.kind, pubkey, err)
+			continue
+		}
+		dms.relay.BroadcastEvent(wrap)
+	}
+}
+
+// checkStorage reports when the stored events go over max_events, once
+// until they're back under it.
+func (dms *AdminDMs) checkStorage(ctx context.Context) {
+	cfg := dms.config().AdminDMs
+	counter, ok := dms.store.(eventstore.Counter)
+	if !cfg.Enabled || cfg.MaxEvents <= 0 || !ok {
+		return
+	}
+	count, err := counter.CountEvents(ctx, nostr.Filter{})
+	if err != nil {
+		log.Printf("Error counting events: %v", err)
+		return
+	}
+
+	dms.mu.Lock()
+	report := count > cfg.MaxEvents && !dms.overCapacity
+	dms.overCapacity = count > cfg.MaxEvents
+	dms.mu.Unlock()
+	if report {
+		dms.Notify(NotifyStorageThreshold, "", fmt.Sprintf("The relay stores %d events, over the threshold of %d.", count, cfg.MaxEvents))
+	}
+}
+
+// npub is how pubkeys are shown in DMs, so clients can link them.
+func npub(pubkey string) string {
+	if encoded, err := nip19.EncodePublicKey(pubkey); err == nil {
+		return encoded
+	}
+	return pubkey
+}
+
+// ownGiftWraps tells whether filter only asks for the gift wraps addressed
+// to pubkey. Only those gift wraps are served, and recipients may read them
+// even from a closed relay.
+func ownGiftWraps(filter nostr.Filter, pubkey string) bool {
+	return pubkey != "" && slices.Equal(filter.Kinds, []int{nostr.KindGiftWrap}) &&
+		len(filter.Tags) == 1 && slices.Equal(filter.Tags["p"], []string{pubkey}) &&
+		len(filter.Authors) == 0 && len(filter.IDs) == 0
+}
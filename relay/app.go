@@ -0,0 +1,953 @@
+// Package relay is the okay nostr relay: a khatru relay wired to a store,
+// access rules, policies, the NIP-86 management API and the background
+// workers that feed it. The okay binary is a command line over it; other
+// programs can embed it with New and serve App.Handler themselves.
+package relay
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// Options configure New. Config describes the whole relay; the other
+// fields let a program that embeds it bring its own store and override
+// parts of the config, also across reloads.
+type Options struct {
+	// Config defaults to DefaultConfig().
+	Config *Config
+
+	// Store holds the events and the management data. When nil it's opened
+	// from Config.Database. Shutdown closes it either way.
+	Store *Storage
+
+	// Info, Access and Policies replace the config sections of the same name.
+	Info     *InfoConfig
+	Access   *AccessConfig
+	Policies *PolicyConfig
+
+	// RejectEvent and RejectFilter are checked after the configured
+	// policies and before the access mode.
+	RejectEvent  []func(ctx context.Context, event *nostr.Event) (reject bool, msg string)
+	RejectFilter []func(ctx context.Context, filter nostr.Filter) (reject bool, msg string)
+}
+
+// apply returns a copy of cfg with the overrides of the options.
+func (opts *Options) apply(cfg *Config) *Config {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	copied := *cfg
+	if opts.Info != nil {
+		copied.Info = *opts.Info
+	}
+	if opts.Access != nil {
+		copied.Access = *opts.Access
+	}
+	if opts.Policies != nil {
+		copied.Policies = *opts.Policies
+	}
+	return &copied
+}
+
+// App is the fully configured relay: hooks, management API and the
+// background workers that feed it.
+type App struct {
+	*Storage
+
+	// Relay can be given more hooks before the app is started.
+	Relay *khatru.Relay
+	// Handler serves the relay, the management API, /healthz and /readyz.
+	Handler http.Handler
+	Metrics *Metrics
+
+	options    Options
+	nip05      *NIP05Verifier
+	config     atomic.Pointer[Config]
+	policies   *PolicySet
+	shadowed   shadowRejects
+	webhooks   *Webhooks
+	dms        *AdminDMs
+	content    *ContentFilter
+	rules      *AccessRules
+	drain      *Drain
+	background []worker
+	workers    workerStatus
+	stop       context.CancelFunc
+	running    sync.WaitGroup
+}
+
+// Config returns the current configuration.
+func (app *App) Config() *Config {
+	return app.config.Load()
+}
+
+// IsOwner tells whether pubkey is the relay owner's. It follows config
+// reloads.
+func (app *App) IsOwner(pubkey string) bool {
+	ownerPubKey := app.Config().Info.PubKey
+	return ownerPubKey != "" && pubkey == ownerPubKey
+}
+
+// IsMember tells whether an author may write in private mode (and read in
+// closed mode): the owner, allowlisted pubkeys and authors with a verified
+// NIP-05 on an allowed domain, unless they were banned.
+func (app *App) IsMember(ctx context.Context, event *nostr.Event) (bool, error) {
+	if app.IsOwner(event.PubKey) {
+		return true, nil
+	}
+	isBanned, err := app.dbManager.IsBannedPubkey(event.PubKey)
+	if err != nil || isBanned {
+		return false, err
+	}
+	// Check if the pubkey is allowed in the database
+	isAllowed, err := app.dbManager.IsAllowedPubkey(event.PubKey)
+	if err != nil || isAllowed {
+		return isAllowed, err
+	}
+
+	// only identifiers on allowed domains are verified
+	domain, err := app.nip05.VerifiedDomain(ctx, event)
+	if err != nil {
+		log.Printf("Error verifying nip05 for %s: %v", event.PubKey, err)
+		return false, nil
+	}
+	return domain != "", nil
+}
+
+// FlagEvent puts an event on the moderation queue and tells the admins who
+// want to know. Policies that flag events call it.
+func (app *App) FlagEvent(event *nostr.Event, reason string) error {
+	if err := app.dbManager.AddEventNeedingModeration(event.ID, reason); err != nil {
+		return err
+	}
+	app.dms.Notify(WebhookModerationFlagged, "", fmt.Sprintf("Event %s by %s was flagged for moderation: %s", event.ID, npub(event.PubKey), reason))
+	return nil
+}
+
+// Start launches the background workers (search backfill, mirroring, the
+// outbox, retention). They stop when ctx is canceled or on Shutdown.
+func (app *App) Start(ctx context.Context) {
+	ctx, app.stop = context.WithCancel(ctx)
+	for _, w := range app.background {
+		app.workers.set(w.name, "running", false)
+		app.running.Add(1)
+		go func() {
+			defer app.running.Done()
+			err := w.run(ctx)
+			switch {
+			case ctx.Err() != nil:
+				app.workers.set(w.name, "stopped", false)
+			case err != nil:
+				log.Printf("Error in %s: %v", w.name, err)
+				app.workers.set(w.name, "failed: "+err.Error(), true)
+			default:
+				app.workers.set(w.name, "done", false)
+			}
+		}()
+	}
+}
+
+// Shutdown stops the relay in order: the websocket connections
+// (subscribers get a CLOSED), the event writes in flight, the background
+// workers and finally the databases. The databases are closed even when
+// ctx expires first. Whoever serves Handler should stop accepting new
+// requests before.
+func (app *App) Shutdown(ctx context.Context) error {
+	var errs []error
+	if err := app.drain.Close(ctx); err != nil {
+		errs = append(errs, err)
+	}
+
+	if app.stop != nil {
+		app.stop()
+	}
+	done := make(chan struct{})
+	go func() {
+		app.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		errs = append(errs, errors.New("timed out waiting for background workers"))
+	}
+
+	app.policies.Close()
+	app.Close()
+	return errors.Join(errs...)
+}
+
+// Reload applies what can change at runtime from a new config: NIP-11
+// info, the access mode, policies, retention, webhooks and admin DMs.
+// Connections stay open; listen, database and feature settings need a
+// restart.
+func (app *App) Reload(cfg *Config) error {
+	cfg = app.options.apply(cfg)
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if err := app.policies.Update(cfg.Policies); err != nil {
+		return err
+	}
+	if err := app.applyInfo(cfg.Info); err != nil {
+		return err
+	}
+	app.config.Store(cfg)
+	return nil
+}
+
+// applyInfo sets the NIP-11 fields. Values changed through the management
+// API or `okay admin set-info` win over the config.
+func (app *App) applyInfo(info InfoConfig) error {
+	stored := make(map[string]string)
+	for _, key := range []string{"name", "description", "icon"} {
+		value, err := app.dbManager.GetRelayInfo(key)
+		if err != nil {
+			return fmt.Errorf("failed to load relay info: %w", err)
+		}
+		stored[key] = value
+	}
+
+	app.Relay.Info.Name = cmp.Or(stored["name"], info.Name)
+	app.Relay.Info.Description = cmp.Or(stored["description"], info.Description)
+	app.Relay.Info.Icon = cmp.Or(stored["icon"], info.Icon)
+	app.Relay.Info.PubKey = info.PubKey
+	app.Relay.Info.Contact = info.Contact
+	return nil
+}
+
+// New builds the relay. It isn't serving anything yet: Start runs the
+// background workers and App.Handler serves the relay.
+func New(opts Options) (app *App, err error) {
+	cfg := opts.apply(opts.Config)
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	st := opts.Store
+	if st == nil {
+		if st, err = OpenStorage(cfg.Database); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if err != nil {
+			st.Close()
+		}
+	}()
+
+	app = &App{Storage: st, options: opts, drain: NewDrain()}
+	app.config.Store(cfg)
+
+	// moderation and admin changes are sent to the webhooks, whether they
+	// come from the management API or from policies
+	app.webhooks = NewWebhooks(st.dbManager, func() WebhooksConfig { return app.Config().Webhooks })
+	st.NotifyWebhooks(app.webhooks)
+	app.background = append(app.background, worker{"webhooks", func(ctx context.Context) error {
+		app.webhooks.Run(ctx)
+		return nil
+	}})
+
+	sharedDB, db, dbManager := st.sharedDB, st.db, st.dbManager
+
+	// the rules of the content_filter policy
+	if app.content, err = NewContentFilter(dbManager); err != nil {
+		return nil, err
+	}
+	app.background = append(app.background, worker{"content filter", func(ctx context.Context) error {
+		app.content.Run(ctx)
+		return nil
+	}})
+
+	// the blocked IPs and kind rules of the management API
+	if app.rules, err = NewAccessRules(dbManager); err != nil {
+		return nil, err
+	}
+	app.background = append(app.background, worker{"access rules", func(ctx context.Context) error {
+		app.rules.Run(ctx)
+		return nil
+	}})
+
+	app.policies = NewPolicySet(app)
+	defer func(policies *PolicySet) {
+		if err != nil {
+			policies.Close()
+		}
+	}(app.policies)
+	if err := app.policies.Update(cfg.Policies); err != nil {
+		return nil, err
+	}
+
+	// create the relay instance
+	relay := khatru.NewRelay()
+	app.Relay = relay
+
+	// set up some basic properties (will be returned on the NIP-11 endpoint)
+	if err := app.applyInfo(cfg.Info); err != nil {
+		return nil, err
+	}
+	relay.Info.Version = "0.0.1"
+	relay.Info.Software = "https://github.com/mroxso/okay"
+
+	// the relay's own signing identity (not the owner's), advertised as NIP-11 "self"
+	relayKey, err := LoadRelayKey(cfg.Key.SecretKey, cfg.Key.File, cfg.Key.Passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load relay key: %w", err)
+	}
+
+	// NIP-17 DMs to the owner and admins, from the relay key
+	app.dms = NewAdminDMs(dbManager, db, relay, relayKey, app.Config)
+	app.background = append(app.background, worker{"admin dms", func(ctx context.Context) error {
+		app.dms.Run(ctx)
+		return nil
+	}})
+
+	// NIP-05 domain allowlisting: authors whose kind 0 nip05 resolves on an
+	// allowed domain may write
+	app.nip05 = NewNIP05Verifier(cfg.NIP05.CacheTTL, func(ctx context.Context, pubkey string) (*nostr.Event, error) {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		ch, err := db.QueryEvents(ctx, nostr.Filter{Authors: []string{pubkey}, Kinds: []int{nostr.KindProfileMetadata}, Limit: 1})
+		if err != nil {
+			return nil, err
+		}
+		return <-ch, nil
+	}, dbManager.IsAllowedNIP05Domain)
+
+	queryEvents := db.QueryEvents
+
+	// NIP-77 negentropy, reading only (created_at, id) from the event table
+	var negentropy *Negentropy
+	if cfg.Negentropy.Enabled {
+		negentropy = NewNegentropy(sharedDB, cfg.Negentropy.MaxRecords, cfg.Negentropy.MaxSessions, time.Minute)
+		if sharedDB != nil {
+			queryEvents = negentropy.WrapQuery(queryEvents)
+		}
+		relay.OnDisconnect = append(relay.OnDisconnect, negentropy.OnDisconnect)
+		relay.Negentropy = true
+		relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 77)
+	}
+
+	// NIP-50 full-text search over the eventstore's event table
+	if cfg.Search.Enabled && sharedDB == nil {
+		log.Printf("search needs the %s backend, disabled on %s", BackendPostgres, st.backend)
+	} else if cfg.Search.Enabled {
+		search, err := NewSearch(sharedDB, cfg.Search.Kinds)
+		if err != nil {
+			return nil, err
+		}
+		app.background = append(app.background, worker{"search backfill", func(ctx context.Context) error {
+			return search.Backfill(ctx, 1000)
+		}})
+		// search filters only have a search term and at most a few kinds,
+		// so the no_complex_filters policy keeps letting them through
+		queryEvents = search.WrapQuery(queryEvents)
+		relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 50)
+	}
+
+	// NIP-29 relay-based groups, signed with the relay's own key
+	var groups *Groups
+	if cfg.Groups.Enabled {
+		groups = NewGroups(dbManager, relay, db, relayKey)
+		groups.CanCreate = func(pubkey string) bool {
+			if app.IsOwner(pubkey) {
+				return true
+			}
+			isAllowed, err := dbManager.IsAllowedPubkey(pubkey)
+			return err == nil && isAllowed
+		}
+		queryEvents = groups.RestrictQuery(queryEvents)
+		relay.RejectEvent = append(relay.RejectEvent, groups.RejectEvent)
+		relay.RejectFilter = append(relay.RejectFilter, groups.RejectFilter)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, groups.RejectFilter)
+		relay.OnEventSaved = append(relay.OnEventSaved, groups.OnEventSaved)
+		relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 29)
+	}
+
+	// writes are tracked so shutdown can wait for them; shadow rejected
+	// events stop before being written
+	relay.StoreEvent = append(relay.StoreEvent, app.shadowed.check, app.drain.Track(db.SaveEvent))
+	relay.QueryEvents = append(relay.QueryEvents, queryEvents)
+
+	// NIP-45 COUNT: exact counts with a time limit, HLL for followers and
+	// reactions (Postgres only)
+	if eventCounter, ok := db.(eventstore.Counter); ok {
+		counter, err := NewCounter(sharedDB, eventCounter.CountEvents, cfg.Count.Timeout, cfg.Count.CacheTTL, 10000)
+		if err != nil {
+			return nil, err
+		}
+		// counts leave out the private groups the requester can't read, as
+		// queries do
+		countEvents, countEventsHLL := counter.CountEvents, counter.CountEventsHLL
+		if groups != nil {
+			countEvents = groups.RestrictCount(counter.CountEvents)
+			countEventsHLL = groups.RestrictCountHLL(counter.CountEventsHLL, counter.CountEvents)
+		}
+		relay.CountEvents = append(relay.CountEvents, countEvents)
+		relay.RejectCountFilter = append(relay.RejectCountFilter, counter.RejectCountFilter)
+		if sharedDB != nil {
+			relay.CountEventsHLL = append(relay.CountEventsHLL, countEventsHLL)
+			relay.OnEventSaved = append(relay.OnEventSaved, counter.OnEventSaved)
+		}
+		relay.Info.SupportedNIPs = append(relay.Info.SupportedNIPs, 45)
+	}
+
+	app.Metrics = NewMetrics(sharedDB, app.drain, app.policies)
+	relay.OnEventSaved = append(relay.OnEventSaved, app.Metrics.OnEventSaved)
+
+	// Personal outbox: forward what the owner and allowlisted users publish
+	// here to downstream relays
+	if len(cfg.Outbox.Relays) > 0 {
+		outbox := NewOutbox(dbManager, db, cfg.Outbox.Relays, func(event *nostr.Event) bool {
+			// group events stay in their group
+			if groups != nil && groups.Handles(event) {
+				return false
+			}
+			if app.IsOwner(event.PubKey) {
+				return true
+			}
+			isAllowed, err := dbManager.IsAllowedPubkey(event.PubKey)
+			return err == nil && isAllowed
+		})
+		app.background = append(app.background, worker{"outbox", func(ctx context.Context) error {
+			outbox.Run(ctx)
+			return nil
+		}})
+		relay.OnEventSaved = append(relay.OnEventSaved, outbox.OnEventSaved)
+	}
+
+	// Retention: delete events past their configured age
+	retention := NewRetention(sharedDB, db, func() RetentionConfig { return app.Config().Retention })
+	app.background = append(app.background, worker{"retention", func(ctx context.Context) error {
+		retention.Run(ctx)
+		return nil
+	}})
+
+	relay.DeleteEvent = append(relay.DeleteEvent, app.drain.Track(db.DeleteEvent))
+	relay.ReplaceEvent = append(relay.ReplaceEvent, app.shadowed.check, app.drain.Track(db.ReplaceEvent))
+
+	relay.RejectConnection = append(relay.RejectConnection, app.policies.RejectConnection, func(r *http.Request) bool {
+		return app.rules.BlockedIP(khatru.GetIPFromRequest(r))
+	})
+
+	// the configurable policies (reloaded with the config), the embedder's,
+	// the management API's IP and kind rules, then the access mode
+	relay.RejectEvent = append(relay.RejectEvent, app.drain.RejectEvent, app.policies.RejectEvent)
+	relay.RejectEvent = append(relay.RejectEvent, opts.RejectEvent...)
+	relay.RejectEvent = append(relay.RejectEvent,
+		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+			// connections opened before the block
+			if app.rules.BlockedIP(khatru.GetIP(ctx)) {
+				return true, "blocked: your IP address is blocked"
+			}
+			return false, ""
+		},
+		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+			if !app.rules.KindAllowed(event.Kind) {
+				return true, fmt.Sprintf("blocked: kind %d is not allowed here", event.Kind)
+			}
+			return false, ""
+		},
+		func(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+			// group events pass this too, and groups.RejectEvent applies
+			// the group's own rules on top
+			if app.Config().Access.Mode == AccessPublic {
+				isBanned, err := dbManager.IsBannedPubkey(event.PubKey)
+				if err != nil {
+					log.Printf("Error checking if pubkey is banned: %v", err)
+					return true, "error checking authorization"
+				}
+				if isBanned {
+					return true, "blocked: you are banned from this relay"
+				}
+				return false, ""
+			}
+
+			ok, err := app.IsMember(ctx, event)
+			if err != nil {
+				log.Printf("Error checking if pubkey is allowed: %v", err)
+				return true, "error checking authorization"
+			}
+			if ok {
+				return false, ""
+			}
+			return true, "this is a private relay, only the owner can write here"
+		},
+	)
+
+	// you can request auth by rejecting an event or a request with the prefix "auth-required: "
+	relay.RejectFilter = append(relay.RejectFilter, app.policies.RejectFilter)
+	relay.RejectFilter = append(relay.RejectFilter, opts.RejectFilter...)
+	relay.RejectFilter = append(relay.RejectFilter,
+		func(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+			pubkey := khatru.GetAuthed(ctx)
+			// gift wraps are only served to their recipients, whatever the
+			// mode; admins read the relay's DMs even when they aren't members
+			if ownGiftWraps(filter, pubkey) {
+				return false, ""
+			}
+			if slices.Contains(filter.Kinds, nostr.KindGiftWrap) {
+				if pubkey == "" {
+					return true, "auth-required: gift wraps are only served to their recipients"
+				}
+				return true, "restricted: gift wraps are only served to their recipients, ask for your own"
+			}
+
+			if app.Config().Access.Mode != AccessClosed {
+				return false, ""
+			}
+			if pubkey == "" {
+				return true, "auth-required: only authenticated users can read from this relay"
+			}
+			ok, err := app.IsMember(ctx, &nostr.Event{PubKey: pubkey})
+			if err != nil {
+				log.Printf("Error checking if pubkey is allowed: %v", err)
+				return true, "error checking authorization"
+			}
+			if ok {
+				return false, ""
+			}
+			return true, "restricted: this is a private relay, only authorized users can read here"
+		},
+	)
+
+	// negentropy limits go last so the access rules above decide first
+	if negentropy != nil {
+		relay.RejectFilter = append(relay.RejectFilter, negentropy.RejectFilter)
+	}
+
+	// connection tracking for graceful shutdown; its RejectFilter records
+	// accepted subscriptions, so it has to run after every other one
+	relay.OnConnect = append(relay.OnConnect, app.drain.OnConnect)
+	relay.OnDisconnect = append(relay.OnDisconnect, app.drain.OnDisconnect)
+	relay.RejectFilter = append(relay.RejectFilter, app.drain.RejectFilter)
+
+	// canCall tells whether a pubkey may call a management method: the owner
+	// may call all of them, admins the ones granted to them
+	canCall := func(pubkey, method string) bool {
+		if app.IsOwner(pubkey) {
+			return true
+		}
+		methods, err := dbManager.GetAdminMethods(pubkey)
+		if err != nil {
+			log.Printf("Error checking admin methods: %v", err)
+			return false
+		}
+		// every admin may ask what there is and choose their DMs
+		if method == "supportedmethods" || method == "getdmpreferences" || method == "setdmpreferences" {
+			return len(methods) > 0
+		}
+		return slices.Contains(methods, method)
+	}
+
+	// authorizeCall lets callers through to the API call policies
+	authorizeCall := func(ctx context.Context, pubkey, method string) (reject bool, msg string) {
+		if !canCall(pubkey, method) {
+			return true, "go away, intruder"
+		}
+		return app.policies.RejectAPICall(ctx, pubkey, method)
+	}
+
+	// management endpoints
+	relay.ManagementAPI.RejectAPICall = append(relay.ManagementAPI.RejectAPICall,
+		func(ctx context.Context, mp nip86.MethodParams) (reject bool, msg string) {
+			return authorizeCall(ctx, khatru.GetAuthed(ctx), mp.MethodName())
+		})
+
+	// notifyBan tells the other admins about a ban made through the API
+	notifyBan := func(ctx context.Context, kind, action, reason string) {
+		actor := khatru.GetAuthed(ctx)
+		app.dms.Notify(kind, actor, fmt.Sprintf("%s %s: %s", npub(actor), action, reason))
+	}
+
+	// Pubkey management
+	relay.ManagementAPI.AllowPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		return dbManager.AddAllowedPubkey(pubkey, reason)
+	}
+
+	relay.ManagementAPI.BanPubKey = func(ctx context.Context, pubkey string, reason string) error {
+		// Remove from allowed list and add to banned list
+		if err := dbManager.RemoveAllowedPubkey(pubkey); err != nil {
+			// Ignore error if pubkey wasn't in allowed list
+			log.Printf("Warning: could not remove pubkey from allowed list: %v", err)
+		}
+		if err := dbManager.BanPubKey(pubkey, reason); err != nil {
+			return err
+		}
+		notifyBan(ctx, WebhookPubkeyBanned, "banned "+npub(pubkey), reason)
+		return nil
+	}
+
+	relay.ManagementAPI.ListAllowedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return dbManager.GetAllowedPubkeysWithReason()
+	}
+
+	relay.ManagementAPI.ListBannedPubKeys = func(ctx context.Context) ([]nip86.PubKeyReason, error) {
+		return dbManager.GetBannedPubkeys()
+	}
+
+	// Event moderation
+	relay.ManagementAPI.ListEventsNeedingModeration = func(ctx context.Context) ([]nip86.IDReason, error) {
+		return dbManager.GetEventsNeedingModeration()
+	}
+
+	relay.ManagementAPI.AllowEvent = func(ctx context.Context, id string, reason string) error {
+		return dbManager.AllowEvent(id, reason)
+	}
+
+	relay.ManagementAPI.BanEvent = func(ctx context.Context, id string, reason string) error {
+		if err := dbManager.BanEvent(id, reason); err != nil {
+			return err
+		}
+		notifyBan(ctx, WebhookEventBanned, "banned event "+id, reason)
+		return nil
+	}
+
+	relay.ManagementAPI.ListBannedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		return dbManager.GetBannedEvents()
+	}
+
+	relay.ManagementAPI.ListAllowedEvents = func(ctx context.Context) ([]nip86.IDReason, error) {
+		return dbManager.GetAllowedEvents()
+	}
+
+	// Relay info management
+	relay.ManagementAPI.ChangeRelayName = func(ctx context.Context, name string) error {
+		if err := dbManager.SetRelayInfo("name", name); err != nil {
+			return err
+		}
+		relay.Info.Name = name
+		return nil
+	}
+
+	relay.ManagementAPI.ChangeRelayDescription = func(ctx context.Context, desc string) error {
+		if err := dbManager.SetRelayInfo("description", desc); err != nil {
+			return err
+		}
+		relay.Info.Description = desc
+		return nil
+	}
+
+	relay.ManagementAPI.ChangeRelayIcon = func(ctx context.Context, icon string) error {
+		if err := dbManager.SetRelayInfo("icon", icon); err != nil {
+			return err
+		}
+		relay.Info.Icon = icon
+		return nil
+	}
+
+	// Kind management
+	relay.ManagementAPI.AllowKind = func(ctx context.Context, kind int) error {
+		return app.rules.reloadAfter(dbManager.AllowKind(kind))
+	}
+
+	relay.ManagementAPI.DisallowKind = func(ctx context.Context, kind int) error {
+		return app.rules.reloadAfter(dbManager.DisallowKind(kind))
+	}
+
+	relay.ManagementAPI.ListAllowedKinds = func(ctx context.Context) ([]int, error) {
+		return dbManager.GetAllowedKinds()
+	}
+
+	relay.ManagementAPI.ListDisAllowedKinds = func(ctx context.Context) ([]int, error) {
+		return dbManager.GetDisallowedKinds()
+	}
+
+	// IP blocking
+	relay.ManagementAPI.BlockIP = func(ctx context.Context, ip net.IP, reason string) error {
+		if err := app.rules.reloadAfter(dbManager.BlockIP(ip, reason)); err != nil {
+			return err
+		}
+		notifyBan(ctx, WebhookIPBlocked, "blocked IP "+ip.String(), reason)
+		return nil
+	}
+
+	relay.ManagementAPI.UnblockIP = func(ctx context.Context, ip net.IP, reason string) error {
+		return app.rules.reloadAfter(dbManager.UnblockIP(ip))
+	}
+
+	relay.ManagementAPI.ListBlockedIPs = func(ctx context.Context) ([]nip86.IPReason, error) {
+		return dbManager.GetBlockedIPs()
+	}
+
+	// Stats
+	relay.ManagementAPI.Stats = func(ctx context.Context) (nip86.Response, error) {
+		// Get basic stats from the database
+		var stats nip86.Response
+		// You can extend this to include actual statistics
+		// For now, return a simple response
+		stats.Result = map[string]interface{}{
+			"version":           relay.Info.Version,
+			"name":              relay.Info.Name,
+			"policy_rejections": app.policies.Rejections(),
+		}
+		return stats, nil
+	}
+
+	// Mirror allowlisted authors from upstream relays; mirrored events go
+	// through relay.AddEvent, so they're checked by the RejectEvent policies above
+	mirror := NewMirror(dbManager, relay, func() ([]string, error) {
+		pubkeys, err := dbManager.GetAllowedPubkeys()
+		if err != nil {
+			return nil, err
+		}
+		if ownerPubKey := app.Config().Info.PubKey; ownerPubKey != "" && !slices.Contains(pubkeys, ownerPubKey) {
+			pubkeys = append(pubkeys, ownerPubKey)
+		}
+		return pubkeys, nil
+	})
+	for _, url := range cfg.Mirror.Upstreams {
+		if err := dbManager.AddMirrorUpstream(nostr.NormalizeURL(url)); err != nil {
+			return nil, fmt.Errorf("failed to add mirror upstream %s: %w", url, err)
+		}
+	}
+	app.background = append(app.background, worker{"mirror", func(ctx context.Context) error {
+		if err := mirror.Start(ctx); err != nil {
+			return err
+		}
+		<-ctx.Done()
+		mirror.Wait()
+		return nil
+	}})
+
+	// Custom management methods that go beyond NIP-86
+	management := NewManagementExtensions(relay)
+	management.Authorize = authorizeCall
+
+	// Admin management: served here rather than by khatru because go-nostr
+	// expects the methods param to be a []string, which JSON never decodes to
+	management.Register("grantadmin", func(ctx context.Context, params []any) (any, error) {
+		pubkey, err := stringParam("grantadmin", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		methods, err := stringListParam("grantadmin", params, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(methods) == 0 {
+			return nil, fmt.Errorf("no methods to grant")
+		}
+		if err := dbManager.GrantAdmin(pubkey, methods); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("revokeadmin", func(ctx context.Context, params []any) (any, error) {
+		pubkey, err := stringParam("revokeadmin", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		// without methods, all of them are revoked
+		var methods []string
+		if len(params) > 1 && params[1] != nil {
+			if methods, err = stringListParam("revokeadmin", params, 1); err != nil {
+				return nil, err
+			}
+		}
+		if err := dbManager.RevokeAdmin(pubkey, methods); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("listadmins", func(ctx context.Context, params []any) (any, error) {
+		return dbManager.GetAdmins()
+	})
+
+	// Admin DM preferences, each admin's own
+	management.Register("getdmpreferences", func(ctx context.Context, params []any) (any, error) {
+		return app.dms.Preferences(managementCaller(ctx))
+	})
+
+	management.Register("setdmpreferences", func(ctx context.Context, params []any) (any, error) {
+		types, err := stringListParam("setdmpreferences", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := app.dms.SetPreferences(managementCaller(ctx), types); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	// NIP-05 domain management
+	management.Register("allownip05domain", func(ctx context.Context, params []any) (any, error) {
+		domain, err := stringParam("allownip05domain", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbManager.AllowNIP05Domain(domain, optionalStringParam(params, 1)); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("disallownip05domain", func(ctx context.Context, params []any) (any, error) {
+		domain, err := stringParam("disallownip05domain", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := dbManager.DisallowNIP05Domain(domain); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("listallowednip05domains", func(ctx context.Context, params []any) (any, error) {
+		return dbManager.GetAllowedNIP05Domains()
+	})
+
+	// Mirror management
+	management.Register("addmirrorupstream", func(ctx context.Context, params []any) (any, error) {
+		url, err := stringParam("addmirrorupstream", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := mirror.AddUpstream(url); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("removemirrorupstream", func(ctx context.Context, params []any) (any, error) {
+		url, err := stringParam("removemirrorupstream", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := mirror.RemoveUpstream(url); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("resyncmirrorupstream", func(ctx context.Context, params []any) (any, error) {
+		url, err := stringParam("resyncmirrorupstream", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := mirror.Resync(url); err != nil {
+			return nil, err
+		}
+		return true, nil
+	})
+
+	management.Register("listmirrorupstreams", func(ctx context.Context, params []any) (any, error) {
+		return mirror.Status()
+	})
+
+	// Content filter rules, applied right away
+	management.Register("addcontentrule", func(ctx context.Context, params []any) (any, error) {
+		var rule ContentRule
+		var err error
+		for i, field := range []*string{&rule.Type, &rule.Pattern, &rule.Action} {
+			if *field, err = stringParam("addcontentrule", params, i); err != nil {
+				return nil, err
+			}
+		}
+		rule.Reason = optionalStringParam(params, 3)
+		if rule, err = NormalizeContentRule(rule); err != nil {
+			return nil, err
+		}
+		if err := dbManager.AddContentRule(rule); err != nil {
+			return nil, err
+		}
+		return true, app.content.Reload()
+	})
+
+	management.Register("removecontentrule", func(ctx context.Context, params []any) (any, error) {
+		kind, err := stringParam("removecontentrule", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := stringParam("removecontentrule", params, 1)
+		if err != nil {
+			return nil, err
+		}
+		// the pattern is looked up the way it was stored
+		if rule, err := NormalizeContentRule(ContentRule{Type: kind, Pattern: pattern, Action: ContentReject}); err == nil {
+			pattern = rule.Pattern
+		}
+		found, err := dbManager.RemoveContentRule(kind, pattern)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return nil, fmt.Errorf("no %s rule %q", kind, pattern)
+		}
+		return true, app.content.Reload()
+	})
+
+	management.Register("listcontentrules", func(ctx context.Context, params []any) (any, error) {
+		return dbManager.GetContentRules()
+	})
+
+	// Outbox dead letters
+	management.Register("listfailedoutboxdeliveries", func(ctx context.Context, params []any) (any, error) {
+		return dbManager.GetDeadOutboxDeliveries()
+	})
+
+	management.Register("retryoutboxdelivery", func(ctx context.Context, params []any) (any, error) {
+		id, err := stringParam("retryoutboxdelivery", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		url := optionalStringParam(params, 1)
+		if url != "" {
+			url = nostr.NormalizeURL(url)
+		}
+		return dbManager.RetryOutboxDeliveries(id, url)
+	})
+
+	// Webhook delivery log
+	management.Register("listwebhookdeliveries", func(ctx context.Context, params []any) (any, error) {
+		limit := 100
+		if len(params) > 0 {
+			n, ok := params[0].(float64)
+			if !ok || n < 1 {
+				return nil, fmt.Errorf("invalid limit")
+			}
+			limit = int(n)
+		}
+		return dbManager.GetWebhookDeliveries(limit)
+	})
+
+	management.Register("retrywebhookdelivery", func(ctx context.Context, params []any) (any, error) {
+		id, err := stringParam("retrywebhookdelivery", params, 0)
+		if err != nil {
+			return nil, err
+		}
+		count, err := dbManager.RetryWebhookDeliveries(id, optionalStringParam(params, 1))
+		if err == nil && count > 0 {
+			app.webhooks.queue().signal()
+		}
+		return count, err
+	})
+
+	mux := relay.Router()
+	// set up other http handlers
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "text/html")
+		fmt.Fprintf(w, `Welcome! This is a <b>nostr</b> relay!`)
+	})
+	mux.HandleFunc("/healthz", app.ServeHealthz)
+	mux.HandleFunc("/readyz", app.ServeReadyz)
+
+	app.Handler = withNIP11Self(management, relayKey.PublicKey)
+	return app, nil
+}
@@ -0,0 +1,343 @@
+package relay
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// What content filter rules look for.
+const (
+	// ContentWord matches a word or phrase, whole words only and ignoring case.
+	ContentWord = "word"
+	// ContentRegex matches a Go regular expression.
+	ContentRegex = "regex"
+	// ContentDomain matches links to a domain and its subdomains.
+	ContentDomain = "domain"
+)
+
+// What content filter rules do with the events they match, from the
+// mildest to the strictest: when several rules match, the strictest wins.
+const (
+	// ContentModerate accepts the event and puts it on the moderation queue.
+	ContentModerate     = "moderate"
+	ContentShadowReject = "shadow_reject"
+	ContentReject       = "reject"
+)
+
+var (
+	contentRuleTypes   = []string{ContentWord, ContentRegex, ContentDomain}
+	contentRuleActions = []string{ContentModerate, ContentShadowReject, ContentReject}
+)
+
+// contentReloadInterval is how often rules are read again, for the changes
+// made by other processes such as `okay admin`.
+const contentReloadInterval = time.Minute
+
+// NormalizeContentRule checks a rule and puts its pattern in the form it's
+// stored in: words and domains lowercase, domains without scheme or path.
+func NormalizeContentRule(rule ContentRule) (ContentRule, error) {
+	if !slices.Contains(contentRuleActions, rule.Action) {
+		return rule, fmt.Errorf("invalid action %q, must be one of %s", rule.Action, strings.Join(contentRuleActions, ", "))
+	}
+	switch rule.Type {
+	case ContentWord:
+		rule.Pattern = strings.ToLower(strings.Join(strings.Fields(rule.Pattern), " "))
+	case ContentRegex:
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			return rule, fmt.Errorf("invalid regex: %w", err)
+		}
+	case ContentDomain:
+		domain := strings.ToLower(strings.TrimSpace(rule.Pattern))
+		if u, err := url.Parse(domain); err == nil && u.Host != "" {
+			domain = u.Hostname()
+		}
+		domain = strings.TrimPrefix(strings.TrimPrefix(domain, "*."), ".")
+		if hostPattern.FindString(domain) != domain {
+			return rule, fmt.Errorf("invalid domain %q", rule.Pattern)
+		}
+		rule.Pattern = domain
+	default:
+		return rule, fmt.Errorf("invalid rule type %q, must be one of %s", rule.Type, strings.Join(contentRuleTypes, ", "))
+	}
+	if rule.Pattern == "" {
+		return rule, fmt.Errorf("pattern cannot be empty")
+	}
+	return rule, nil
+}
+
+// ContentFilter matches text against the content rules of the management
+// store. The rules are compiled once per change: words into an
+// Aho-Corasick automaton and domains into a set, so the time a check takes
+// hardly grows with the number of rules. Regexes are tried together first.
+type ContentFilter struct {
+	dbm     ManagementStore
+	current atomic.Pointer[contentMatcher]
+}
+
+type contentMatcher struct {
+	words      *ahoCorasick
+	wordRules  []ContentRule
+	anyRegex   *regexp.Regexp
+	regexes    []*regexp.Regexp
+	regexRules []ContentRule
+	domains    map[string]ContentRule
+}
+
+// NewContentFilter loads the rules of dbm.
+func NewContentFilter(dbm ManagementStore) (*ContentFilter, error) {
+	cf := &ContentFilter{dbm: dbm}
+	if err := cf.Reload(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// Reload reads the rules again. Stored rules that don't compile are
+// skipped.
+func (cf *ContentFilter) Reload() error {
+	rules, err := cf.dbm.GetContentRules()
+	if err != nil {
+		return fmt.Errorf("failed to load content rules: %w", err)
+	}
+
+	m := &contentMatcher{domains: make(map[string]ContentRule)}
+	var words, regexes []string
+	for _, rule := range rules {
+		switch rule.Type {
+		case ContentWord:
+			words = append(words, rule.Pattern)
+			m.wordRules = append(m.wordRules, rule)
+		case ContentRegex:
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				log.Printf("Error compiling content rule %q: %v", rule.Pattern, err)
+				continue
+			}
+			regexes = append(regexes, "(?:"+rule.Pattern+")")
+			m.regexes = append(m.regexes, re)
+			m.regexRules = append(m.regexRules, rule)
+		case ContentDomain:
+			m.domains[rule.Pattern] = rule
+		}
+	}
+	m.words = newAhoCorasick(words)
+	if len(regexes) > 0 {
+		if m.anyRegex, err = regexp.Compile(strings.Join(regexes, "|")); err != nil {
+			return fmt.Errorf("failed to compile content rules: %w", err)
+		}
+	}
+	cf.current.Store(m)
+	return nil
+}
+
+// Run reads the rules again every minute until ctx is canceled.
+func (cf *ContentFilter) Run(ctx context.Context) {
+	ticker := time.NewTicker(contentReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := cf.Reload(); err != nil {
+				log.Printf("Error reloading content rules: %v", err)
+			}
+		}
+	}
+}
+
+// Match returns the strictest rule that matches any of texts.
+func (cf *ContentFilter) Match(texts ...string) (ContentRule, bool) {
+	m := cf.current.Load()
+	var matched ContentRule
+	found := false
+	match := func(rule ContentRule) {
+		if !found || slices.Index(contentRuleActions, rule.Action) > slices.Index(contentRuleActions, matched.Action) {
+			matched, found = rule, true
+		}
+	}
+
+	for _, text := range texts {
+		if found && matched.Action == ContentReject {
+			break
+		}
+		lower := strings.ToLower(text)
+		m.words.find(lower, func(i, start, end int) bool {
+			if !wordBoundary(lower, start, end) {
+				return true
+			}
+			match(m.wordRules[i])
+			return matched.Action != ContentReject
+		})
+		for _, host := range hostPattern.FindAllString(lower, -1) {
+			// the host and every domain above it
+			for domain := host; domain != ""; {
+				if rule, ok := m.domains[domain]; ok {
+					match(rule)
+				}
+				_, domain, _ = strings.Cut(domain, ".")
+			}
+		}
+		if m.anyRegex != nil && m.anyRegex.MatchString(text) {
+			for i, re := range m.regexes {
+				if re.MatchString(text) {
+					match(m.regexRules[i])
+				}
+			}
+		}
+	}
+	return matched, found
+}
+
+// hostPattern finds host names in text, with or without a scheme.
+var hostPattern = regexp.MustCompile(`(?:[a-z0-9](?:[a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z][a-z0-9-]{0,61}[a-z0-9]`)
+
+// wordBoundary tells whether text[start:end] is a whole word: the runes
+// around it aren't letters or digits.
+func wordBoundary(text string, start, end int) bool {
+	isWord := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) }
+	if before, _ := utf8.DecodeLastRuneInString(text[:start]); start > 0 && isWord(before) {
+		return false
+	}
+	if after, _ := utf8.DecodeRuneInString(text[end:]); end < len(text) && isWord(after) {
+		return false
+	}
+	return true
+}
+
+// ahoCorasick finds every occurrence of a set of patterns in one pass over
+// the text.
+type ahoCorasick struct {
+	nodes    []acNode
+	patterns []string
+}
+
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	// out are the patterns ending here, including through fail links
+	out []int32
+}
+
+func newAhoCorasick(patterns []string) *ahoCorasick {
+	ac := &ahoCorasick{nodes: []acNode{{}}, patterns: patterns}
+	for i, pattern := range patterns {
+		node := int32(0)
+		for j := 0; j < len(pattern); j++ {
+			next, ok := ac.nodes[node].next[pattern[j]]
+			if !ok {
+				if ac.nodes[node].next == nil {
+					ac.nodes[node].next = make(map[byte]int32)
+				}
+				next = int32(len(ac.nodes))
+				ac.nodes[node].next[pattern[j]] = next
+				ac.nodes = append(ac.nodes, acNode{})
+			}
+			node = next
+		}
+		ac.nodes[node].out = append(ac.nodes[node].out, int32(i))
+	}
+
+	// fail links, breadth first so the shorter suffixes are done first
+	queue := make([]int32, 0, len(ac.nodes))
+	for _, child := range ac.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for c, child := range ac.nodes[node].next {
+			fail := ac.nodes[node].fail
+			for {
+				if next, ok := ac.nodes[fail].next[c]; ok {
+					ac.nodes[child].fail = next
+					break
+				}
+				if fail == 0 {
+					break
+				}
+				fail = ac.nodes[fail].fail
+			}
+			ac.nodes[child].out = append(ac.nodes[child].out, ac.nodes[ac.nodes[child].fail].out...)
+			queue = append(queue, child)
+		}
+	}
+	return ac
+}
+
+// find calls fn with every match, the pattern index and where it is in
+// text, until fn returns false.
+func (ac *ahoCorasick) find(text string, fn func(i, start, end int) bool) {
+	if len(ac.patterns) == 0 {
+		return
+	}
+	node := int32(0)
+	for pos := 0; pos < len(text); pos++ {
+		for {
+			if next, ok := ac.nodes[node].next[text[pos]]; ok {
+				node = next
+				break
+			}
+			if node == 0 {
+				break
+			}
+			node = ac.nodes[node].fail
+		}
+		for _, i := range ac.nodes[node].out {
+			if !fn(int(i), pos+1-len(ac.patterns[i]), pos+1) {
+				return
+			}
+		}
+	}
+}
+
+// ContentFilterParams configure the content filter policy.
+type ContentFilterParams struct {
+	// Tags are the tags whose values are checked along with the content.
+	Tags []string `yaml:"tags"`
+}
+
+var defaultContentTags = []string{"subject", "title", "summary", "alt", "t", "r"}
+
+func init() {
+	RegisterPolicy("content_filter", func(app *App, p ContentFilterParams) (Policy, error) {
+		if p.Tags == nil {
+			p.Tags = defaultContentTags
+		}
+		return Policy{Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+			texts := []string{event.Content}
+			for _, tag := range event.Tags {
+				if len(tag) >= 2 && slices.Contains(p.Tags, tag[0]) {
+					texts = append(texts, tag[1:]...)
+				}
+			}
+			rule, ok := app.content.Match(texts...)
+			if !ok {
+				return false, ""
+			}
+			switch rule.Action {
+			case ContentModerate:
+				reason := cmp.Or(rule.Reason, fmt.Sprintf("matches %s %q", rule.Type, rule.Pattern))
+				if err := app.FlagEvent(event, reason); err != nil {
+					log.Printf("Error flagging event %s: %v", event.ID, err)
+				}
+				return false, ""
+			case ContentShadowReject:
+				return app.ShadowReject(event)
+			}
+			return true, "blocked: content not allowed here"
+		}}, nil
+	})
+}
@@ -0,0 +1,270 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip45"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// Counter serves NIP-45 COUNT requests. Exact counts run against the
+// eventstore under a timeout; the follower and reaction counts defined by
+// NIP-45 are answered from HyperLogLog registers kept in hll_registers,
+// which are built lazily and then updated as events are saved.
+type Counter struct {
+	db    *sql.DB
+	exact func(ctx context.Context, filter nostr.Filter) (int64, error)
+
+	// Timeout bounds every exact count and every HLL build.
+	Timeout time.Duration
+
+	cache *countCache
+}
+
+// NewCounter creates the HLL table and a counter with a result cache. With
+// a nil db the counter only does exact counts and CountEventsHLL mustn't be
+// used.
+func NewCounter(db *sql.DB, exact func(ctx context.Context, filter nostr.Filter) (int64, error), timeout, cacheTTL time.Duration, cacheSize int) (*Counter, error) {
+	counter := &Counter{
+		db:      db,
+		exact:   exact,
+		Timeout: timeout,
+		cache:   newCountCache(cacheTTL, cacheSize),
+	}
+	if db == nil {
+		return counter, nil
+	}
+
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS hll_registers (
+		ref VARCHAR(64) NOT NULL,
+		kind INTEGER NOT NULL,
+		registers BYTEA NOT NULL,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ref, kind)
+	)`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create hll_registers table: %w", err)
+	}
+	return counter, nil
+}
+
+// RejectCountFilter refuses COUNT filters that would scan the whole table.
+func (c *Counter) RejectCountFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if len(filter.IDs) > 0 || len(filter.Authors) > 0 || len(filter.Tags) > 0 {
+		return false, ""
+	}
+	if filter.Since != nil && len(filter.Kinds) > 0 {
+		return false, ""
+	}
+	return true, "blocked: count filters must include ids, authors or tags, or kinds with a since"
+}
+
+// CountEvents returns an exact count, cached, within the timeout.
+func (c *Counter) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	key := "exact:" + filter.String()
+	if count, _, ok := c.cache.get(key); ok {
+		return count, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	count, err := c.exact(ctx, filter)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return 0, fmt.Errorf("error: count took too long, try a narrower filter")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	c.cache.put(key, count, nil)
+	return count, nil
+}
+
+// CountEventsHLL answers the NIP-45 HLL cases (followers of a pubkey,
+// reactions to an event) with an approximate count and the registers.
+func (c *Counter) CountEventsHLL(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+	key := fmt.Sprintf("hll:%d:", offset) + filter.String()
+	if count, registers, ok := c.cache.get(key); ok {
+		return count, hyperloglog.NewWithRegisters(registers, offset), nil
+	}
+
+	kind := filter.Kinds[0]
+	var ref string
+	for _, values := range filter.Tags {
+		ref = values[0]
+	}
+
+	hll, err := c.loadHLL(ctx, ref, kind, offset)
+	if err != nil {
+		return 0, nil, err
+	}
+	if hll == nil {
+		if hll, err = c.buildHLL(ctx, filter, ref, kind, offset); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	count := int64(hll.Count())
+	c.cache.put(key, count, hll.GetRegisters())
+	return count, hll, nil
+}
+
+// OnEventSaved adds the author of follow lists and reactions to the
+// registers of every pubkey or event they reference.
+func (c *Counter) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	for ref, offset := range nip45.HyperLogLogEventPubkeyOffsetsAndReferencesForEvent(event) {
+		if err := c.addToHLL(ctx, ref, event.Kind, offset, event.PubKey); err != nil {
+			log.Printf("Error updating hll for %s: %v", ref, err)
+		}
+	}
+}
+
+func (c *Counter) loadHLL(ctx context.Context, ref string, kind, offset int) (*hyperloglog.HyperLogLog, error) {
+	var registers []byte
+	query := `SELECT registers FROM hll_registers WHERE ref = $1 AND kind = $2`
+	err := c.db.QueryRowContext(ctx, query, ref, kind).Scan(&registers)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load hll for %s: %w", ref, err)
+	}
+	return hyperloglog.NewWithRegisters(registers, offset), nil
+}
+
+// buildHLL computes the registers from stored events the first time a
+// reference is counted.
+func (c *Counter) buildHLL(ctx context.Context, filter nostr.Filter, ref string, kind, offset int) (*hyperloglog.HyperLogLog, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+
+	rows, err := c.db.QueryContext(ctx, `SELECT DISTINCT pubkey FROM event WHERE kind = $1 AND tagvalues && ARRAY[$2]`, kind, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build hll for %s: %w", ref, err)
+	}
+	defer rows.Close()
+
+	hll := hyperloglog.New(offset)
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, err
+		}
+		if nostr.IsValid32ByteHex(pubkey) {
+			hll.Add(pubkey)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("error: count took too long")
+		}
+		return nil, err
+	}
+
+	query := `INSERT INTO hll_registers (ref, kind, registers) VALUES ($1, $2, $3) ON CONFLICT (ref, kind) DO NOTHING`
+	if _, err := c.db.ExecContext(ctx, query, ref, kind, hll.GetRegisters()); err != nil {
+		return nil, fmt.Errorf("failed to store hll for %s: %w", ref, err)
+	}
+	return hll, nil
+}
+
+// addToHLL updates existing registers. References that were never counted
+// are skipped; they'll be built from the event table on first use.
+func (c *Counter) addToHLL(ctx context.Context, ref string, kind, offset int, pubkey string) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var registers []byte
+	err = tx.QueryRowContext(ctx, `SELECT registers FROM hll_registers WHERE ref = $1 AND kind = $2 FOR UPDATE`, ref, kind).Scan(&registers)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	hll := hyperloglog.NewWithRegisters(registers, offset)
+	hll.Add(pubkey)
+	if _, err := tx.ExecContext(ctx, `UPDATE hll_registers SET registers = $3, updated_at = CURRENT_TIMESTAMP WHERE ref = $1 AND kind = $2`,
+		ref, kind, hll.GetRegisters()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// countCache keeps recent count results for a short time so that popular
+// counts (like the reactions of a trending note) don't hit the database on
+// every request.
+type countCache struct {
+	ttl     time.Duration
+	maxSize int
+
+	mu      sync.Mutex
+	entries map[string]countCacheEntry
+}
+
+type countCacheEntry struct {
+	count     int64
+	registers []byte
+	expires   time.Time
+}
+
+func newCountCache(ttl time.Duration, maxSize int) *countCache {
+	return &countCache{ttl: ttl, maxSize: maxSize, entries: make(map[string]countCacheEntry)}
+}
+
+func (cc *countCache) get(key string) (int64, []byte, bool) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	entry, ok := cc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return 0, nil, false
+	}
+	var registers []byte
+	if entry.registers != nil {
+		registers = append([]byte(nil), entry.registers...)
+	}
+	return entry.count, registers, true
+}
+
+func (cc *countCache) put(key string, count int64, registers []byte) {
+	if cc.ttl <= 0 || cc.maxSize <= 0 {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if len(cc.entries) >= cc.maxSize {
+		now := time.Now()
+		for k, entry := range cc.entries {
+			if now.After(entry.expires) {
+				delete(cc.entries, k)
+			}
+		}
+		// still full: make room by dropping an arbitrary entry
+		for k := range cc.entries {
+			if len(cc.entries) < cc.maxSize {
+				break
+			}
+			delete(cc.entries, k)
+		}
+	}
+
+	if registers != nil {
+		registers = append([]byte(nil), registers...)
+	}
+	cc.entries[key] = countCacheEntry{count: count, registers: registers, expires: time.Now().Add(cc.ttl)}
+}
@@ -0,0 +1,1594 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// SQL dialects DBManager speaks. Queries use $n placeholders in both; the
+// SQLite connection rewrites them (see store_sqlite.go).
+const (
+	dialectPostgres = "postgres"
+	dialectSQLite   = "sqlite"
+)
+
+// DBManager handles the normal PostgreSQL (or SQLite) connection for non-event data
+type DBManager struct {
+	db      *sql.DB
+	dialect string
+	ownsDB  bool
+}
+
+// NewDBManager creates a new database manager using an existing *sql.DB
+// (for example from the khatru eventstore backend). It does not take
+// ownership of the connection and therefore does not Close it.
+func NewDBManager(existing *sql.DB) (*DBManager, error) {
+	return newDBManager(existing, dialectPostgres)
+}
+
+func newDBManager(existing *sql.DB, dialect string) (*DBManager, error) {
+	if existing == nil {
+		return nil, fmt.Errorf("existing db cannot be nil")
+	}
+
+	manager := &DBManager{db: existing, dialect: dialect}
+	if err := manager.initTables(); err != nil {
+		return nil, fmt.Errorf("failed to initialize database tables: %w", err)
+	}
+
+	return manager, nil
+}
+
+// initTables creates the necessary tables for the application.
+// This method is called automatically during DBManager initialization.
+func (dbm *DBManager) initTables() error {
+	tables := []string{
+		`CREATE TABLE IF NOT EXISTS allowed_pubkeys (
+			pubkey VARCHAR(64) PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS banned_pubkeys (
+			pubkey VARCHAR(64) PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS events_needing_moderation (
+			id VARCHAR(64) PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS allowed_events (
+			id VARCHAR(64) PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS banned_events (
+			id VARCHAR(64) PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS allowed_kinds (
+			kind INTEGER PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS disallowed_kinds (
+			kind INTEGER PRIMARY KEY,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS blocked_ips (
+			ip INET PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS admins (
+			pubkey VARCHAR(64) PRIMARY KEY,
+			methods TEXT[],
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS relay_info (
+			key VARCHAR(64) PRIMARY KEY,
+			value TEXT,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS allowed_nip05_domains (
+			domain VARCHAR(255) PRIMARY KEY,
+			reason TEXT,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS groups (
+			id VARCHAR(64) PRIMARY KEY,
+			name TEXT NOT NULL DEFAULT '',
+			about TEXT NOT NULL DEFAULT '',
+			picture TEXT NOT NULL DEFAULT '',
+			private BOOLEAN NOT NULL DEFAULT FALSE,
+			closed BOOLEAN NOT NULL DEFAULT FALSE,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS mirror_upstreams (
+			url TEXT PRIMARY KEY,
+			backfill_until BIGINT NOT NULL DEFAULT 0,
+			backfill_done BOOLEAN NOT NULL DEFAULT FALSE,
+			last_seen BIGINT NOT NULL DEFAULT 0,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_members (
+			group_id VARCHAR(64) REFERENCES groups(id) ON DELETE CASCADE,
+			pubkey VARCHAR(64),
+			roles TEXT[] NOT NULL DEFAULT '{}',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (group_id, pubkey)
+		)`,
+		`CREATE TABLE IF NOT EXISTS outbox_deliveries (
+			event_id VARCHAR(64),
+			relay_url TEXT,
+			event JSONB NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (event_id, relay_url)
+		)`,
+		`CREATE INDEX IF NOT EXISTS outbox_deliveries_due ON outbox_deliveries (next_attempt_at) WHERE status = 'pending'`,
+		`CREATE TABLE IF NOT EXISTS webhook_deliveries (
+			id VARCHAR(32),
+			url TEXT,
+			type VARCHAR(32) NOT NULL,
+			payload JSONB NOT NULL,
+			status VARCHAR(16) NOT NULL DEFAULT 'pending',
+			attempts INTEGER NOT NULL DEFAULT 0,
+			last_error TEXT NOT NULL DEFAULT '',
+			next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (id, url)
+		)`,
+		`CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at) WHERE status = 'pending'`,
+		`CREATE TABLE IF NOT EXISTS content_rules (
+			type VARCHAR(16),
+			pattern TEXT,
+			action VARCHAR(16) NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY (type, pattern)
+		)`,
+		`CREATE TABLE IF NOT EXISTS dm_preferences (
+			pubkey VARCHAR(64) PRIMARY KEY,
+			types TEXT[] NOT NULL DEFAULT '{}',
+			updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)`,
+	}
+
+	for _, query := range tables {
+		if _, err := dbm.db.Exec(query); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// AddAllowedPubkey adds a pubkey to the allowed list with an optional reason.
+// If the pubkey already exists, the operation is ignored (no error returned).
+func (dbm *DBManager) AddAllowedPubkey(pubkey, reason string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+
+	query := `INSERT INTO allowed_pubkeys (pubkey, reason) VALUES ($1, $2) ON CONFLICT (pubkey) DO NOTHING`
+	if _, err := dbm.db.Exec(query, pubkey, reason); err != nil {
+		return fmt.Errorf("failed to add allowed pubkey %s: %w", pubkey, err)
+	}
+
+	return nil
+}
+
+// RemoveAllowedPubkey removes a pubkey from the allowed list.
+// Returns an error if the pubkey is not found in the allowed list.
+func (dbm *DBManager) RemoveAllowedPubkey(pubkey string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+
+	query := `DELETE FROM allowed_pubkeys WHERE pubkey = $1`
+	result, err := dbm.db.Exec(query, pubkey)
+	if err != nil {
+		return fmt.Errorf("failed to remove allowed pubkey %s: %w", pubkey, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get rows affected for pubkey %s: %w", pubkey, err)
+	}
+
+	if rowsAffected == 0 {
+		return fmt.Errorf("pubkey %s not found in allowed list", pubkey)
+	}
+
+	return nil
+}
+
+// IsAllowedPubkey checks if a pubkey is in the allowed list.
+// Returns true if the pubkey is allowed, false otherwise.
+func (dbm *DBManager) IsAllowedPubkey(pubkey string) (bool, error) {
+	if pubkey == "" {
+		return false, nil
+	}
+
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM allowed_pubkeys WHERE pubkey = $1)`
+	if err := dbm.db.QueryRow(query, pubkey).Scan(&exists); err != nil {
+		return false, fmt.Errorf("failed to check if pubkey %s is allowed: %w", pubkey, err)
+	}
+
+	return exists, nil
+}
+
+// GetAllowedPubkeys returns all allowed pubkeys ordered by creation time.
+// Returns an empty slice if no pubkeys are found.
+func (dbm *DBManager) GetAllowedPubkeys() ([]string, error) {
+	query := `SELECT pubkey FROM allowed_pubkeys ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query allowed pubkeys: %w", err)
+	}
+	defer rows.Close()
+
+	var pubkeys []string
+	for rows.Next() {
+		var pubkey string
+		if err := rows.Scan(&pubkey); err != nil {
+			return nil, fmt.Errorf("failed to scan pubkey row: %w", err)
+		}
+		pubkeys = append(pubkeys, pubkey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error occurred while iterating over pubkey rows: %w", err)
+	}
+
+	return pubkeys, nil
+}
+
+// Close closes the database connection.
+// This should be called when the DBManager is no longer needed.
+func (dbm *DBManager) Close() error {
+	if dbm.db != nil && dbm.ownsDB {
+		// a shared *sql.DB is closed by whoever opened it
+		return dbm.db.Close()
+	}
+	return nil
+}
+
+// secondsFromNow is the SQL for the current time plus the number of
+// seconds in the given parameter.
+func (dbm *DBManager) secondsFromNow(param string) string {
+	if dbm.dialect == dialectSQLite {
+		return `datetime('now', ` + param + ` || ' seconds')`
+	}
+	return `CURRENT_TIMESTAMP + ` + param + ` * INTERVAL '1 second'`
+}
+
+// Health checks the database connection health.
+// Returns nil if the connection is healthy, an error otherwise.
+func (dbm *DBManager) Health(ctx context.Context) error {
+	if dbm.db == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	if err := dbm.db.PingContext(ctx); err != nil {
+		return fmt.Errorf("database ping failed: %w", err)
+	}
+
+	return nil
+}
+
+// requiredTables are the tables the relay can't work without: the
+// eventstore's and the ones created by initTables.
+var requiredTables = []string{
+	"event", "allowed_pubkeys", "banned_pubkeys", "events_needing_moderation",
+	"allowed_events", "banned_events", "allowed_kinds", "disallowed_kinds",
+	"blocked_ips", "admins", "relay_info", "allowed_nip05_domains", "groups",
+	"mirror_upstreams", "group_members", "outbox_deliveries", "webhook_deliveries",
+	"content_rules", "dm_preferences",
+}
+
+// MissingTables returns the required tables that don't exist, e.g. because
+// the schema wasn't created or was dropped under us.
+func (dbm *DBManager) MissingTables(ctx context.Context) ([]string, error) {
+	query := `SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()`
+	if dbm.dialect == dialectSQLite {
+		query = `SELECT name FROM sqlite_master WHERE type = 'table'`
+	}
+	rows, err := dbm.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check tables: %w", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, table := range requiredTables {
+		if !existing[table] {
+			missing = append(missing, table)
+		}
+	}
+	return missing, nil
+}
+
+// BanPubKey adds a pubkey to the banned list.
+func (dbm *DBManager) BanPubKey(pubkey, reason string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	query := `INSERT INTO banned_pubkeys (pubkey, reason) VALUES ($1, $2) ON CONFLICT (pubkey) DO UPDATE SET reason = $2`
+	_, err := dbm.db.Exec(query, pubkey, reason)
+	return err
+}
+
+// UnbanPubKey removes a pubkey from the banned list.
+func (dbm *DBManager) UnbanPubKey(pubkey string) error {
+	query := `DELETE FROM banned_pubkeys WHERE pubkey = $1`
+	_, err := dbm.db.Exec(query, pubkey)
+	return err
+}
+
+// IsBannedPubkey checks if a pubkey is banned.
+func (dbm *DBManager) IsBannedPubkey(pubkey string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM banned_pubkeys WHERE pubkey = $1)`
+	err := dbm.db.QueryRow(query, pubkey).Scan(&exists)
+	return exists, err
+}
+
+// GetBannedPubkeys returns all banned pubkeys.
+func (dbm *DBManager) GetBannedPubkeys() ([]nip86.PubKeyReason, error) {
+	query := `SELECT pubkey, reason FROM banned_pubkeys ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []nip86.PubKeyReason
+	for rows.Next() {
+		var pr nip86.PubKeyReason
+		if err := rows.Scan(&pr.PubKey, &pr.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, pr)
+	}
+	return result, rows.Err()
+}
+
+// GetAllowedPubkeysWithReason returns all allowed pubkeys with reasons.
+func (dbm *DBManager) GetAllowedPubkeysWithReason() ([]nip86.PubKeyReason, error) {
+	query := `SELECT pubkey, reason FROM allowed_pubkeys ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []nip86.PubKeyReason
+	for rows.Next() {
+		var pr nip86.PubKeyReason
+		if err := rows.Scan(&pr.PubKey, &pr.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, pr)
+	}
+	return result, rows.Err()
+}
+
+// AddEventNeedingModeration adds an event to the moderation queue.
+func (dbm *DBManager) AddEventNeedingModeration(id, reason string) error {
+	if id == "" {
+		return fmt.Errorf("event id cannot be empty")
+	}
+	query := `INSERT INTO events_needing_moderation (id, reason) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`
+	_, err := dbm.db.Exec(query, id, reason)
+	return err
+}
+
+// GetEventsNeedingModeration returns all events needing moderation.
+func (dbm *DBManager) GetEventsNeedingModeration() ([]nip86.IDReason, error) {
+	query := `SELECT id, reason FROM events_needing_moderation ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []nip86.IDReason
+	for rows.Next() {
+		var ir nip86.IDReason
+		if err := rows.Scan(&ir.ID, &ir.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, ir)
+	}
+	return result, rows.Err()
+}
+
+// AllowEvent adds an event to the allowed list and removes it from moderation queue.
+func (dbm *DBManager) AllowEvent(id, reason string) error {
+	if id == "" {
+		return fmt.Errorf("event id cannot be empty")
+	}
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO allowed_events (id, reason) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET reason = $2`, id, reason)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM events_needing_moderation WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM banned_events WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// BanEvent adds an event to the banned list and removes it from moderation queue.
+func (dbm *DBManager) BanEvent(id, reason string) error {
+	if id == "" {
+		return fmt.Errorf("event id cannot be empty")
+	}
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO banned_events (id, reason) VALUES ($1, $2) ON CONFLICT (id) DO UPDATE SET reason = $2`, id, reason)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM events_needing_moderation WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM allowed_events WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetBannedEvents returns all banned events.
+func (dbm *DBManager) GetBannedEvents() ([]nip86.IDReason, error) {
+	query := `SELECT id, reason FROM banned_events ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []nip86.IDReason
+	for rows.Next() {
+		var ir nip86.IDReason
+		if err := rows.Scan(&ir.ID, &ir.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, ir)
+	}
+	return result, rows.Err()
+}
+
+// GetAllowedEvents returns all allowed events.
+func (dbm *DBManager) GetAllowedEvents() ([]nip86.IDReason, error) {
+	query := `SELECT id, reason FROM allowed_events ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []nip86.IDReason
+	for rows.Next() {
+		var ir nip86.IDReason
+		if err := rows.Scan(&ir.ID, &ir.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, ir)
+	}
+	return result, rows.Err()
+}
+
+// AllowKind adds a kind to the allowed list.
+func (dbm *DBManager) AllowKind(kind int) error {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO allowed_kinds (kind) VALUES ($1) ON CONFLICT (kind) DO NOTHING`, kind)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM disallowed_kinds WHERE kind = $1`, kind)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisallowKind adds a kind to the disallowed list.
+func (dbm *DBManager) DisallowKind(kind int) error {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO disallowed_kinds (kind) VALUES ($1) ON CONFLICT (kind) DO NOTHING`, kind)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM allowed_kinds WHERE kind = $1`, kind)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetAllowedKinds returns all allowed kinds.
+func (dbm *DBManager) GetAllowedKinds() ([]int, error) {
+	query := `SELECT kind FROM allowed_kinds ORDER BY kind`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var kind int
+		if err := rows.Scan(&kind); err != nil {
+			return nil, err
+		}
+		result = append(result, kind)
+	}
+	return result, rows.Err()
+}
+
+// GetDisallowedKinds returns all disallowed kinds.
+func (dbm *DBManager) GetDisallowedKinds() ([]int, error) {
+	query := `SELECT kind FROM disallowed_kinds ORDER BY kind`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []int
+	for rows.Next() {
+		var kind int
+		if err := rows.Scan(&kind); err != nil {
+			return nil, err
+		}
+		result = append(result, kind)
+	}
+	return result, rows.Err()
+}
+
+// BlockIP adds an IP to the blocked list.
+func (dbm *DBManager) BlockIP(ip net.IP, reason string) error {
+	if ip == nil {
+		return fmt.Errorf("ip cannot be nil")
+	}
+	query := `INSERT INTO blocked_ips (ip, reason) VALUES ($1, $2) ON CONFLICT (ip) DO UPDATE SET reason = $2`
+	_, err := dbm.db.Exec(query, ip.String(), reason)
+	return err
+}
+
+// UnblockIP removes an IP from the blocked list.
+func (dbm *DBManager) UnblockIP(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("ip cannot be nil")
+	}
+	query := `DELETE FROM blocked_ips WHERE ip = $1`
+	_, err := dbm.db.Exec(query, ip.String())
+	return err
+}
+
+// GetBlockedIPs returns all blocked IPs.
+func (dbm *DBManager) GetBlockedIPs() ([]nip86.IPReason, error) {
+	query := `SELECT ip, reason FROM blocked_ips ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []nip86.IPReason
+	for rows.Next() {
+		var ir nip86.IPReason
+		if err := rows.Scan(&ir.IP, &ir.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, ir)
+	}
+	return result, rows.Err()
+}
+
+// SetRelayInfo sets a relay info field (name, description, icon).
+func (dbm *DBManager) SetRelayInfo(key, value string) error {
+	query := `INSERT INTO relay_info (key, value, updated_at) VALUES ($1, $2, CURRENT_TIMESTAMP) ON CONFLICT (key) DO UPDATE SET value = $2, updated_at = CURRENT_TIMESTAMP`
+	_, err := dbm.db.Exec(query, key, value)
+	return err
+}
+
+// GetRelayInfo gets a relay info field.
+func (dbm *DBManager) GetRelayInfo(key string) (string, error) {
+	var value string
+	query := `SELECT value FROM relay_info WHERE key = $1`
+	err := dbm.db.QueryRow(query, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return value, err
+}
+
+// GrantAdmin grants admin permissions to a pubkey.
+func (dbm *DBManager) GrantAdmin(pubkey string, methods []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	query := `INSERT INTO admins (pubkey, methods) VALUES ($1, $2) ON CONFLICT (pubkey) DO UPDATE SET methods = $2`
+	_, err := dbm.db.Exec(query, pubkey, pq.Array(methods))
+	return err
+}
+
+// RevokeAdmin revokes admin permissions from a pubkey.
+func (dbm *DBManager) RevokeAdmin(pubkey string, methods []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	if len(methods) == 0 {
+		// If no methods specified, revoke all admin access
+		query := `DELETE FROM admins WHERE pubkey = $1`
+		_, err := dbm.db.Exec(query, pubkey)
+		return err
+	}
+	// Otherwise, update methods list
+	var currentMethods []string
+	query := `SELECT methods FROM admins WHERE pubkey = $1`
+	err := dbm.db.QueryRow(query, pubkey).Scan(pq.Array(&currentMethods))
+	if err == sql.ErrNoRows {
+		return nil // Already not an admin
+	}
+	if err != nil {
+		return err
+	}
+	// Remove specified methods
+	methodMap := make(map[string]bool)
+	for _, m := range currentMethods {
+		methodMap[m] = true
+	}
+	for _, m := range methods {
+		delete(methodMap, m)
+	}
+	newMethods := make([]string, 0, len(methodMap))
+	for m := range methodMap {
+		newMethods = append(newMethods, m)
+	}
+	if len(newMethods) == 0 {
+		query = `DELETE FROM admins WHERE pubkey = $1`
+		_, err = dbm.db.Exec(query, pubkey)
+		return err
+	}
+	query = `UPDATE admins SET methods = $1 WHERE pubkey = $2`
+	_, err = dbm.db.Exec(query, pq.Array(newMethods), pubkey)
+	return err
+}
+
+// IsAdmin checks if a pubkey is an admin.
+func (dbm *DBManager) IsAdmin(pubkey string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM admins WHERE pubkey = $1)`
+	err := dbm.db.QueryRow(query, pubkey).Scan(&exists)
+	return exists, err
+}
+
+// GetAdminMethods returns the admin methods for a pubkey.
+func (dbm *DBManager) GetAdminMethods(pubkey string) ([]string, error) {
+	var methods []string
+	query := `SELECT methods FROM admins WHERE pubkey = $1`
+	err := dbm.db.QueryRow(query, pubkey).Scan(pq.Array(&methods))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return methods, err
+}
+
+// AdminMethods is an admin pubkey with the management methods it may call.
+type AdminMethods struct {
+	PubKey  string   `json:"pubkey"`
+	Methods []string `json:"methods"`
+}
+
+// GetAdmins returns all admins.
+func (dbm *DBManager) GetAdmins() ([]AdminMethods, error) {
+	query := `SELECT pubkey, methods FROM admins ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []AdminMethods
+	for rows.Next() {
+		var am AdminMethods
+		if err := rows.Scan(&am.PubKey, pq.Array(&am.Methods)); err != nil {
+			return nil, err
+		}
+		result = append(result, am)
+	}
+	return result, rows.Err()
+}
+
+// SetDMPreferences sets the notification types a pubkey gets as DMs.
+func (dbm *DBManager) SetDMPreferences(pubkey string, types []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	if types == nil {
+		types = []string{}
+	}
+	query := `INSERT INTO dm_preferences (pubkey, types) VALUES ($1, $2)
+		ON CONFLICT (pubkey) DO UPDATE SET types = $2, updated_at = CURRENT_TIMESTAMP`
+	_, err := dbm.db.Exec(query, pubkey, pq.Array(types))
+	return err
+}
+
+// GetDMPreferences returns the notification types a pubkey gets as DMs,
+// and whether it ever set them.
+func (dbm *DBManager) GetDMPreferences(pubkey string) ([]string, bool, error) {
+	var types []string
+	query := `SELECT types FROM dm_preferences WHERE pubkey = $1`
+	err := dbm.db.QueryRow(query, pubkey).Scan(pq.Array(&types))
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	return types, err == nil, err
+}
+
+// DomainReason is a NIP-05 domain together with the reason it was allowed.
+type DomainReason struct {
+	Domain string `json:"domain"`
+	Reason string `json:"reason"`
+}
+
+// AllowNIP05Domain adds a domain whose verified NIP-05 identifiers may write.
+func (dbm *DBManager) AllowNIP05Domain(domain, reason string) error {
+	if domain == "" {
+		return fmt.Errorf("domain cannot be empty")
+	}
+	query := `INSERT INTO allowed_nip05_domains (domain, reason) VALUES ($1, $2) ON CONFLICT (domain) DO UPDATE SET reason = $2`
+	_, err := dbm.db.Exec(query, strings.ToLower(domain), reason)
+	return err
+}
+
+// DisallowNIP05Domain removes a domain from the NIP-05 allowlist.
+func (dbm *DBManager) DisallowNIP05Domain(domain string) error {
+	if domain == "" {
+		return fmt.Errorf("domain cannot be empty")
+	}
+	query := `DELETE FROM allowed_nip05_domains WHERE domain = $1`
+	_, err := dbm.db.Exec(query, strings.ToLower(domain))
+	return err
+}
+
+// IsAllowedNIP05Domain checks if a domain is in the NIP-05 allowlist.
+func (dbm *DBManager) IsAllowedNIP05Domain(domain string) (bool, error) {
+	var exists bool
+	query := `SELECT EXISTS(SELECT 1 FROM allowed_nip05_domains WHERE domain = $1)`
+	err := dbm.db.QueryRow(query, strings.ToLower(domain)).Scan(&exists)
+	return exists, err
+}
+
+// GetAllowedNIP05Domains returns all allowed NIP-05 domains.
+func (dbm *DBManager) GetAllowedNIP05Domains() ([]DomainReason, error) {
+	query := `SELECT domain, reason FROM allowed_nip05_domains ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []DomainReason
+	for rows.Next() {
+		var dr DomainReason
+		if err := rows.Scan(&dr.Domain, &dr.Reason); err != nil {
+			return nil, err
+		}
+		result = append(result, dr)
+	}
+	return result, rows.Err()
+}
+
+// ContentRule is a word, regex or domain the content filter looks for, and
+// what it does with the events that have it.
+type ContentRule struct {
+	Type      string    `json:"type"`
+	Pattern   string    `json:"pattern"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AddContentRule adds a content filter rule, or changes the action and
+// reason of an existing one.
+func (dbm *DBManager) AddContentRule(rule ContentRule) error {
+	if rule.Type == "" || rule.Pattern == "" {
+		return fmt.Errorf("rule type and pattern cannot be empty")
+	}
+	query := `INSERT INTO content_rules (type, pattern, action, reason) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (type, pattern) DO UPDATE SET action = $3, reason = $4`
+	_, err := dbm.db.Exec(query, rule.Type, rule.Pattern, rule.Action, rule.Reason)
+	return err
+}
+
+// RemoveContentRule removes a content filter rule. It returns whether there
+// was one.
+func (dbm *DBManager) RemoveContentRule(kind, pattern string) (bool, error) {
+	result, err := dbm.db.Exec(`DELETE FROM content_rules WHERE type = $1 AND pattern = $2`, kind, pattern)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// GetContentRules returns all content filter rules.
+func (dbm *DBManager) GetContentRules() ([]ContentRule, error) {
+	query := `SELECT type, pattern, action, reason, created_at FROM content_rules ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []ContentRule
+	for rows.Next() {
+		var rule ContentRule
+		if err := rows.Scan(&rule.Type, &rule.Pattern, &rule.Action, &rule.Reason, &rule.CreatedAt); err != nil {
+			return nil, err
+		}
+		result = append(result, rule)
+	}
+	return result, rows.Err()
+}
+
+// GroupRecord is the persisted metadata of a NIP-29 group.
+type GroupRecord struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	About   string `json:"about"`
+	Picture string `json:"picture"`
+	Private bool   `json:"private"`
+	Closed  bool   `json:"closed"`
+}
+
+// CreateGroup inserts a new group. Returns an error if the id is taken.
+func (dbm *DBManager) CreateGroup(group GroupRecord) error {
+	if group.ID == "" {
+		return fmt.Errorf("group id cannot be empty")
+	}
+	query := `INSERT INTO groups (id, name, about, picture, private, closed) VALUES ($1, $2, $3, $4, $5, $6)`
+	if _, err := dbm.db.Exec(query, group.ID, group.Name, group.About, group.Picture, group.Private, group.Closed); err != nil {
+		return fmt.Errorf("failed to create group %s: %w", group.ID, err)
+	}
+	return nil
+}
+
+// UpdateGroup overwrites the metadata of an existing group.
+func (dbm *DBManager) UpdateGroup(group GroupRecord) error {
+	query := `UPDATE groups SET name = $2, about = $3, picture = $4, private = $5, closed = $6, updated_at = CURRENT_TIMESTAMP WHERE id = $1`
+	_, err := dbm.db.Exec(query, group.ID, group.Name, group.About, group.Picture, group.Private, group.Closed)
+	return err
+}
+
+// DeleteGroup removes a group and, through the foreign key, its members.
+func (dbm *DBManager) DeleteGroup(id string) error {
+	query := `DELETE FROM groups WHERE id = $1`
+	_, err := dbm.db.Exec(query, id)
+	return err
+}
+
+// GetGroup returns a group by id, or nil if it doesn't exist.
+func (dbm *DBManager) GetGroup(id string) (*GroupRecord, error) {
+	var g GroupRecord
+	query := `SELECT id, name, about, picture, private, closed FROM groups WHERE id = $1`
+	err := dbm.db.QueryRow(query, id).Scan(&g.ID, &g.Name, &g.About, &g.Picture, &g.Private, &g.Closed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+// GetGroups returns all groups ordered by creation time.
+func (dbm *DBManager) GetGroups() ([]GroupRecord, error) {
+	query := `SELECT id, name, about, picture, private, closed FROM groups ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []GroupRecord
+	for rows.Next() {
+		var g GroupRecord
+		if err := rows.Scan(&g.ID, &g.Name, &g.About, &g.Picture, &g.Private, &g.Closed); err != nil {
+			return nil, err
+		}
+		result = append(result, g)
+	}
+	return result, rows.Err()
+}
+
+// PutGroupMember adds a member to a group or replaces their roles.
+// Members with at least one role are group admins.
+func (dbm *DBManager) PutGroupMember(groupID, pubkey string, roles []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	query := `INSERT INTO group_members (group_id, pubkey, roles) VALUES ($1, $2, $3) ON CONFLICT (group_id, pubkey) DO UPDATE SET roles = $3`
+	_, err := dbm.db.Exec(query, groupID, pubkey, pq.Array(roles))
+	return err
+}
+
+// RemoveGroupMember removes a member from a group.
+func (dbm *DBManager) RemoveGroupMember(groupID, pubkey string) error {
+	query := `DELETE FROM group_members WHERE group_id = $1 AND pubkey = $2`
+	_, err := dbm.db.Exec(query, groupID, pubkey)
+	return err
+}
+
+// GetGroupMemberRoles returns the roles of a group member. The second return
+// value is false when the pubkey is not a member.
+func (dbm *DBManager) GetGroupMemberRoles(groupID, pubkey string) ([]string, bool, error) {
+	var roles []string
+	query := `SELECT roles FROM group_members WHERE group_id = $1 AND pubkey = $2`
+	err := dbm.db.QueryRow(query, groupID, pubkey).Scan(pq.Array(&roles))
+	if err == sql.ErrNoRows {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return roles, true, nil
+}
+
+// GetGroupMembers returns every member of a group with their roles.
+func (dbm *DBManager) GetGroupMembers(groupID string) (map[string][]string, error) {
+	query := `SELECT pubkey, roles FROM group_members WHERE group_id = $1 ORDER BY created_at`
+	rows, err := dbm.db.Query(query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make(map[string][]string)
+	for rows.Next() {
+		var pubkey string
+		var roles []string
+		if err := rows.Scan(&pubkey, pq.Array(&roles)); err != nil {
+			return nil, err
+		}
+		result[pubkey] = roles
+	}
+	return result, rows.Err()
+}
+
+// MirrorUpstream is an upstream relay we mirror events from, with its
+// sync cursors (unix timestamps).
+type MirrorUpstream struct {
+	URL           string `json:"url"`
+	BackfillUntil int64  `json:"backfill_until"`
+	BackfillDone  bool   `json:"backfill_done"`
+	LastSeen      int64  `json:"last_seen"`
+}
+
+// AddMirrorUpstream adds an upstream relay. Existing cursors are kept.
+func (dbm *DBManager) AddMirrorUpstream(url string) error {
+	if url == "" {
+		return fmt.Errorf("url cannot be empty")
+	}
+	query := `INSERT INTO mirror_upstreams (url) VALUES ($1) ON CONFLICT (url) DO NOTHING`
+	_, err := dbm.db.Exec(query, url)
+	return err
+}
+
+// RemoveMirrorUpstream removes an upstream relay and its cursors.
+func (dbm *DBManager) RemoveMirrorUpstream(url string) error {
+	query := `DELETE FROM mirror_upstreams WHERE url = $1`
+	_, err := dbm.db.Exec(query, url)
+	return err
+}
+
+// GetMirrorUpstream returns an upstream by url, or nil if it doesn't exist.
+func (dbm *DBManager) GetMirrorUpstream(url string) (*MirrorUpstream, error) {
+	var mu MirrorUpstream
+	query := `SELECT url, backfill_until, backfill_done, last_seen FROM mirror_upstreams WHERE url = $1`
+	err := dbm.db.QueryRow(query, url).Scan(&mu.URL, &mu.BackfillUntil, &mu.BackfillDone, &mu.LastSeen)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mu, nil
+}
+
+// GetMirrorUpstreams returns all upstream relays.
+func (dbm *DBManager) GetMirrorUpstreams() ([]MirrorUpstream, error) {
+	query := `SELECT url, backfill_until, backfill_done, last_seen FROM mirror_upstreams ORDER BY created_at`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []MirrorUpstream
+	for rows.Next() {
+		var mu MirrorUpstream
+		if err := rows.Scan(&mu.URL, &mu.BackfillUntil, &mu.BackfillDone, &mu.LastSeen); err != nil {
+			return nil, err
+		}
+		result = append(result, mu)
+	}
+	return result, rows.Err()
+}
+
+// SetMirrorBackfillCursor records how far back the historical backfill got.
+func (dbm *DBManager) SetMirrorBackfillCursor(url string, until int64, done bool) error {
+	query := `UPDATE mirror_upstreams SET backfill_until = $2, backfill_done = $3, updated_at = CURRENT_TIMESTAMP WHERE url = $1`
+	_, err := dbm.db.Exec(query, url, until, done)
+	return err
+}
+
+// SetMirrorLastSeen records the newest event timestamp seen live.
+func (dbm *DBManager) SetMirrorLastSeen(url string, lastSeen int64) error {
+	greatest := "GREATEST"
+	if dbm.dialect == dialectSQLite {
+		greatest = "MAX" // SQLite's scalar max
+	}
+	query := `UPDATE mirror_upstreams SET last_seen = ` + greatest + `(last_seen, $2), updated_at = CURRENT_TIMESTAMP WHERE url = $1`
+	_, err := dbm.db.Exec(query, url, lastSeen)
+	return err
+}
+
+// ResetMirrorBackfill makes the next connection redo the historical backfill.
+func (dbm *DBManager) ResetMirrorBackfill(url string) error {
+	query := `UPDATE mirror_upstreams SET backfill_until = 0, backfill_done = FALSE, updated_at = CURRENT_TIMESTAMP WHERE url = $1`
+	_, err := dbm.db.Exec(query, url)
+	return err
+}
+
+// Outbox delivery states.
+const (
+	OutboxPending   = deliveryPending
+	OutboxDelivered = deliveryDelivered
+	OutboxDead      = deliveryDead
+)
+
+// OutboxDelivery is the delivery state of one event to one downstream relay.
+type OutboxDelivery struct {
+	EventID       string       `json:"event_id"`
+	RelayURL      string       `json:"relay_url"`
+	Event         *nostr.Event `json:"-"`
+	Status        string       `json:"status"`
+	Attempts      int          `json:"attempts"`
+	LastError     string       `json:"last_error,omitempty"`
+	NextAttemptAt time.Time    `json:"next_attempt_at"`
+}
+
+func (d OutboxDelivery) queueKey() (string, string) { return d.EventID, d.RelayURL }
+func (d OutboxDelivery) attempts() int              { return d.Attempts }
+
+// deliveryTable is a delivery queue table, one row per item and destination.
+type deliveryTable struct {
+	name      string
+	idColumn  string
+	urlColumn string
+	// columns are the ones claims return.
+	columns string
+	// pruneDead has pruning remove old dead entries too, not only the
+	// delivered ones.
+	pruneDead bool
+}
+
+var (
+	outboxTable = deliveryTable{
+		name: "outbox_deliveries", idColumn: "event_id", urlColumn: "relay_url",
+		columns: `event_id, relay_url, event, status, attempts, last_error, next_attempt_at`,
+	}
+	webhookTable = deliveryTable{
+		name: "webhook_deliveries", idColumn: "id", urlColumn: "url",
+		columns: webhookColumns, pruneDead: true,
+	}
+)
+
+// claimDeliveries picks up to limit pending deliveries that are due and
+// pushes their next attempt lease into the future, so that other workers (or
+// a restart while they're in flight) don't send them twice right away.
+// Postgres skips the rows other workers are claiming; SQLite has a single
+// writer, so there's nothing to skip.
+func claimDeliveries[D any](dbm *DBManager, t deliveryTable, limit int, lease time.Duration, scan func(*sql.Rows) ([]D, error)) ([]D, error) {
+	lock := ` FOR UPDATE SKIP LOCKED`
+	if dbm.dialect == dialectSQLite {
+		lock = ""
+	}
+	query := `UPDATE ` + t.name + ` SET next_attempt_at = ` + dbm.secondsFromNow("$2") + `
+		WHERE (` + t.idColumn + `, ` + t.urlColumn + `) IN (
+			SELECT ` + t.idColumn + `, ` + t.urlColumn + ` FROM ` + t.name + `
+			WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+			ORDER BY next_attempt_at LIMIT $1` + lock + `
+		)
+		RETURNING ` + t.columns
+	rows, err := dbm.db.Query(query, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scan(rows)
+}
+
+// markDelivered records a successful delivery.
+func (dbm *DBManager) markDelivered(t deliveryTable, id, url string) error {
+	query := `UPDATE ` + t.name + ` SET status = 'delivered', attempts = attempts + 1, last_error = '',
+		updated_at = CURRENT_TIMESTAMP WHERE ` + t.idColumn + ` = $1 AND ` + t.urlColumn + ` = $2`
+	_, err := dbm.db.Exec(query, id, url)
+	return err
+}
+
+// markFailed records a failed attempt. The delivery is retried after
+// retryIn, or dead-lettered if dead is true.
+func (dbm *DBManager) markFailed(t deliveryTable, id, url, lastError string, retryIn time.Duration, dead bool) error {
+	status := deliveryPending
+	if dead {
+		status = deliveryDead
+	}
+	query := `UPDATE ` + t.name + ` SET status = $3, attempts = attempts + 1, last_error = $4,
+		next_attempt_at = ` + dbm.secondsFromNow("$5") + `, updated_at = CURRENT_TIMESTAMP
+		WHERE ` + t.idColumn + ` = $1 AND ` + t.urlColumn + ` = $2`
+	_, err := dbm.db.Exec(query, id, url, status, lastError, retryIn.Seconds())
+	return err
+}
+
+// retryDeliveries puts dead deliveries of an item back in the queue with a
+// fresh retry budget. An empty url retries all of them.
+func (dbm *DBManager) retryDeliveries(t deliveryTable, id, url string) (int64, error) {
+	query := `UPDATE ` + t.name + ` SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP WHERE status = 'dead' AND ` + t.idColumn + ` = $1 AND ($2 = '' OR ` + t.urlColumn + ` = $2)`
+	result, err := dbm.db.Exec(query, id, url)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// pruneDeliveries removes finished entries older than the given age.
+func (dbm *DBManager) pruneDeliveries(t deliveryTable, olderThan time.Duration) error {
+	finished := `status = 'delivered'`
+	if t.pruneDead {
+		finished = `status <> 'pending'`
+	}
+	query := `DELETE FROM ` + t.name + ` WHERE ` + finished + ` AND updated_at < ` + dbm.secondsFromNow("$1")
+	_, err := dbm.db.Exec(query, -olderThan.Seconds())
+	return err
+}
+
+// EnqueueOutboxEvent queues an event for delivery to every given relay.
+// Events that are already queued for a relay are left alone.
+func (dbm *DBManager) EnqueueOutboxEvent(event *nostr.Event, relayURLs []string) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO outbox_deliveries (event_id, relay_url, event) VALUES ($1, $2, $3)
+		ON CONFLICT (event_id, relay_url) DO NOTHING`
+	for _, url := range relayURLs {
+		if _, err := tx.Exec(query, event.ID, url, data); err != nil {
+			return fmt.Errorf("failed to enqueue event %s for %s: %w", event.ID, url, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ClaimOutboxDeliveries picks up to limit pending deliveries that are due and
+// leases them, see claimDeliveries.
+func (dbm *DBManager) ClaimOutboxDeliveries(limit int, lease time.Duration) ([]OutboxDelivery, error) {
+	return claimDeliveries(dbm, outboxTable, limit, lease, scanOutboxDeliveries)
+}
+
+// MarkOutboxDelivered records a successful delivery.
+func (dbm *DBManager) MarkOutboxDelivered(eventID, relayURL string) error {
+	return dbm.markDelivered(outboxTable, eventID, relayURL)
+}
+
+// MarkOutboxFailed records a failed attempt. The delivery is retried after
+// retryIn, or dead-lettered if dead is true.
+func (dbm *DBManager) MarkOutboxFailed(eventID, relayURL, lastError string, retryIn time.Duration, dead bool) error {
+	return dbm.markFailed(outboxTable, eventID, relayURL, lastError, retryIn, dead)
+}
+
+// GetDeadOutboxDeliveries returns the deliveries that ran out of retries.
+func (dbm *DBManager) GetDeadOutboxDeliveries() ([]OutboxDelivery, error) {
+	query := `SELECT event_id, relay_url, event, status, attempts, last_error, next_attempt_at
+		FROM outbox_deliveries WHERE status = 'dead' ORDER BY updated_at DESC`
+	rows, err := dbm.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanOutboxDeliveries(rows)
+}
+
+// RetryOutboxDeliveries puts dead deliveries of an event back in the queue
+// with a fresh retry budget. An empty relayURL retries all of them.
+func (dbm *DBManager) RetryOutboxDeliveries(eventID, relayURL string) (int64, error) {
+	return dbm.retryDeliveries(outboxTable, eventID, relayURL)
+}
+
+// PruneOutboxDelivered removes delivered entries older than the given age.
+func (dbm *DBManager) PruneOutboxDelivered(olderThan time.Duration) error {
+	return dbm.pruneDeliveries(outboxTable, olderThan)
+}
+
+func scanOutboxDeliveries(rows *sql.Rows) ([]OutboxDelivery, error) {
+	var result []OutboxDelivery
+	for rows.Next() {
+		var d OutboxDelivery
+		var data []byte
+		if err := rows.Scan(&d.EventID, &d.RelayURL, &data, &d.Status, &d.Attempts, &d.LastError, &d.NextAttemptAt); err != nil {
+			return nil, err
+		}
+		d.Event = &nostr.Event{}
+		if err := json.Unmarshal(data, d.Event); err != nil {
+			return nil, fmt.Errorf("invalid queued event %s: %w", d.EventID, err)
+		}
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+// Webhook delivery states.
+const (
+	WebhookPending   = deliveryPending
+	WebhookDelivered = deliveryDelivered
+	WebhookDead      = deliveryDead
+)
+
+// WebhookDelivery is the delivery state of one notification to one
+// endpoint. The deliveries make up the webhook log.
+type WebhookDelivery struct {
+	ID            string          `json:"id"`
+	URL           string          `json:"url"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     string          `json:"last_error,omitempty"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	UpdatedAt     time.Time       `json:"updated_at"`
+}
+
+func (d WebhookDelivery) queueKey() (string, string) { return d.ID, d.URL }
+func (d WebhookDelivery) attempts() int              { return d.Attempts }
+
+const webhookColumns = `id, url, type, payload, status, attempts, last_error, next_attempt_at, created_at, updated_at`
+
+// EnqueueWebhook queues a notification for delivery to every given URL.
+func (dbm *DBManager) EnqueueWebhook(id, kind string, payload []byte, urls []string) error {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `INSERT INTO webhook_deliveries (id, url, type, payload) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id, url) DO NOTHING`
+	for _, url := range urls {
+		if _, err := tx.Exec(query, id, url, kind, payload); err != nil {
+			return fmt.Errorf("failed to enqueue webhook %s for %s: %w", id, url, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ClaimWebhookDeliveries picks up to limit pending deliveries that are due
+// and leases them, see claimDeliveries.
+func (dbm *DBManager) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	return claimDeliveries(dbm, webhookTable, limit, lease, scanWebhookDeliveries)
+}
+
+// MarkWebhookDelivered records a successful delivery.
+func (dbm *DBManager) MarkWebhookDelivered(id, url string) error {
+	return dbm.markDelivered(webhookTable, id, url)
+}
+
+// MarkWebhookFailed records a failed attempt. The delivery is retried after
+// retryIn, or dead-lettered if dead is true.
+func (dbm *DBManager) MarkWebhookFailed(id, url, lastError string, retryIn time.Duration, dead bool) error {
+	return dbm.markFailed(webhookTable, id, url, lastError, retryIn, dead)
+}
+
+// GetWebhookDeliveries returns the latest limit deliveries, newest first.
+func (dbm *DBManager) GetWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	rows, err := dbm.db.Query(`SELECT `+webhookColumns+` FROM webhook_deliveries
+		ORDER BY created_at DESC, id LIMIT $1`, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanWebhookDeliveries(rows)
+}
+
+// RetryWebhookDeliveries puts dead deliveries of a notification back in the
+// queue with a fresh retry budget. An empty url retries all of them.
+func (dbm *DBManager) RetryWebhookDeliveries(id, url string) (int64, error) {
+	return dbm.retryDeliveries(webhookTable, id, url)
+}
+
+// PruneWebhookDeliveries removes delivered and dead entries older than the
+// given age.
+func (dbm *DBManager) PruneWebhookDeliveries(olderThan time.Duration) error {
+	return dbm.pruneDeliveries(webhookTable, olderThan)
+}
+
+func scanWebhookDeliveries(rows *sql.Rows) ([]WebhookDelivery, error) {
+	var result []WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		if err := rows.Scan(&d.ID, &d.URL, &d.Type, &payload, &d.Status, &d.Attempts, &d.LastError,
+			&d.NextAttemptAt, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		result = append(result, d)
+	}
+	return result, rows.Err()
+}
+
+// policyTables are the tables moved between instances by DumpPolicyTables
+// and RestorePolicyTables.
+var policyTables = []string{"allowed_pubkeys", "banned_pubkeys", "banned_events", "admins", "relay_info"}
+
+// PolicyRow is one line of a policy dump.
+type PolicyRow struct {
+	Table string          `json:"table"`
+	Row   json.RawMessage `json:"row"`
+}
+
+// DumpPolicyTables writes every row of the policy tables as JSONL.
+func (dbm *DBManager) DumpPolicyTables(w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	count := 0
+	for _, table := range policyTables {
+		// the table name is one of policyTables, so it's safe to inline
+		query := `SELECT row_to_json(t) FROM ` + table + ` t`
+		if dbm.dialect == dialectSQLite {
+			query = `SELECT * FROM ` + table
+		}
+		rows, err := dbm.db.Query(query)
+		if err != nil {
+			return count, fmt.Errorf("failed to dump %s: %w", table, err)
+		}
+		for rows.Next() {
+			var row json.RawMessage
+			if dbm.dialect == dialectSQLite {
+				err = scanRowJSON(rows, &row)
+			} else {
+				err = rows.Scan(&row)
+			}
+			if err != nil {
+				rows.Close()
+				return count, err
+			}
+			if err := enc.Encode(PolicyRow{Table: table, Row: row}); err != nil {
+				rows.Close()
+				return count, err
+			}
+			count++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// arrayColumns are the TEXT[] columns, which SQLite stores in Postgres'
+// array text format.
+var arrayColumns = map[string]bool{"methods": true, "roles": true}
+
+// scanRowJSON turns the current row into a JSON object shaped like
+// Postgres' row_to_json.
+func scanRowJSON(rows *sql.Rows, row *json.RawMessage) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	if err := rows.Scan(pointers...); err != nil {
+		return err
+	}
+
+	object := make(map[string]any, len(columns))
+	for i, column := range columns {
+		value := values[i]
+		if b, ok := value.([]byte); ok {
+			value = string(b)
+		}
+		if text, ok := value.(string); ok && arrayColumns[column] {
+			var list pq.StringArray
+			if err := list.Scan(text); err != nil {
+				return fmt.Errorf("invalid %s: %w", column, err)
+			}
+			value = []string(list)
+		}
+		object[column] = value
+	}
+	*row, err = json.Marshal(object)
+	return err
+}
+
+// policyRowTimeLayouts are the timestamp formats found in dumps: Postgres'
+// row_to_json and Go's JSON encoding.
+var policyRowTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02 15:04:05"}
+
+// parsePolicyRowTime parses a timestamp of a dumped row.
+func parsePolicyRowTime(value string) (time.Time, bool) {
+	for _, layout := range policyRowTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// restoreRowSQLite inserts a dumped row into a SQLite table, converting
+// arrays and timestamps to the way SQLite stores them.
+func restoreRowSQLite(tx *sql.Tx, table string, data json.RawMessage) error {
+	var object map[string]any
+	if err := json.Unmarshal(data, &object); err != nil {
+		return err
+	}
+
+	// only columns the table really has make it into the query
+	rows, err := tx.Query(`SELECT * FROM ` + table + ` LIMIT 0`)
+	if err != nil {
+		return err
+	}
+	known, err := rows.Columns()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	var columns, placeholders []string
+	var args []any
+	for _, column := range known {
+		value, ok := object[column]
+		if !ok {
+			continue
+		}
+		switch v := value.(type) {
+		case []any:
+			list := make([]string, len(v))
+			for i, item := range v {
+				list[i] = fmt.Sprint(item)
+			}
+			value = pq.Array(list)
+		case string:
+			if strings.HasSuffix(column, "_at") {
+				if t, ok := parsePolicyRowTime(v); ok {
+					value = t.Format("2006-01-02 15:04:05")
+				}
+			}
+		}
+		columns = append(columns, column)
+		args = append(args, value)
+		placeholders = append(placeholders, fmt.Sprintf("$%d", len(args)))
+	}
+
+	query := `INSERT INTO ` + table + ` (` + strings.Join(columns, ", ") + `) VALUES (` + strings.Join(placeholders, ", ") + `) ON CONFLICT DO NOTHING`
+	_, err = tx.Exec(query, args...)
+	return err
+}
+
+// RestorePolicyTables loads a dump written by DumpPolicyTables in a single
+// transaction. Rows that already exist are kept as they are.
+func (dbm *DBManager) RestorePolicyTables(r io.Reader) (int, error) {
+	tx, err := dbm.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	dec := json.NewDecoder(r)
+	count := 0
+	for {
+		var pr PolicyRow
+		if err := dec.Decode(&pr); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, fmt.Errorf("invalid dump line %d: %w", count+1, err)
+		}
+		if !slices.Contains(policyTables, pr.Table) {
+			return 0, fmt.Errorf("line %d: unknown table %q", count+1, pr.Table)
+		}
+
+		// the table name is one of policyTables, so it's safe to inline
+		var err error
+		if dbm.dialect == dialectSQLite {
+			err = restoreRowSQLite(tx, pr.Table, pr.Row)
+		} else {
+			query := `INSERT INTO ` + pr.Table + ` SELECT * FROM json_populate_record(NULL::` + pr.Table + `, $1) ON CONFLICT DO NOTHING`
+			_, err = tx.Exec(query, []byte(pr.Row))
+		}
+		if err != nil {
+			return 0, fmt.Errorf("line %d: failed to restore %s row: %w", count+1, pr.Table, err)
+		}
+		count++
+	}
+	return count, tx.Commit()
+}
@@ -0,0 +1,1561 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip59"
+	"github.com/nbd-wtf/go-nostr/nip77"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy"
+	"github.com/nbd-wtf/go-nostr/nip77/negentropy/storage/vector"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// rpc calls a management method signed by sk and returns its result, failing
+// the test on transport errors. Errors returned by the method are returned.
+func (tr *testRelay) rpc(t *testing.T, sk, method string, params ...any) (any, error) {
+	t.Helper()
+	signer, err := keyer.NewPlainKeySigner(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if params == nil {
+		params = []any{}
+	}
+	resp, err := CallManagementAPI(ctx, signer, tr.url, nip86.Request{Method: method, Params: params})
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("%s", resp.Error)
+	}
+	return resp.Result, nil
+}
+
+// mustRPC is rpc for calls that must succeed.
+func (tr *testRelay) mustRPC(t *testing.T, sk, method string, params ...any) any {
+	t.Helper()
+	result, err := tr.rpc(t, sk, method, params...)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return result
+}
+
+func newKey(t *testing.T) (sk, pk string) {
+	t.Helper()
+	sk = nostr.GeneratePrivateKey()
+	pk, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sk, pk
+}
+
+func signedKind(t *testing.T, sk string, kind int) nostr.Event {
+	t.Helper()
+	event := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "kind test"}
+	if err := event.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func wantRejected(t *testing.T, err error, reason string) {
+	t.Helper()
+	if err == nil || !strings.Contains(err.Error(), reason) {
+		t.Fatalf("got %v, want a rejection containing %q", err, reason)
+	}
+}
+
+// pubkeys returns the pubkeys of a list*pubkeys result.
+func pubkeys(result any) []string {
+	var list []string
+	items, _ := result.([]any)
+	for _, item := range items {
+		if entry, ok := item.(map[string]any); ok {
+			pubkey, _ := entry["pubkey"].(string)
+			list = append(list, pubkey)
+		}
+	}
+	return list
+}
+
+func TestAllowAndBanOverRPC(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	relay := tr.connect(t)
+	sk, pk := newKey(t)
+
+	wantRejected(t, publish(relay, signedNote(t, sk, "before")), "private relay")
+
+	tr.mustRPC(t, tr.ownerSK, "allowpubkey", pk, "friend")
+	if got := pubkeys(tr.mustRPC(t, tr.ownerSK, "listallowedpubkeys")); !slices.Contains(got, pk) {
+		t.Fatalf("allowed pubkeys %v don't include %s", got, pk)
+	}
+	if err := publish(relay, signedNote(t, sk, "allowed")); err != nil {
+		t.Fatalf("allowed pubkey: %v", err)
+	}
+
+	tr.mustRPC(t, tr.ownerSK, "banpubkey", pk, "spam")
+	if got := pubkeys(tr.mustRPC(t, tr.ownerSK, "listallowedpubkeys")); slices.Contains(got, pk) {
+		t.Errorf("banned pubkey still allowed: %v", got)
+	}
+	if got := pubkeys(tr.mustRPC(t, tr.ownerSK, "listbannedpubkeys")); !slices.Contains(got, pk) {
+		t.Errorf("banned pubkeys %v don't include %s", got, pk)
+	}
+	// with the allowlist entry gone, the private relay refuses it first
+	wantRejected(t, publish(relay, signedNote(t, sk, "after")), "blocked")
+}
+
+func TestKindRules(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	relay := tr.connect(t)
+
+	tr.mustRPC(t, tr.ownerSK, "disallowkind", 7)
+	wantRejected(t, publish(relay, signedKind(t, tr.ownerSK, 7)), "kind 7")
+	if err := publish(relay, signedKind(t, tr.ownerSK, 1)); err != nil {
+		t.Fatalf("kind 1 with no allowed kinds: %v", err)
+	}
+
+	// allowing a kind limits the relay to the allowed ones
+	tr.mustRPC(t, tr.ownerSK, "allowkind", 1)
+	if err := publish(relay, signedKind(t, tr.ownerSK, 1)); err != nil {
+		t.Fatalf("allowed kind: %v", err)
+	}
+	wantRejected(t, publish(relay, signedKind(t, tr.ownerSK, 30023)), "kind 30023")
+
+	// and allowing a disallowed kind lifts the ban on it
+	tr.mustRPC(t, tr.ownerSK, "allowkind", 7)
+	if err := publish(relay, signedKind(t, tr.ownerSK, 7)); err != nil {
+		t.Fatalf("reallowed kind: %v", err)
+	}
+	if got, _ := tr.mustRPC(t, tr.ownerSK, "listdisallowedkinds").([]any); len(got) != 0 {
+		t.Errorf("disallowed kinds = %v, want none", got)
+	}
+}
+
+func TestIPBlocks(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	relay := tr.connect(t)
+
+	tr.mustRPC(t, tr.ownerSK, "blockip", "127.0.0.1", "test")
+
+	// connections already open can't write anymore
+	wantRejected(t, publish(relay, signedNote(t, tr.ownerSK, "blocked")), "IP address is blocked")
+
+	// and new ones are refused
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if blocked, err := nostr.RelayConnect(ctx, tr.url); err == nil {
+		blocked.Close()
+		t.Fatal("blocked IP could connect")
+	}
+
+	// the management API still answers, so the block can be lifted
+	tr.mustRPC(t, tr.ownerSK, "unblockip", "127.0.0.1")
+	if err := publish(tr.connect(t), signedNote(t, tr.ownerSK, "unblocked")); err != nil {
+		t.Fatalf("unblocked IP: %v", err)
+	}
+}
+
+func TestAdminGrants(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	adminSK, adminPK := newKey(t)
+	strangerSK, strangerPK := newKey(t)
+
+	if _, err := tr.rpc(t, adminSK, "allowpubkey", strangerPK); err == nil {
+		t.Fatal("non-admin could call allowpubkey")
+	}
+
+	tr.mustRPC(t, tr.ownerSK, "grantadmin", adminPK, []string{"allowpubkey", "listallowedpubkeys"})
+	tr.mustRPC(t, adminSK, "allowpubkey", strangerPK, "invited")
+	if got := pubkeys(tr.mustRPC(t, adminSK, "listallowedpubkeys")); !slices.Contains(got, strangerPK) {
+		t.Errorf("allowed pubkeys %v don't include %s", got, strangerPK)
+	}
+	tr.mustRPC(t, adminSK, "supportedmethods")
+
+	// methods that weren't granted, built-in or custom, are refused
+	for _, method := range []string{"banpubkey", "listallowednip05domains", "grantadmin"} {
+		params := []any{strangerPK}
+		if method == "grantadmin" {
+			params = append(params, []string{"banpubkey"})
+		}
+		if _, err := tr.rpc(t, adminSK, method, params...); err == nil {
+			t.Errorf("admin could call %s without a grant", method)
+		}
+	}
+	if _, err := tr.rpc(t, strangerSK, "listallowedpubkeys"); err == nil {
+		t.Error("allowlisted pubkey could call listallowedpubkeys")
+	}
+
+	tr.mustRPC(t, tr.ownerSK, "revokeadmin", adminPK)
+	if _, err := tr.rpc(t, adminSK, "listallowedpubkeys"); err == nil {
+		t.Error("revoked admin could call listallowedpubkeys")
+	}
+}
+
+func TestRevokeAdminMethods(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	_, pk := newKey(t)
+
+	methods := func() []string {
+		t.Helper()
+		got, err := tr.app.dbManager.GetAdminMethods(pk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(got)
+		return got
+	}
+	grant := func(methods ...string) {
+		t.Helper()
+		tr.mustRPC(t, tr.ownerSK, "grantadmin", pk, methods)
+	}
+	revoke := func(methods ...string) {
+		t.Helper()
+		tr.mustRPC(t, tr.ownerSK, "revokeadmin", pk, methods)
+	}
+
+	// revoking from someone who isn't an admin does nothing
+	revoke("banpubkey")
+	if got := methods(); got != nil {
+		t.Fatalf("methods = %v, want none", got)
+	}
+
+	grant("allowpubkey", "banpubkey", "stats")
+
+	// methods that weren't granted are ignored
+	revoke("blockip")
+	if got := methods(); !slices.Equal(got, []string{"allowpubkey", "banpubkey", "stats"}) {
+		t.Errorf("after revoking an ungranted method: %v", got)
+	}
+
+	// a partial revoke keeps the rest
+	revoke("banpubkey", "blockip")
+	if got := methods(); !slices.Equal(got, []string{"allowpubkey", "stats"}) {
+		t.Errorf("after a partial revoke: %v", got)
+	}
+
+	// revoking the last methods removes the admin
+	revoke("allowpubkey", "stats")
+	if admin, _ := tr.app.dbManager.IsAdmin(pk); admin {
+		t.Errorf("admin without methods is still an admin: %v", methods())
+	}
+
+	// and an empty list revokes everything
+	grant("allowpubkey", "stats")
+	revoke()
+	if admin, _ := tr.app.dbManager.IsAdmin(pk); admin {
+		t.Errorf("empty revoke kept the admin: %v", methods())
+	}
+
+	// granting again replaces the methods
+	grant("stats")
+	grant("allowpubkey")
+	if got := methods(); !slices.Equal(got, []string{"allowpubkey"}) {
+		t.Errorf("after granting again: %v", got)
+	}
+	admins, _ := tr.mustRPC(t, tr.ownerSK, "listadmins").([]any)
+	if len(admins) != 1 {
+		t.Errorf("listadmins = %v, want one admin", admins)
+	}
+
+	if _, err := tr.rpc(t, tr.ownerSK, "grantadmin", pk, []string{}); err == nil {
+		t.Error("granting no methods should fail")
+	}
+}
+
+func TestRelayInfoPersists(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) { cfg.Info.Name = "from config" })
+
+	tr.mustRPC(t, tr.ownerSK, "changerelayname", "from api")
+	tr.mustRPC(t, tr.ownerSK, "changerelaydescription", "a test relay")
+
+	if name, _ := tr.app.dbManager.GetRelayInfo("name"); name != "from api" {
+		t.Errorf("stored name = %q", name)
+	}
+
+	// a reload keeps what was set through the API
+	if err := tr.app.applyInfo(tr.app.Config().Info); err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, tr.httpURL, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var info nip11Info
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Name != "from api" || info.Description != "a test relay" {
+		t.Errorf("NIP-11 name %q, description %q", info.Name, info.Description)
+	}
+}
+
+type nip11Info struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+func TestPolicyChains(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Policies.Event = []PolicyEntry{
+			{Name: "validate_kind"},
+			{Name: "pow", Params: map[string]any{"difficulty": 4, "kinds": []int{1}}},
+		}
+		cfg.Policies.Filter = []PolicyEntry{{Name: "no_empty_filters"}}
+		cfg.Policies.APICall = []PolicyEntry{{Name: "api_methods", Params: map[string]any{"allow": []string{"stats"}}}}
+	})
+	relay := tr.connect(t)
+	sk, _ := newKey(t)
+
+	// an id can meet the difficulty by chance
+	noWork := signedNote(t, sk, "no work")
+	for i := 0; nip13.Difficulty(noWork.ID) >= 4; i++ {
+		noWork = signedNote(t, sk, fmt.Sprint("no work ", i))
+	}
+	wantRejected(t, publish(relay, noWork), "pow")
+	if err := publish(relay, signedKind(t, sk, 7)); err != nil {
+		t.Fatalf("kind without pow: %v", err)
+	}
+
+	event := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: "worked"}
+	pk, _ := nostr.GetPublicKey(sk)
+	event.PubKey = pk
+	tag, err := nip13.DoWork(context.Background(), event, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.Tags = append(event.Tags, tag)
+	if err := event.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(relay, event); err != nil {
+		t.Fatalf("event with pow: %v", err)
+	}
+
+	if _, err := tr.rpc(t, tr.ownerSK, "listallowedpubkeys"); err == nil || !strings.Contains(err.Error(), "disabled") {
+		t.Errorf("got %v, want api_methods to refuse listallowedpubkeys", err)
+	}
+
+	stats, _ := tr.mustRPC(t, tr.ownerSK, "stats").(map[string]any)
+	result, _ := stats["result"].(map[string]any)
+	rejections, _ := result["policy_rejections"].(map[string]any)
+	events, _ := rejections["event"].(map[string]any)
+	api, _ := rejections["api"].(map[string]any)
+	if events["pow"] != float64(1) || events["validate_kind"] != float64(0) || api["api_methods"] != float64(1) {
+		t.Errorf("policy rejections = %v", rejections)
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Policies.Event = []PolicyEntry{{Name: "no_such_policy"}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "unknown event policy") {
+		t.Errorf("got %v, want an unknown policy error", err)
+	}
+
+	cfg.Policies.Event = []PolicyEntry{{Name: "prevent_large_tags", Params: map[string]any{"max_lenght": 10}}}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "max_lenght") {
+		t.Errorf("got %v, want an unknown param error", err)
+	}
+
+	cfg.Policies.Event = []PolicyEntry{{Name: "event_rate_limit", Params: map[string]any{"tokens": 5, "interval": "1s", "by": "pubkey"}}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("rate limit params: %v", err)
+	}
+
+	// a policy in a stage it has no hook for is refused when built
+	tr := newTestRelay(t, nil)
+	policies := tr.app.Config().Policies
+	policies.Filter = []PolicyEntry{{Name: "validate_kind"}}
+	if err := tr.app.policies.Update(policies); err == nil {
+		t.Error("event policy accepted as a filter policy")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(1, time.Hour, 2)
+	if !rl.allow("a") || !rl.allow("a") {
+		t.Fatal("burst not allowed")
+	}
+	if rl.allow("a") {
+		t.Error("allowed past the burst")
+	}
+	if !rl.allow("b") {
+		t.Error("keys share a bucket")
+	}
+}
+
+func TestScriptPolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeScript := func(name, src string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeScript("10-spam.star", `
+def check(event, conn):
+    if "buy now" in event.content:
+        return reject("no spam")
+    if not is_allowed(event.pubkey) and "http" in event.content:
+        return flag("link from a stranger")
+`)
+	writeScript("20-loop.star", `
+def check(event, conn):
+    if event.content == "loop":
+        for i in range(100000000):
+            pass
+`)
+
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Policies.Event = []PolicyEntry{{Name: "script", Params: map[string]any{"dir": dir, "max_steps": 10000}}}
+	})
+	relay := tr.connect(t)
+	sk, _ := newKey(t)
+
+	wantRejected(t, publish(relay, signedNote(t, sk, "buy now")), "blocked: no spam")
+	link := signedNote(t, sk, "see http://example.com")
+	if err := publish(relay, link); err != nil {
+		t.Fatalf("flagged event: %v", err)
+	}
+	// a script over its limits is skipped
+	if err := publish(relay, signedNote(t, sk, "loop")); err != nil {
+		t.Fatalf("looping script: %v", err)
+	}
+
+	queue, _ := tr.mustRPC(t, tr.ownerSK, "listeventsneedingmoderation").([]any)
+	if len(queue) != 1 || queue[0].(map[string]any)["id"] != link.ID {
+		t.Errorf("moderation queue = %v, want %s", queue, link.ID)
+	}
+}
+
+func TestScriptReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "policy.star")
+	if err := os.WriteFile(path, []byte("def check(event, conn):\n    return reject('first')\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	sr, err := NewScriptRunner(NewKVManager(&memoryKV{data: make(map[string][]byte)}), ScriptParams{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &nostr.Event{Kind: 1, Content: "hi"}
+	if d, _ := sr.Check(context.Background(), event); d.Message != "first" || d.Script != "policy.star" {
+		t.Errorf("got %+v", d)
+	}
+
+	// a broken script keeps the last good ones
+	os.WriteFile(path, []byte("def check(event, conn)\n"), 0o644)
+	sr.checked = time.Time{}
+	if d, _ := sr.Check(context.Background(), event); d.Message != "first" {
+		t.Errorf("broken script replaced the loaded one: %+v", d)
+	}
+
+	os.WriteFile(path, []byte("def check(event, conn):\n    return flag('second')\n"), 0o644)
+	sr.checked, sr.stamp = time.Time{}, ""
+	if d, _ := sr.Check(context.Background(), event); d.Action != ScriptFlag || d.Message != "second" {
+		t.Errorf("script not reloaded: %+v", d)
+	}
+
+	os.WriteFile(path, []byte("def check(event, conn):\n    return 1\n"), 0o644)
+	sr.checked, sr.stamp = time.Time{}, ""
+	if d, err := sr.Check(context.Background(), event); d.Action != ScriptAccept || err == nil {
+		t.Errorf("got %+v, %v, want an error", d, err)
+	}
+}
+
+// TestPluginProcess is the plugin TestPlugin runs: it answers by the
+// content of the event.
+func TestPluginProcess(t *testing.T) {
+	if os.Getenv("OKAY_TEST_PLUGIN") != "1" {
+		return
+	}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var req pluginRequest
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil || req.Type != "new" || req.SourceType != "IP4" {
+			os.Exit(2)
+		}
+		resp := PluginResponse{ID: req.Event.ID, Action: PluginAccept}
+		switch req.Event.Content {
+		case "spam":
+			resp.Action, resp.Msg = PluginReject, "spam"
+		case "shadow":
+			resp.Action = PluginShadowReject
+		case "slow":
+			time.Sleep(500 * time.Millisecond)
+		case "crash":
+			os.Exit(1)
+		case "stall":
+			// stops reading, until killed
+			time.Sleep(time.Hour)
+		}
+		line, _ := json.Marshal(resp)
+		fmt.Println(string(line))
+	}
+	os.Exit(0)
+}
+
+func TestPlugin(t *testing.T) {
+	t.Setenv("OKAY_TEST_PLUGIN", "1")
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Policies.Event = []PolicyEntry{{Name: "plugin", Params: map[string]any{
+			"command":       os.Args[0],
+			"args":          []string{"-test.run=^TestPluginProcess$"},
+			"timeout":       "300ms",
+			"restart_delay": "10ms",
+		}}}
+	})
+	relay := tr.connect(t)
+	sk, _ := newKey(t)
+
+	if err := publish(relay, signedNote(t, sk, "hello")); err != nil {
+		t.Fatalf("accepted event: %v", err)
+	}
+	wantRejected(t, publish(relay, signedNote(t, sk, "spam")), "blocked: spam")
+	shadow := signedNote(t, sk, "shadow")
+	if err := publish(relay, shadow); err != nil {
+		t.Fatalf("shadow rejected event: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if found, _ := relay.QuerySync(ctx, nostr.Filter{IDs: []string{shadow.ID}}); len(found) != 0 {
+		t.Error("shadow rejected event was stored")
+	}
+
+	// the plugin answers one event at a time, so a late answer holds up the
+	// next ones too
+	wantRejected(t, publish(relay, signedNote(t, sk, "slow")), "write policy unavailable")
+	time.Sleep(300 * time.Millisecond)
+
+	// the fallback decides while the plugin is down, then it's restarted
+	wantRejected(t, publish(relay, signedNote(t, sk, "crash")), "write policy unavailable")
+	time.Sleep(50 * time.Millisecond)
+	if err := publish(relay, signedNote(t, sk, "hello again")); err != nil {
+		t.Fatalf("after restart: %v", err)
+	}
+
+	// a plugin that stops reading is killed once an event fills the pipe
+	wantRejected(t, publish(relay, signedNote(t, sk, "stall")), "write policy unavailable")
+	wantRejected(t, publish(relay, signedNote(t, sk, strings.Repeat("x", 256*1024))), "write policy unavailable")
+	time.Sleep(50 * time.Millisecond)
+	if err := publish(relay, signedNote(t, sk, "hello once more")); err != nil {
+		t.Fatalf("after kill: %v", err)
+	}
+}
+
+// webhookReceiver records the notifications posted to it. The first
+// request fails, so every test sees a retry.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests int
+	received []WebhookNotification
+}
+
+func newWebhookReceiver(t *testing.T, secret string) *webhookReceiver {
+	wr := &webhookReceiver{}
+	wr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if got := r.Header.Get("X-Okay-Signature"); got != WebhookSignature(secret, body) {
+			t.Errorf("bad signature %q", got)
+		}
+		var n WebhookNotification
+		if err := json.Unmarshal(body, &n); err != nil || n.Type != r.Header.Get("X-Okay-Event") {
+			t.Errorf("bad notification %s: %v", body, err)
+		}
+
+		wr.mu.Lock()
+		defer wr.mu.Unlock()
+		wr.requests++
+		if wr.requests == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		wr.received = append(wr.received, n)
+	}))
+	t.Cleanup(wr.Close)
+	return wr
+}
+
+// wait returns the notifications once there are n of them.
+func (wr *webhookReceiver) wait(t *testing.T, n int) []WebhookNotification {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		wr.mu.Lock()
+		received := slices.Clone(wr.received)
+		wr.mu.Unlock()
+		if len(received) >= n {
+			return received
+		}
+	}
+	t.Fatalf("timed out waiting for %d webhooks", n)
+	return nil
+}
+
+func TestWebhooks(t *testing.T) {
+	team := newWebhookReceiver(t, "team secret")
+	audit := newWebhookReceiver(t, "audit secret")
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Policies.Event = []PolicyEntry{{Name: "pow", Params: map[string]any{"difficulty": 30}}}
+		cfg.Webhooks.Backoff = 10 * time.Millisecond
+		cfg.Webhooks.Endpoints = []WebhookEndpoint{
+			{URL: team.URL, Secret: "team secret"},
+			{URL: audit.URL, Secret: "audit secret", Events: []string{WebhookPolicyRejected}},
+		}
+	})
+	_, pk := newKey(t)
+
+	tr.mustRPC(t, tr.ownerSK, "banpubkey", pk, "spam")
+	got := team.wait(t, 1)
+	if got[0].Type != WebhookPubkeyBanned || got[0].Data.(map[string]any)["pubkey"] != pk {
+		t.Errorf("got %+v", got[0])
+	}
+
+	tr.mustRPC(t, tr.ownerSK, "grantadmin", pk, []string{"banpubkey"})
+	if err := tr.app.Management().AddEventNeedingModeration(strings.Repeat("ab", 32), "looks odd"); err != nil {
+		t.Fatal(err)
+	}
+	got = team.wait(t, 3)
+	if got[1].Type != WebhookAdminGranted || got[2].Type != WebhookModerationFlagged {
+		t.Errorf("got %s and %s", got[1].Type, got[2].Type)
+	}
+
+	sk, _ := newKey(t)
+	wantRejected(t, publish(tr.connect(t), signedNote(t, sk, "no work")), "pow")
+	rejected := audit.wait(t, 1)[0].Data.(map[string]any)
+	if rejected["stage"] != StageEvent || rejected["policy"] != "pow" {
+		t.Errorf("got %v", rejected)
+	}
+
+	// the log has every delivery, the retried one included
+	log, _ := tr.mustRPC(t, tr.ownerSK, "listwebhookdeliveries").([]any)
+	if len(log) != 4 {
+		t.Fatalf("got %d deliveries, want 4", len(log))
+	}
+	attempts := 0
+	for _, entry := range log {
+		d := entry.(map[string]any)
+		if d["status"] != WebhookDelivered {
+			t.Errorf("delivery %v not delivered", d)
+		}
+		attempts += int(d["attempts"].(float64))
+	}
+	if attempts != 6 {
+		t.Errorf("got %d attempts, want 6", attempts)
+	}
+}
+
+// directMessages returns what the relay sent to sk as NIP-17 DMs, reading
+// them over an authenticated connection.
+func (tr *testRelay) directMessages(t *testing.T, sk string) []nostr.Event {
+	t.Helper()
+	pk, _ := nostr.GetPublicKey(sk)
+	relay := tr.connect(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// AUTH needs the challenge, sent when the first request is refused
+	relay.QuerySync(ctx, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {pk}}})
+	if err := relay.Auth(ctx, func(event *nostr.Event) error { return event.Sign(sk) }); err != nil {
+		t.Fatal(err)
+	}
+	wraps, err := relay.QuerySync(ctx, nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {pk}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []nostr.Event
+	for _, wrap := range wraps {
+		rumor, err := nip59.GiftUnwrap(*wrap, func(otherpubkey, ciphertext string) (string, error) {
+			key, err := nip44.GenerateConversationKey(otherpubkey, sk)
+			if err != nil {
+				return "", err
+			}
+			return nip44.Decrypt(ciphertext, key)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, rumor)
+	}
+	return messages
+}
+
+// waitForDMs waits until sk got n DMs.
+func (tr *testRelay) waitForDMs(t *testing.T, sk string, n int) []nostr.Event {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if messages := tr.directMessages(t, sk); len(messages) >= n {
+			return messages
+		}
+	}
+	t.Fatalf("timed out waiting for %d DMs", n)
+	return nil
+}
+
+func TestAdminDMs(t *testing.T) {
+	relaySK := nostr.GeneratePrivateKey()
+	relayPK, _ := nostr.GetPublicKey(relaySK)
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessClosed
+		cfg.Key.SecretKey = relaySK
+		cfg.AdminDMs.Enabled = true
+		cfg.AdminDMs.RateLimitOffenders = 2
+		cfg.Policies.Event = []PolicyEntry{{Name: "event_rate_limit", Params: map[string]any{"tokens": 1, "interval": "1h"}}}
+	})
+	adminSK, adminPK := newKey(t)
+	_, spammer := newKey(t)
+	tr.mustRPC(t, tr.ownerSK, "grantadmin", adminPK, []string{"listbannedpubkeys"})
+
+	// each admin picks their own
+	if _, err := tr.rpc(t, adminSK, "setdmpreferences", []string{"pubkey.bannd"}); err == nil {
+		t.Error("unknown notification accepted")
+	}
+	tr.mustRPC(t, adminSK, "setdmpreferences", []string{WebhookPubkeyBanned})
+	if got := tr.mustRPC(t, adminSK, "getdmpreferences"); fmt.Sprint(got) != "["+WebhookPubkeyBanned+"]" {
+		t.Errorf("got preferences %v", got)
+	}
+	if got, _ := tr.mustRPC(t, tr.ownerSK, "getdmpreferences").([]any); len(got) != len(adminDMTypes) {
+		t.Errorf("owner has preferences %v, want all", got)
+	}
+
+	// the admin hears about the owner's ban, the owner doesn't
+	tr.mustRPC(t, tr.ownerSK, "banpubkey", spammer, "spam")
+	messages := tr.waitForDMs(t, adminSK, 1)
+	if messages[0].PubKey != relayPK || !strings.Contains(messages[0].Content, "spam") {
+		t.Errorf("got %+v", messages[0])
+	}
+
+	// only the owner wants rate limit offenders
+	relay := tr.connect(t)
+	for i := range 3 {
+		publish(relay, signedNote(t, tr.ownerSK, fmt.Sprint("note ", i)))
+	}
+	messages = tr.waitForDMs(t, tr.ownerSK, 1)
+	if len(messages) != 1 || !strings.Contains(messages[0].Content, "rate limited 2 times") {
+		t.Errorf("owner got %+v", messages)
+	}
+	if got := tr.directMessages(t, adminSK); len(got) != 1 {
+		t.Errorf("admin got %d DMs, want 1", len(got))
+	}
+}
+
+func TestContentFilter(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Policies.Event = []PolicyEntry{{Name: "content_filter"}}
+	})
+	for _, rule := range [][]any{
+		{"word", "Buy  NOW", "reject"},
+		{"word", "now", "moderate"},
+		{"domain", "https://Spam.example/landing", "shadow_reject"},
+		{"regex", `(?i)free\s+sats`, "moderate", "giveaway spam"},
+	} {
+		tr.mustRPC(t, tr.ownerSK, "addcontentrule", rule...)
+	}
+	for _, rule := range [][]any{
+		{"regex", "(unclosed", "reject"},
+		{"word", "spam", "delete"},
+		{"phrase", "spam", "reject"},
+	} {
+		if _, err := tr.rpc(t, tr.ownerSK, "addcontentrule", rule...); err == nil {
+			t.Errorf("rule %v accepted", rule)
+		}
+	}
+	rules, _ := tr.mustRPC(t, tr.ownerSK, "listcontentrules").([]any)
+	if len(rules) != 4 || rules[0].(map[string]any)["pattern"] != "buy now" || rules[2].(map[string]any)["pattern"] != "spam.example" {
+		t.Fatalf("got rules %v", rules)
+	}
+
+	sk, _ := newKey(t)
+	relay := tr.connect(t)
+	stored := func(event nostr.Event) bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		found, _ := relay.QuerySync(ctx, nostr.Filter{IDs: []string{event.ID}})
+		return len(found) == 1
+	}
+
+	// the strictest rule wins
+	wantRejected(t, publish(relay, signedNote(t, sk, "Buy now!")), "content not allowed")
+	titled := signedNote(t, sk, "an article")
+	titled.Tags = nostr.Tags{{"title", "buy now"}}
+	titled.Sign(sk)
+	wantRejected(t, publish(relay, titled), "content not allowed")
+
+	// whole words only
+	if err := publish(relay, signedNote(t, sk, "buy nowhere")); err != nil {
+		t.Error(err)
+	}
+
+	link := signedNote(t, sk, "see https://www.spam.example/offer")
+	if err := publish(relay, link); err != nil || stored(link) {
+		t.Errorf("shadow rejected event: %v, stored %v", err, stored(link))
+	}
+
+	giveaway := signedNote(t, sk, "FREE   sats")
+	if err := publish(relay, giveaway); err != nil || !stored(giveaway) {
+		t.Errorf("moderated event: %v, stored %v", err, stored(giveaway))
+	}
+	queue, _ := tr.mustRPC(t, tr.ownerSK, "listeventsneedingmoderation").([]any)
+	if len(queue) != 1 || queue[0].(map[string]any)["id"] != giveaway.ID || queue[0].(map[string]any)["reason"] != "giveaway spam" {
+		t.Errorf("got moderation queue %v", queue)
+	}
+
+	tr.mustRPC(t, tr.ownerSK, "removecontentrule", "word", "buy now")
+	if err := publish(relay, signedNote(t, sk, "buy now")); err != nil {
+		t.Error(err)
+	}
+	if _, err := tr.rpc(t, tr.ownerSK, "removecontentrule", "word", "buy now"); err == nil {
+		t.Error("removed a rule twice")
+	}
+}
+
+func TestNIP05Domains(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	aliceSK, alicePK := newKey(t)
+
+	// a stub well-known server for every domain, counting the lookups
+	var mu sync.Mutex
+	lookups := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("domain")
+		mu.Lock()
+		lookups[domain]++
+		mu.Unlock()
+		if domain != "good.example" {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"names": map[string]string{"alice": alicePK}})
+	}))
+	defer server.Close()
+	tr.app.nip05.HTTPClient = server.Client()
+	tr.app.nip05.URLFor = func(domain, name string) string {
+		return server.URL + "/.well-known/nostr.json?name=" + name + "&domain=" + domain
+	}
+	lookupsOf := func(domain string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return lookups[domain]
+	}
+
+	tr.mustRPC(t, tr.ownerSK, "allownip05domain", "good.example")
+	tr.mustRPC(t, tr.ownerSK, "allownip05domain", "broken.example")
+	relay := tr.connect(t)
+	profile := func(sk, nip05 string) nostr.Event {
+		event := nostr.Event{Kind: nostr.KindProfileMetadata, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: `{"name":"test","nip05":"` + nip05 + `"}`}
+		event.Sign(sk)
+		return event
+	}
+
+	if err := publish(relay, profile(aliceSK, "Alice@good.example")); err != nil {
+		t.Fatalf("verified profile: %v", err)
+	}
+	if err := publish(relay, signedNote(t, aliceSK, "verified")); err != nil {
+		t.Fatalf("verified author: %v", err)
+	}
+	if got := lookupsOf("good.example"); got != 1 {
+		t.Errorf("good.example looked up %d times, want 1", got)
+	}
+
+	// domains that aren't allowed are never fetched
+	strangerSK, _ := newKey(t)
+	wantRejected(t, publish(relay, profile(strangerSK, "alice@internal.example")), "private relay")
+	if got := lookupsOf("internal.example"); got != 0 {
+		t.Errorf("internal.example looked up %d times", got)
+	}
+
+	// failed lookups are cached too
+	bobSK, _ := newKey(t)
+	for range 3 {
+		wantRejected(t, publish(relay, profile(bobSK, "bob@broken.example")), "private relay")
+	}
+	if got := lookupsOf("broken.example"); got != 1 {
+		t.Errorf("broken.example looked up %d times, want 1", got)
+	}
+
+	// a verified identifier doesn't let a banned author back in
+	tr.mustRPC(t, tr.ownerSK, "banpubkey", alicePK, "spam")
+	wantRejected(t, publish(relay, signedNote(t, aliceSK, "banned")), "private relay")
+}
+
+func TestGroupPermissions(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Groups.Enabled = true
+	})
+	relay := tr.connect(t)
+	groupEvent := func(sk string, kind int, tags ...nostr.Tag) nostr.Event {
+		event := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: append(nostr.Tags{{"h", "club"}}, tags...)}
+		if err := event.Sign(sk); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	waitForMember := func(pk string) {
+		t.Helper()
+		for range 50 {
+			if _, ok, _ := tr.app.Management().GetGroupMemberRoles("club", pk); ok {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s didn't join", pk)
+	}
+
+	if err := publish(relay, groupEvent(tr.ownerSK, nostr.KindSimpleGroupCreateGroup)); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+
+	// banned pubkeys can't join open groups either
+	bannedSK, bannedPK := newKey(t)
+	tr.mustRPC(t, tr.ownerSK, "banpubkey", bannedPK, "spam")
+	wantRejected(t, publish(relay, groupEvent(bannedSK, nostr.KindSimpleGroupJoinRequest)), "banned")
+
+	modSK, modPK := newKey(t)
+	memberSK, memberPK := newKey(t)
+	for _, sk := range []string{modSK, memberSK} {
+		if err := publish(relay, groupEvent(sk, nostr.KindSimpleGroupJoinRequest)); err != nil {
+			t.Fatalf("join: %v", err)
+		}
+	}
+	waitForMember(modPK)
+	waitForMember(memberPK)
+	if err := publish(relay, groupEvent(tr.ownerSK, nostr.KindSimpleGroupPutUser, nostr.Tag{"p", modPK, "moderator"})); err != nil {
+		t.Fatalf("grant moderator: %v", err)
+	}
+
+	// plain members can't moderate
+	post := groupEvent(memberSK, 9)
+	if err := publish(relay, post); err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	wantRejected(t, publish(relay, groupEvent(memberSK, nostr.KindSimpleGroupDeleteEvent, nostr.Tag{"e", post.ID})), "doesn't allow delete-event")
+
+	// moderators delete posts and remove members, but don't give roles,
+	// remove admins or delete the group
+	if err := publish(relay, groupEvent(modSK, nostr.KindSimpleGroupDeleteEvent, nostr.Tag{"e", post.ID})); err != nil {
+		t.Errorf("moderator deleting a post: %v", err)
+	}
+	wantRejected(t, publish(relay, groupEvent(modSK, nostr.KindSimpleGroupPutUser, nostr.Tag{"p", memberPK, "admin"})), "doesn't allow grant-roles")
+	ownerPK, _ := nostr.GetPublicKey(tr.ownerSK)
+	wantRejected(t, publish(relay, groupEvent(modSK, nostr.KindSimpleGroupRemoveUser, nostr.Tag{"p", ownerPK})), "doesn't allow grant-roles")
+	wantRejected(t, publish(relay, groupEvent(modSK, nostr.KindSimpleGroupDeleteGroup)), "doesn't allow delete-group")
+	if err := publish(relay, groupEvent(modSK, nostr.KindSimpleGroupRemoveUser, nostr.Tag{"p", memberPK})); err != nil {
+		t.Errorf("moderator removing a member: %v", err)
+	}
+}
+
+// newUpstream serves a khatru relay on the memory backend that answers at
+// most pageSize events per query, as relays capping the limit do.
+func newUpstream(t *testing.T, pageSize int) (url string, store eventstore.Store) {
+	t.Helper()
+	st, err := openMemory(DatabaseConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream := khatru.NewRelay()
+	upstream.StoreEvent = append(upstream.StoreEvent, st.db.SaveEvent)
+	upstream.QueryEvents = append(upstream.QueryEvents, func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Limit <= 0 || filter.Limit > pageSize {
+			filter.Limit = pageSize
+		}
+		return st.db.QueryEvents(ctx, filter)
+	})
+	server := httptest.NewServer(upstream)
+	t.Cleanup(func() {
+		server.Close()
+		st.Close()
+	})
+	return "ws" + strings.TrimPrefix(server.URL, "http"), st.db
+}
+
+func TestMirror(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	upstreamURL, upstream := newUpstream(t, 3)
+
+	// two events a second, so pages of 3 end in the middle of one
+	var history []nostr.Event
+	for i := range 10 {
+		event := nostr.Event{Kind: 1, CreatedAt: nostr.Now() - nostr.Timestamp(100+100*(i/2)), Tags: nostr.Tags{}, Content: fmt.Sprint("old ", i)}
+		if err := event.Sign(tr.ownerSK); err != nil {
+			t.Fatal(err)
+		}
+		if err := upstream.SaveEvent(context.Background(), &event); err != nil {
+			t.Fatal(err)
+		}
+		history = append(history, event)
+	}
+	tr.mustRPC(t, tr.ownerSK, "addmirrorupstream", upstreamURL)
+
+	mirrored := func(events ...nostr.Event) bool {
+		ids := make([]string, len(events))
+		for i, event := range events {
+			ids[i] = event.ID
+		}
+		ch, err := tr.app.Events().QueryEvents(context.Background(), nostr.Filter{IDs: ids})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found := 0
+		for range ch {
+			found++
+		}
+		return found == len(ids)
+	}
+	waitFor := func(what string, done func() bool) {
+		t.Helper()
+		for range 100 {
+			if done() {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		t.Fatalf("timed out waiting for %s", what)
+	}
+
+	waitFor("the backfill", func() bool {
+		upstreams, _ := tr.mustRPC(t, tr.ownerSK, "listmirrorupstreams").([]any)
+		return len(upstreams) == 1 && upstreams[0].(map[string]any)["backfill_done"] == true
+	})
+	if !mirrored(history...) {
+		t.Fatalf("backfill skipped events: %v", tr.mustRPC(t, tr.ownerSK, "listmirrorupstreams"))
+	}
+
+	// then new events are mirrored live
+	publisher, err := nostr.RelayConnect(context.Background(), upstreamURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer publisher.Close()
+	live := signedNote(t, tr.ownerSK, "live")
+	if err := publish(publisher, live); err != nil {
+		t.Fatal(err)
+	}
+	waitFor("the live event", func() bool { return mirrored(live) })
+
+	// resync backfills again, from a single worker
+	tr.mustRPC(t, tr.ownerSK, "resyncmirrorupstream", upstreamURL)
+	tr.mustRPC(t, tr.ownerSK, "resyncmirrorupstream", upstreamURL)
+	waitFor("the resync", func() bool {
+		upstreams, _ := tr.mustRPC(t, tr.ownerSK, "listmirrorupstreams").([]any)
+		return len(upstreams) == 1 && upstreams[0].(map[string]any)["backfill_done"] == true
+	})
+}
+
+func TestOutbox(t *testing.T) {
+	st := openTestStorage(t)
+	goodURL, good := newUpstream(t, 100)
+
+	// a destination that refuses everything until accepting is set
+	var accepting atomic.Bool
+	var received sync.Map
+	bad := khatru.NewRelay()
+	bad.RejectEvent = append(bad.RejectEvent, func(ctx context.Context, event *nostr.Event) (bool, string) {
+		return !accepting.Load(), "blocked: not now"
+	})
+	bad.StoreEvent = append(bad.StoreEvent, func(ctx context.Context, event *nostr.Event) error {
+		received.Store(event.ID, true)
+		return nil
+	})
+	badServer := httptest.NewServer(bad)
+	defer badServer.Close()
+	badURL := nostr.NormalizeURL("ws" + strings.TrimPrefix(badServer.URL, "http"))
+
+	outbox := NewOutbox(st.Management(), st.Events(), []string{goodURL, badURL}, func(event *nostr.Event) bool { return true })
+	outbox.MaxAttempts = 3
+	outbox.BaseBackoff = time.Millisecond
+	outbox.MaxBackoff = time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	outbox.pool = nostr.NewSimplePool(ctx)
+
+	// the relay events are published to, as App wires it
+	source := khatru.NewRelay()
+	source.StoreEvent = append(source.StoreEvent, st.Events().SaveEvent)
+	source.ReplaceEvent = append(source.ReplaceEvent, st.Events().ReplaceEvent)
+	source.QueryEvents = append(source.QueryEvents, st.Events().QueryEvents)
+	source.OnEventSaved = append(source.OnEventSaved, outbox.OnEventSaved)
+	sourceServer := httptest.NewServer(source)
+	defer sourceServer.Close()
+	tr := &testRelay{url: "ws" + strings.TrimPrefix(sourceServer.URL, "http")}
+	relay := tr.connect(t)
+
+	sk, _ := newKey(t)
+	note := signedNote(t, sk, "forward me")
+	profile := signedKind(t, sk, nostr.KindProfileMetadata)
+	stale := nostr.Event{Kind: nostr.KindProfileMetadata, CreatedAt: profile.CreatedAt - 10, Tags: nostr.Tags{}, Content: "{}"}
+	stale.Sign(sk)
+	for _, event := range []nostr.Event{note, profile, stale} {
+		if err := publish(relay, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deliver runs the queue until n deliveries are dead
+	deliver := func(n int) []OutboxDelivery {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			outbox.queue().deliverDue(ctx)
+			dead, err := st.Management().GetDeadOutboxDeliveries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dead) == n || time.Now().After(deadline) {
+				return dead
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// retried after the backoff until dead
+	dead := deliver(2)
+	for _, event := range []nostr.Event{note, profile} {
+		if found, _ := good.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}}); <-found == nil {
+			t.Errorf("%s wasn't delivered", event.ID)
+		}
+	}
+	if found, _ := good.QueryEvents(ctx, nostr.Filter{IDs: []string{stale.ID}}); <-found != nil {
+		t.Error("the older profile, which wasn't saved, was forwarded")
+	}
+
+	if len(dead) != 2 {
+		t.Fatalf("got %d dead deliveries, want the note and profile to %s", len(dead), badURL)
+	}
+	for _, d := range dead {
+		if d.RelayURL != badURL || d.Attempts != outbox.MaxAttempts || !strings.Contains(d.LastError, "not now") {
+			t.Errorf("dead delivery %+v", d)
+		}
+	}
+
+	// retried by hand once the destination is back
+	accepting.Store(true)
+	if n, err := st.Management().RetryOutboxDeliveries(note.ID, badURL); err != nil || n != 1 {
+		t.Fatalf("retry: %d, %v", n, err)
+	}
+	if dead := deliver(1); len(dead) != 1 || dead[0].EventID != profile.ID {
+		t.Errorf("dead deliveries after the retry: %+v", dead)
+	}
+	if _, ok := received.Load(note.ID); !ok {
+		t.Error("the retried delivery wasn't sent")
+	}
+}
+
+func TestSearch(t *testing.T) {
+	if os.Getenv("OKAY_TEST_DATABASE_URL") == "" {
+		t.Skip("search needs Postgres, set OKAY_TEST_DATABASE_URL")
+	}
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Search = SearchConfig{Enabled: true, Kinds: []int{1}}
+	})
+	relay := tr.connect(t)
+	note := func(content string, tags ...nostr.Tag) nostr.Event {
+		event := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: tags, Content: content}
+		if err := event.Sign(tr.ownerSK); err != nil {
+			t.Fatal(err)
+		}
+		if err := publish(relay, event); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	many := note("nostr relays are great, nostr everywhere, nostr forever")
+	once := note("a relay that speaks nostr")
+	german := note("Die Häuser sind groß", nostr.Tag{"l", "de", "ISO-639-1"})
+	untagged := note("haus")
+	link := note("read https://example.com/post today")
+	// kind 0 isn't indexed here
+	profile := nostr.Event{Kind: 0, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: `{"name":"nostr"}`}
+	profile.Sign(tr.ownerSK)
+	if err := publish(relay, profile); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(filter nostr.Filter) []string {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		events, err := relay.QuerySync(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, event := range events {
+			ids = append(ids, event.ID)
+		}
+		return ids
+	}
+	if got := search(nostr.Filter{Search: "nostr"}); !slices.Equal(got, []string{many.ID, once.ID}) {
+		t.Errorf("nostr: got %v, want the most relevant note first and no profile", got)
+	}
+	if got := search(nostr.Filter{Search: "nostr", Kinds: []int{0}}); len(got) != 0 {
+		t.Errorf("unindexed kind: got %v", got)
+	}
+	if got := search(nostr.Filter{Search: "haus language:de"}); !slices.Equal(got, []string{german.ID}) {
+		t.Errorf("language:de: got %v, want only the German note, stemmed", got)
+	}
+	if got := search(nostr.Filter{Search: "haus"}); len(got) != 2 || !slices.Contains(got, untagged.ID) {
+		t.Errorf("haus: got %v, want both notes", got)
+	}
+	if got := search(nostr.Filter{Search: "https://example.com/post"}); !slices.Equal(got, []string{link.ID}) {
+		t.Errorf("url: got %v, want the note with the link", got)
+	}
+}
+
+// negentropySync reconciles filter with the relay over conn, whose handler
+// sends the NIP-77 replies to replies, starting from have. It returns the
+// ids the relay has and have doesn't, or the NEG-ERR reason.
+func negentropySync(t *testing.T, conn *nostr.Relay, replies chan nostr.Envelope, id string, filter nostr.Filter, have ...nostr.Event) ([]string, error) {
+	t.Helper()
+	vec := vector.New()
+	for _, event := range have {
+		vec.Insert(event.CreatedAt, event.ID)
+	}
+	vec.Seal()
+	neg := negentropy.New(vec, 1024*1024)
+	var haveNots []string
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		for id := range neg.HaveNots {
+			haveNots = append(haveNots, id)
+		}
+	}()
+	go func() {
+		for range neg.Haves {
+		}
+	}()
+
+	open, _ := nip77.OpenEnvelope{SubscriptionID: id, Filter: filter, Message: neg.Start()}.MarshalJSON()
+	if err := <-conn.Write(open); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case reply := <-replies:
+			switch env := reply.(type) {
+			case *nip77.ErrorEnvelope:
+				return nil, errors.New(env.Reason)
+			case *nip77.MessageEnvelope:
+				next, err := neg.Reconcile(env.Message)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if next == "" {
+					closeMsg, _ := nip77.CloseEnvelope{SubscriptionID: id}.MarshalJSON()
+					conn.Write(closeMsg)
+					<-collected
+					return haveNots, nil
+				}
+				msg, _ := nip77.MessageEnvelope{SubscriptionID: id, Message: next}.MarshalJSON()
+				conn.Write(msg)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no negentropy reply")
+		}
+	}
+}
+
+func TestNegentropy(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Groups.Enabled = true
+		cfg.Negentropy = NegentropyConfig{Enabled: true, MaxRecords: 3, MaxSessions: 3}
+	})
+	ownerPK, _ := nostr.GetPublicKey(tr.ownerSK)
+	owner := tr.connect(t)
+	var notes []nostr.Event
+	for i := range 3 {
+		note := signedNote(t, tr.ownerSK, fmt.Sprint("note ", i))
+		if err := publish(owner, note); err != nil {
+			t.Fatal(err)
+		}
+		notes = append(notes, note)
+	}
+	// a private group's events stay out of strangers' sets
+	for _, event := range []nostr.Event{
+		{Kind: nostr.KindSimpleGroupCreateGroup, Tags: nostr.Tags{{"h", "secret"}, {"private"}}},
+		{Kind: 9, Tags: nostr.Tags{{"h", "secret"}}, Content: "members only"},
+	} {
+		event.CreatedAt = nostr.Now()
+		if err := event.Sign(tr.ownerSK); err != nil {
+			t.Fatal(err)
+		}
+		if err := publish(owner, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filter := nostr.Filter{Authors: []string{ownerPK}, Kinds: []int{1, 9}}
+	wantIDs := []string{notes[0].ID, notes[1].ID, notes[2].ID}
+	slices.Sort(wantIDs)
+
+	// NEG-OPEN runs the RejectFilter hooks, then builds the set from the
+	// QueryEvents ones, on the stranger's connection
+	connected := make(chan context.Context, 1)
+	tr.app.Relay.OnConnect = append(tr.app.Relay.OnConnect, func(ctx context.Context) {
+		select {
+		case connected <- ctx:
+		default:
+		}
+	})
+	tr.connect(t)
+	connCtx := eventstore.SetNegentropy(<-connected)
+	open := func(filter nostr.Filter) ([]string, string) {
+		t.Helper()
+		for _, reject := range tr.app.Relay.RejectFilter {
+			if rejected, msg := reject(connCtx, filter); rejected {
+				return nil, msg
+			}
+		}
+		var ids []string
+		for _, query := range tr.app.Relay.QueryEvents {
+			ch, err := query(connCtx, filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for event := range ch {
+				ids = append(ids, event.ID)
+			}
+		}
+		slices.Sort(ids)
+		return ids, ""
+	}
+
+	if ids, reason := open(filter); reason != "" || !slices.Equal(ids, wantIDs) {
+		t.Errorf("set: got %v %q, want the three notes and no group event", ids, reason)
+	}
+	// access rules apply as for a REQ
+	if _, reason := open(nostr.Filter{Tags: nostr.TagMap{"h": {"secret"}}}); !strings.Contains(reason, "auth-required") {
+		t.Errorf("private group: got %q, want auth-required", reason)
+	}
+	// sets larger than MaxRecords are refused where they're sized (Postgres)
+	if tr.app.Storage.SQL() != nil {
+		if _, reason := open(nostr.Filter{Authors: []string{ownerPK}}); !strings.Contains(reason, "more than 3") {
+			t.Errorf("oversized set: got %q", reason)
+		}
+	}
+	// three sessions a minute per connection, counting the ones that got
+	// past the access rules
+	var reason string
+	for range 3 {
+		if _, reason = open(filter); reason != "" {
+			break
+		}
+	}
+	if !strings.Contains(reason, "too many negentropy sessions") {
+		t.Errorf("over the session limit: got %q", reason)
+	}
+
+	t.Run("wire", func(t *testing.T) {
+		probe, _ := nip77.OpenEnvelope{SubscriptionID: "probe", Filter: filter, Message: "61"}.MarshalJSON()
+		if nip77.ParseNegMessage(string(probe)) == nil {
+			t.Skip("this go-nostr can't parse NIP-77 envelopes, so khatru refuses NEG-OPEN")
+		}
+		replies := make(chan nostr.Envelope, 10)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		conn, err := nostr.RelayConnect(ctx, tr.url, nostr.WithCustomHandler(func(data string) {
+			if envelope := nip77.ParseNegMessage(data); envelope != nil {
+				replies <- envelope
+			}
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// NEG-OPEN, NEG-MSG and NEG-CLOSE: the stranger lacks two notes
+		haveNots, err := negentropySync(t, conn, replies, "sync", filter, notes[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		slices.Sort(haveNots)
+		want := []string{notes[1].ID, notes[2].ID}
+		slices.Sort(want)
+		if !slices.Equal(haveNots, want) {
+			t.Errorf("got %v, want the two missing notes", haveNots)
+		}
+		if _, err := negentropySync(t, conn, replies, "group", nostr.Filter{Tags: nostr.TagMap{"h": {"secret"}}}); err == nil || !strings.Contains(err.Error(), "auth-required") {
+			t.Errorf("private group: got %v, want auth-required", err)
+		}
+	})
+}
+
+func TestCountHidesPrivateGroups(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) {
+		cfg.Access.Mode = AccessPublic
+		cfg.Groups.Enabled = true
+	})
+	ownerPK, _ := nostr.GetPublicKey(tr.ownerSK)
+	owner := tr.connect(t)
+	inGroup := func(kind int, content string, tags ...nostr.Tag) nostr.Event {
+		event := nostr.Event{Kind: kind, CreatedAt: nostr.Now(), Tags: append(nostr.Tags{{"h", "secret"}}, tags...), Content: content}
+		if err := event.Sign(tr.ownerSK); err != nil {
+			t.Fatal(err)
+		}
+		return event
+	}
+	if err := publish(owner, inGroup(nostr.KindSimpleGroupCreateGroup, "", nostr.Tag{"private"})); err != nil {
+		t.Fatalf("create group: %v", err)
+	}
+	for _, event := range []nostr.Event{inGroup(9, "one"), inGroup(9, "two"), signedNote(t, tr.ownerSK, "public")} {
+		if err := publish(owner, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := nostr.Filter{Authors: []string{ownerPK}, Kinds: []int{1, 9}}
+	count := func(relay *nostr.Relay) int64 {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		n, _, err := relay.Count(ctx, nostr.Filters{filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if got := count(tr.connect(t)); got != 1 {
+		t.Errorf("stranger counted %d events, want 1", got)
+	}
+
+	// members count the group's events too
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	owner.QuerySync(ctx, nostr.Filter{Tags: nostr.TagMap{"h": {"secret"}}})
+	if err := owner.Auth(ctx, func(event *nostr.Event) error { return event.Sign(tr.ownerSK) }); err != nil {
+		t.Fatal(err)
+	}
+	if got := count(owner); got != 3 {
+		t.Errorf("member counted %d events, want 3", got)
+	}
+}
+
+func TestDrainForgetsClosedSubscriptions(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) { cfg.Access.Mode = AccessPublic })
+	relay := tr.connect(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	sub, err := relay.Subscribe(ctx, nostr.Filters{{Kinds: []int{1}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-sub.EndOfStoredEvents
+	if got := tr.app.drain.Subscriptions(); got != 1 {
+		t.Fatalf("drain has %d subscriptions, want 1", got)
+	}
+
+	sub.Unsub()
+	deadline := time.Now().Add(5 * time.Second)
+	for tr.app.drain.Subscriptions() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("closed subscription is still recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGiftWrapsNeedRecipient(t *testing.T) {
+	for _, mode := range []string{AccessPrivate, AccessPublic} {
+		t.Run(mode, func(t *testing.T) {
+			tr := newTestRelay(t, func(cfg *Config) { cfg.Access.Mode = mode })
+			aliceSK, alicePK := newKey(t)
+			bobSK, _ := newKey(t)
+			wrap := nostr.Event{Kind: nostr.KindGiftWrap, CreatedAt: nostr.Now(), Tags: nostr.Tags{{"p", alicePK}}, Content: "sealed"}
+			if err := wrap.Sign(tr.ownerSK); err != nil {
+				t.Fatal(err)
+			}
+			if err := publish(tr.connect(t), wrap); err != nil {
+				t.Fatal(err)
+			}
+			alices := nostr.Filter{Kinds: []int{nostr.KindGiftWrap}, Tags: nostr.TagMap{"p": {alicePK}}}
+
+			// closed returns the reason the relay refused filter with, or ""
+			// once it sent the stored events
+			closed := func(relay *nostr.Relay, filter nostr.Filter) (string, []*nostr.Event) {
+				t.Helper()
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				sub, err := relay.Subscribe(ctx, nostr.Filters{filter})
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer sub.Unsub()
+				var events []*nostr.Event
+				for {
+					select {
+					case event := <-sub.Events:
+						events = append(events, event)
+					case reason := <-sub.ClosedReason:
+						return reason, nil
+					case <-sub.EndOfStoredEvents:
+						return "", events
+					case <-ctx.Done():
+						t.Fatal("no reply")
+					}
+				}
+			}
+			authed := func(sk string) *nostr.Relay {
+				relay := tr.connect(t)
+				closed(relay, alices)
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				if err := relay.Auth(ctx, func(event *nostr.Event) error { return event.Sign(sk) }); err != nil {
+					t.Fatal(err)
+				}
+				return relay
+			}
+
+			if reason, _ := closed(tr.connect(t), alices); !strings.HasPrefix(reason, "auth-required:") {
+				t.Errorf("unauthenticated: got %q, want auth-required", reason)
+			}
+			bob := authed(bobSK)
+			if reason, _ := closed(bob, alices); !strings.HasPrefix(reason, "restricted:") {
+				t.Errorf("someone else's: got %q, want restricted", reason)
+			}
+			if reason, _ := closed(bob, nostr.Filter{Kinds: []int{1, nostr.KindGiftWrap}}); !strings.HasPrefix(reason, "restricted:") {
+				t.Errorf("mixed kinds: got %q, want restricted", reason)
+			}
+			if reason, events := closed(authed(aliceSK), alices); reason != "" || len(events) != 1 || events[0].ID != wrap.ID {
+				t.Errorf("recipient: got %q %v, want the gift wrap", reason, events)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"fmt"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// sqlParams collects positional parameters for queries against the
+// eventstore's event table.
+type sqlParams []any
+
+// add appends a parameter and returns its $n placeholder.
+func (p *sqlParams) add(v any) string {
+	*p = append(*p, v)
+	return fmt.Sprintf("$%d", len(*p))
+}
+
+// filterConditions translates the ids, authors, kinds, tags, since and until
+// of a filter into WHERE conditions on the event table. It returns false when
+// the filter can't match anything.
+func filterConditions(filter nostr.Filter, params *sqlParams) ([]string, bool) {
+	conditions := make([]string, 0, 6)
+	if len(filter.IDs) > 0 {
+		conditions = append(conditions, "id = ANY("+params.add(pq.Array(filter.IDs))+")")
+	}
+	if len(filter.Authors) > 0 {
+		conditions = append(conditions, "pubkey = ANY("+params.add(pq.Array(filter.Authors))+")")
+	}
+	if len(filter.Kinds) > 0 {
+		conditions = append(conditions, "kind = ANY("+params.add(pq.Array(filter.Kinds))+")")
+	}
+	for _, values := range filter.Tags {
+		if len(values) == 0 {
+			return nil, false
+		}
+		// each separate tag key is an independent condition
+		conditions = append(conditions, "tagvalues && "+params.add(pq.Array(values)))
+	}
+	if filter.Since != nil {
+		conditions = append(conditions, "created_at >= "+params.add(int64(*filter.Since)))
+	}
+	if filter.Until != nil {
+		conditions = append(conditions, "created_at <= "+params.add(int64(*filter.Until)))
+	}
+	if len(conditions) == 0 {
+		conditions = append(conditions, "true")
+	}
+	return conditions, true
+}
@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// ExportEvents writes the events matching filter as JSONL, newest first, and
+// returns how many there were. A limit keeps the newest events, as in a REQ.
+// On Postgres it reads the event table directly; the other backends stream
+// from the eventstore. Search filters aren't supported.
+func (s *Storage) ExportEvents(ctx context.Context, w io.Writer, filter nostr.Filter) (int, error) {
+	if filter.Search != "" {
+		return 0, errors.New("search filters can't be exported")
+	}
+	if s.sharedDB == nil {
+		return exportFromStore(ctx, w, s, filter)
+	}
+
+	var params sqlParams
+	conditions, ok := filterConditions(filter, &params)
+	if !ok {
+		return 0, nil
+	}
+	query := `SELECT id, pubkey, created_at, kind, tags, content, sig FROM event
+		WHERE ` + strings.Join(conditions, " AND ") + ` ORDER BY created_at DESC, id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ` + params.add(filter.Limit)
+	}
+
+	rows, err := s.sharedDB.QueryContext(ctx, query, params...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to query events: %w", err)
+	}
+	defer rows.Close()
+
+	buffered := bufio.NewWriter(w)
+	count := 0
+	for rows.Next() {
+		var evt nostr.Event
+		var timestamp int64
+		if err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp, &evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+			return count, err
+		}
+		evt.CreatedAt = nostr.Timestamp(timestamp)
+		buffered.WriteString(evt.String())
+		buffered.WriteByte('\n')
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	return count, buffered.Flush()
+}
+
+// errExportLimit stops the walk of exportFromStore once the limit is reached.
+var errExportLimit = errors.New("export limit reached")
+
+// exportFromStore streams through the eventstore, for backends without
+// SQL.
+func exportFromStore(ctx context.Context, w io.Writer, s *Storage, filter nostr.Filter) (int, error) {
+	buffered := bufio.NewWriter(w)
+	count := 0
+	err := WalkEvents(ctx, s.db, filter, func(event *nostr.Event) error {
+		if filter.Limit > 0 && count >= filter.Limit {
+			return errExportLimit
+		}
+		buffered.WriteString(event.String())
+		if err := buffered.WriteByte('\n'); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil && !errors.Is(err, errExportLimit) {
+		return count, fmt.Errorf("failed to export events: %w", err)
+	}
+	return count, buffered.Flush()
+}
@@ -0,0 +1,614 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip29"
+	"github.com/nbd-wtf/go-nostr/nip45/hyperloglog"
+)
+
+// The group roles that allow moderation. groupAdminRole is given to the
+// creator of a group; other roles are only labels.
+const (
+	groupAdminRole     = "admin"
+	groupModeratorRole = "moderator"
+)
+
+// The NIP-29 moderation permissions.
+const (
+	groupAddUser      = "add-user"
+	groupRemoveUser   = "remove-user"
+	groupEditMetadata = "edit-metadata"
+	groupDeleteEvent  = "delete-event"
+	groupDeleteGroup  = "delete-group"
+	groupCreateInvite = "create-invite"
+	// groupGrantRoles is needed to give roles, and to change or remove
+	// members who have some.
+	groupGrantRoles = "grant-roles"
+)
+
+// groupRolePermissions are what each role may do.
+var groupRolePermissions = map[string][]string{
+	groupAdminRole: {
+		groupAddUser, groupRemoveUser, groupEditMetadata, groupDeleteEvent,
+		groupDeleteGroup, groupCreateInvite, groupGrantRoles,
+	},
+	groupModeratorRole: {groupAddUser, groupRemoveUser, groupDeleteEvent},
+}
+
+// groupKindPermissions is the permission each moderation kind needs.
+var groupKindPermissions = map[int]string{
+	nostr.KindSimpleGroupPutUser:      groupAddUser,
+	nostr.KindSimpleGroupRemoveUser:   groupRemoveUser,
+	nostr.KindSimpleGroupEditMetadata: groupEditMetadata,
+	nostr.KindSimpleGroupDeleteEvent:  groupDeleteEvent,
+	nostr.KindSimpleGroupDeleteGroup:  groupDeleteGroup,
+	nostr.KindSimpleGroupCreateInvite: groupCreateInvite,
+}
+
+// Groups implements NIP-29 relay-based groups. Group state lives in the
+// groups and group_members tables and is published as relay-signed
+// addressable events (kinds 39000-39002).
+type Groups struct {
+	dbm   ManagementStore
+	relay *khatru.Relay
+	store eventstore.Store
+
+	key       *RelayKey
+	PublicKey string
+
+	// CanCreate decides who may create new groups with kind 9007.
+	CanCreate func(pubkey string) bool
+
+	mu          sync.Mutex
+	lastStateAt map[string]nostr.Timestamp
+}
+
+// NewGroups sets up NIP-29 support. Group state events are signed with the
+// relay key.
+func NewGroups(dbm ManagementStore, relay *khatru.Relay, store eventstore.Store, key *RelayKey) *Groups {
+	return &Groups{
+		dbm:         dbm,
+		relay:       relay,
+		store:       store,
+		key:         key,
+		PublicKey:   key.PublicKey,
+		CanCreate:   func(string) bool { return false },
+		lastStateAt: make(map[string]nostr.Timestamp),
+	}
+}
+
+// Handles reports whether an event belongs to the groups subsystem, so that
+// other write policies can leave the decision to RejectEvent.
+func (g *Groups) Handles(event *nostr.Event) bool {
+	return event.Tags.GetFirst([]string{"h", ""}) != nil ||
+		nip29.MetadataEventKinds.Includes(event.Kind)
+}
+
+// RejectEvent enforces membership and admin rights for group events.
+func (g *Groups) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	if nip29.MetadataEventKinds.Includes(event.Kind) {
+		if event.PubKey != g.PublicKey {
+			return true, "restricted: group state can only be published by the relay"
+		}
+		return false, ""
+	}
+
+	groupID := groupIDOf(event)
+	if groupID == "" {
+		if nip29.ModerationEventKinds.Includes(event.Kind) ||
+			event.Kind == nostr.KindSimpleGroupJoinRequest || event.Kind == nostr.KindSimpleGroupLeaveRequest {
+			return true, "invalid: missing group 'h' tag"
+		}
+		return false, "" // not a group event
+	}
+
+	group, err := g.dbm.GetGroup(groupID)
+	if err != nil {
+		log.Printf("Error loading group %s: %v", groupID, err)
+		return true, "error: failed to load group"
+	}
+
+	if event.Kind == nostr.KindSimpleGroupCreateGroup {
+		if group != nil {
+			return true, "duplicate: group already exists"
+		}
+		if !g.CanCreate(event.PubKey) {
+			return true, "restricted: you are not allowed to create groups here"
+		}
+		return false, ""
+	}
+
+	if group == nil {
+		return true, "invalid: group doesn't exist"
+	}
+
+	roles, isMember, err := g.dbm.GetGroupMemberRoles(groupID, event.PubKey)
+	if err != nil {
+		log.Printf("Error loading group member %s: %v", event.PubKey, err)
+		return true, "error: failed to load group membership"
+	}
+
+	switch {
+	case event.Kind == nostr.KindSimpleGroupJoinRequest:
+		if isMember {
+			return true, "duplicate: already a member"
+		}
+		return false, ""
+	case event.Kind == nostr.KindSimpleGroupLeaveRequest:
+		if !isMember {
+			return true, "invalid: not a member"
+		}
+		return false, ""
+	case nip29.ModerationEventKinds.Includes(event.Kind):
+		needed, err := g.permissionsFor(groupID, event)
+		if err != nil {
+			log.Printf("Error loading group members of %s: %v", groupID, err)
+			return true, "error: failed to load group membership"
+		}
+		for _, permission := range needed {
+			if !hasGroupPermission(roles, permission) {
+				return true, "restricted: your group role doesn't allow " + permission
+			}
+		}
+		return false, ""
+	default:
+		if !isMember {
+			return true, "restricted: you must join the group first"
+		}
+		return false, ""
+	}
+}
+
+// permissionsFor returns the permissions a moderation event needs: the one
+// of its kind, and groupGrantRoles when it gives roles or changes members
+// who have some.
+func (g *Groups) permissionsFor(groupID string, event *nostr.Event) ([]string, error) {
+	needed := []string{groupKindPermissions[event.Kind]}
+	if event.Kind != nostr.KindSimpleGroupPutUser && event.Kind != nostr.KindSimpleGroupRemoveUser {
+		return needed, nil
+	}
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if len(tag) > 2 {
+			return append(needed, groupGrantRoles), nil
+		}
+		roles, _, err := g.dbm.GetGroupMemberRoles(groupID, tag[1])
+		if err != nil {
+			return nil, err
+		}
+		if len(roles) > 0 {
+			return append(needed, groupGrantRoles), nil
+		}
+	}
+	return needed, nil
+}
+
+// hasGroupPermission tells whether any of roles allows permission.
+func hasGroupPermission(roles []string, permission string) bool {
+	for _, role := range roles {
+		if slices.Contains(groupRolePermissions[role], permission) {
+			return true
+		}
+	}
+	return false
+}
+
+// OnEventSaved applies accepted moderation, join and leave events to the
+// group state and republishes the relay-signed state events.
+func (g *Groups) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	groupID := groupIDOf(event)
+	if groupID == "" {
+		return
+	}
+
+	var err error
+	switch event.Kind {
+	case nostr.KindSimpleGroupCreateGroup:
+		err = g.createGroup(ctx, groupID, event)
+	case nostr.KindSimpleGroupDeleteGroup:
+		err = g.deleteGroup(ctx, groupID)
+	case nostr.KindSimpleGroupEditMetadata:
+		err = g.editMetadata(ctx, groupID, event)
+	case nostr.KindSimpleGroupPutUser:
+		err = g.putUsers(ctx, groupID, event)
+	case nostr.KindSimpleGroupRemoveUser:
+		err = g.removeUsers(ctx, groupID, event)
+	case nostr.KindSimpleGroupDeleteEvent:
+		err = g.deleteEvents(ctx, groupID, event)
+	case nostr.KindSimpleGroupJoinRequest:
+		err = g.join(ctx, groupID, event)
+	case nostr.KindSimpleGroupLeaveRequest:
+		err = g.leave(ctx, groupID, event)
+	}
+	if err != nil {
+		log.Printf("Error applying group event %s to %s: %v", event.ID, groupID, err)
+	}
+}
+
+// RejectFilter requires authentication and membership to read private groups.
+func (g *Groups) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	for _, groupID := range filter.Tags["h"] {
+		group, err := g.dbm.GetGroup(groupID)
+		if err != nil {
+			log.Printf("Error loading group %s: %v", groupID, err)
+			return true, "error: failed to load group"
+		}
+		if group == nil || !group.Private {
+			continue
+		}
+
+		pubkey := khatru.GetAuthed(ctx)
+		if pubkey == "" {
+			return true, "auth-required: this group is private"
+		}
+		if _, isMember, err := g.dbm.GetGroupMemberRoles(groupID, pubkey); err != nil || !isMember {
+			return true, "restricted: you are not a member of this group"
+		}
+	}
+	return false, ""
+}
+
+// RestrictQuery wraps a query function so that events of private groups are
+// never returned to non-members, even when the filter has no 'h' tag.
+func (g *Groups) RestrictQuery(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		ch, err := query(ctx, filter)
+		if err != nil || khatru.IsInternalCall(ctx) {
+			return ch, err
+		}
+
+		pubkey := khatru.GetAuthed(ctx)
+		visible := make(map[string]bool)
+		out := make(chan *nostr.Event)
+		go func() {
+			defer close(out)
+			for event := range ch {
+				if groupID := groupIDOf(event); groupID != "" {
+					ok, seen := visible[groupID]
+					if !seen {
+						ok = g.canRead(groupID, pubkey)
+						visible[groupID] = ok
+					}
+					if !ok {
+						continue
+					}
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					for range ch {
+					}
+					return
+				}
+			}
+		}()
+		return out, nil
+	}
+}
+
+// RestrictCount wraps an exact count so that events of private groups
+// aren't counted for non-members either: the events of the groups hidden
+// from them are counted apart and taken off.
+func (g *Groups) RestrictCount(count func(ctx context.Context, filter nostr.Filter) (int64, error)) func(ctx context.Context, filter nostr.Filter) (int64, error) {
+	return func(ctx context.Context, filter nostr.Filter) (int64, error) {
+		hidden, err := g.hiddenFrom(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		total, err := count(ctx, filter)
+		if err != nil || len(hidden) == 0 {
+			return total, err
+		}
+		excluded, err := count(ctx, withGroups(filter, hidden))
+		if err != nil {
+			return 0, err
+		}
+		return total - excluded, nil
+	}
+}
+
+// RestrictCountHLL wraps a HLL count the same way. The registers can't
+// leave out hidden events, so when the filter matches some the exact
+// count is returned instead, without registers.
+func (g *Groups) RestrictCountHLL(
+	countHLL func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error),
+	count func(ctx context.Context, filter nostr.Filter) (int64, error),
+) func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+	return func(ctx context.Context, filter nostr.Filter, offset int) (int64, *hyperloglog.HyperLogLog, error) {
+		hidden, err := g.hiddenFrom(ctx, filter)
+		if err != nil {
+			return 0, nil, err
+		}
+		if len(hidden) == 0 {
+			return countHLL(ctx, filter, offset)
+		}
+		excluded, err := count(ctx, withGroups(filter, hidden))
+		if err != nil {
+			return 0, nil, err
+		}
+		if excluded == 0 {
+			return countHLL(ctx, filter, offset)
+		}
+		total, err := count(ctx, filter)
+		if err != nil {
+			return 0, nil, err
+		}
+		return total - excluded, nil, nil
+	}
+}
+
+// hiddenFrom returns the private groups whose events the filter would
+// reach but its requester can't read. Filters naming groups were already
+// checked by RejectFilter.
+func (g *Groups) hiddenFrom(ctx context.Context, filter nostr.Filter) ([]string, error) {
+	if len(filter.Tags["h"]) > 0 || khatru.IsInternalCall(ctx) {
+		return nil, nil
+	}
+	groups, err := g.dbm.GetGroups()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load groups: %w", err)
+	}
+	pubkey := khatru.GetAuthed(ctx)
+	var hidden []string
+	for _, group := range groups {
+		if !group.Private {
+			continue
+		}
+		if pubkey != "" {
+			if _, isMember, err := g.dbm.GetGroupMemberRoles(group.ID, pubkey); err != nil {
+				return nil, fmt.Errorf("failed to load group membership: %w", err)
+			} else if isMember {
+				continue
+			}
+		}
+		hidden = append(hidden, group.ID)
+	}
+	return hidden, nil
+}
+
+// withGroups narrows filter to the events of groups.
+func withGroups(filter nostr.Filter, groups []string) nostr.Filter {
+	tags := make(nostr.TagMap, len(filter.Tags)+1)
+	for name, values := range filter.Tags {
+		tags[name] = values
+	}
+	tags["h"] = groups
+	filter.Tags = tags
+	return filter
+}
+
+func (g *Groups) canRead(groupID, pubkey string) bool {
+	group, err := g.dbm.GetGroup(groupID)
+	if err != nil {
+		log.Printf("Error loading group %s: %v", groupID, err)
+		return false
+	}
+	if group == nil || !group.Private {
+		return true
+	}
+	if pubkey == "" {
+		return false
+	}
+	_, isMember, err := g.dbm.GetGroupMemberRoles(groupID, pubkey)
+	return err == nil && isMember
+}
+
+func (g *Groups) createGroup(ctx context.Context, groupID string, event *nostr.Event) error {
+	group := GroupRecord{ID: groupID, Name: groupID}
+	applyGroupMetadataTags(&group, event.Tags)
+	if err := g.dbm.CreateGroup(group); err != nil {
+		return err
+	}
+	if err := g.dbm.PutGroupMember(groupID, event.PubKey, []string{groupAdminRole}); err != nil {
+		return err
+	}
+	return g.publishState(ctx, groupID)
+}
+
+func (g *Groups) deleteGroup(ctx context.Context, groupID string) error {
+	if err := g.dbm.DeleteGroup(groupID); err != nil {
+		return err
+	}
+
+	ch, err := g.store.QueryEvents(ctx, nostr.Filter{
+		Kinds:   nip29.MetadataEventKinds,
+		Authors: []string{g.PublicKey},
+		Tags:    nostr.TagMap{"d": []string{groupID}},
+	})
+	if err != nil {
+		return err
+	}
+	for state := range ch {
+		if err := g.store.DeleteEvent(ctx, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Groups) editMetadata(ctx context.Context, groupID string, event *nostr.Event) error {
+	group, err := g.dbm.GetGroup(groupID)
+	if err != nil || group == nil {
+		return err
+	}
+	applyGroupMetadataTags(group, event.Tags)
+	if err := g.dbm.UpdateGroup(*group); err != nil {
+		return err
+	}
+	return g.publishState(ctx, groupID)
+}
+
+func (g *Groups) putUsers(ctx context.Context, groupID string, event *nostr.Event) error {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" || !nostr.IsValidPublicKey(tag[1]) {
+			continue
+		}
+		if err := g.dbm.PutGroupMember(groupID, tag[1], tag[2:]); err != nil {
+			return err
+		}
+	}
+	return g.publishState(ctx, groupID)
+}
+
+func (g *Groups) removeUsers(ctx context.Context, groupID string, event *nostr.Event) error {
+	for _, tag := range event.Tags {
+		if len(tag) < 2 || tag[0] != "p" {
+			continue
+		}
+		if err := g.dbm.RemoveGroupMember(groupID, tag[1]); err != nil {
+			return err
+		}
+	}
+	return g.publishState(ctx, groupID)
+}
+
+func (g *Groups) deleteEvents(ctx context.Context, groupID string, event *nostr.Event) error {
+	var ids []string
+	for _, tag := range event.Tags {
+		if len(tag) >= 2 && tag[0] == "e" {
+			ids = append(ids, tag[1])
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	ch, err := g.store.QueryEvents(ctx, nostr.Filter{IDs: ids})
+	if err != nil {
+		return err
+	}
+	for target := range ch {
+		// moderators can only remove posts from their own group
+		if groupIDOf(target) != groupID {
+			continue
+		}
+		if err := g.store.DeleteEvent(ctx, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *Groups) join(ctx context.Context, groupID string, event *nostr.Event) error {
+	group, err := g.dbm.GetGroup(groupID)
+	if err != nil || group == nil {
+		return err
+	}
+	if group.Closed {
+		// the request stays stored for the admins to act upon with a kind 9000
+		return nil
+	}
+	if err := g.dbm.PutGroupMember(groupID, event.PubKey, nil); err != nil {
+		return err
+	}
+	return g.publishState(ctx, groupID)
+}
+
+func (g *Groups) leave(ctx context.Context, groupID string, event *nostr.Event) error {
+	if err := g.dbm.RemoveGroupMember(groupID, event.PubKey); err != nil {
+		return err
+	}
+	return g.publishState(ctx, groupID)
+}
+
+// publishState signs, stores and broadcasts the metadata, admins and
+// members events of a group.
+func (g *Groups) publishState(ctx context.Context, groupID string) error {
+	record, err := g.dbm.GetGroup(groupID)
+	if err != nil || record == nil {
+		return err
+	}
+	members, err := g.dbm.GetGroupMembers(groupID)
+	if err != nil {
+		return err
+	}
+
+	group := nip29.Group{
+		Address: nip29.GroupAddress{ID: groupID},
+		Name:    record.Name,
+		About:   record.About,
+		Picture: record.Picture,
+		Private: record.Private,
+		Closed:  record.Closed,
+		Members: make(map[string][]*nip29.Role, len(members)),
+	}
+	for pubkey, roles := range members {
+		for _, name := range roles {
+			group.Members[pubkey] = append(group.Members[pubkey], &nip29.Role{Name: name})
+		}
+		if _, ok := group.Members[pubkey]; !ok {
+			group.Members[pubkey] = nil
+		}
+	}
+
+	for _, state := range []*nostr.Event{group.ToMetadataEvent(), group.ToAdminsEvent(), group.ToMembersEvent()} {
+		state.CreatedAt = g.nextStateTimestamp(groupID, state.Kind)
+		if err := g.key.Sign(state); err != nil {
+			return fmt.Errorf("failed to sign group state: %w", err)
+		}
+		if err := g.store.ReplaceEvent(ctx, state); err != nil {
+			return fmt.Errorf("failed to store group state: %w", err)
+		}
+		g.relay.BroadcastEvent(state)
+	}
+	return nil
+}
+
+// nextStateTimestamp makes sure successive state events of the same kind
+// always replace each other, even within the same second.
+func (g *Groups) nextStateTimestamp(groupID string, kind int) nostr.Timestamp {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	key := fmt.Sprintf("%d:%s", kind, groupID)
+	ts := nostr.Now()
+	if last := g.lastStateAt[key]; ts <= last {
+		ts = last + 1
+	}
+	g.lastStateAt[key] = ts
+	return ts
+}
+
+// applyGroupMetadataTags copies name, about, picture and status tags from a
+// create or edit-metadata event onto a group.
+func applyGroupMetadataTags(group *GroupRecord, tags nostr.Tags) {
+	for _, tag := range tags {
+		if len(tag) == 0 {
+			continue
+		}
+		switch {
+		case tag[0] == "name" && len(tag) >= 2:
+			group.Name = tag[1]
+		case tag[0] == "about" && len(tag) >= 2:
+			group.About = tag[1]
+		case tag[0] == "picture" && len(tag) >= 2:
+			group.Picture = tag[1]
+		case tag[0] == "private":
+			group.Private = true
+		case tag[0] == "public":
+			group.Private = false
+		case tag[0] == "closed":
+			group.Closed = true
+		case tag[0] == "open":
+			group.Closed = false
+		}
+	}
+}
+
+// groupIDOf returns the value of the event's 'h' tag, or "" if it has none.
+func groupIDOf(event *nostr.Event) string {
+	if tag := event.Tags.GetFirst([]string{"h", ""}); tag != nil && len(*tag) >= 2 {
+		return (*tag)[1]
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// readyTimeout bounds the dependency checks of a /readyz request.
+const readyTimeout = 2 * time.Second
+
+// worker is a background task run by App.Start. It returns when its job is
+// done or ctx is canceled; an error marks it failed in /readyz.
+type worker struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// workerStatus keeps the state of every background worker for /readyz.
+type workerStatus struct {
+	mu     sync.Mutex
+	states map[string]string
+	failed map[string]bool
+}
+
+func (ws *workerStatus) set(name, state string, failed bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.states == nil {
+		ws.states = make(map[string]string)
+		ws.failed = make(map[string]bool)
+	}
+	ws.states[name] = state
+	ws.failed[name] = failed
+}
+
+// snapshot returns the states and whether any worker failed.
+func (ws *workerStatus) snapshot() (map[string]string, bool) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	failed := false
+	for _, f := range ws.failed {
+		failed = failed || f
+	}
+	return maps.Clone(ws.states), failed
+}
+
+// readyReport is the body of /readyz.
+type readyReport struct {
+	Ready   bool              `json:"ready"`
+	Checks  map[string]string `json:"checks"`
+	Workers map[string]string `json:"workers"`
+}
+
+// ServeHealthz answers as long as the process is serving HTTP.
+func (app *App) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// ServeReadyz checks the databases, the schema and the background workers,
+// answering 503 when something is wrong or the relay is shutting down.
+func (app *App) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	report := readyReport{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			report.Ready = false
+			report.Checks[name] = err.Error()
+			return
+		}
+		report.Checks[name] = "ok"
+	}
+
+	check("database", app.dbManager.Health(ctx))
+	// the SQL eventstores have their own pool; the others are in-process
+	if pinger, ok := app.db.(interface{ PingContext(context.Context) error }); ok {
+		check("eventstore", pinger.PingContext(ctx))
+	}
+
+	if dbm, ok := unwrapStore(app.dbManager).(*DBManager); ok {
+		missing, err := dbm.MissingTables(ctx)
+		if err == nil && len(missing) > 0 {
+			err = fmt.Errorf("missing tables: %s", strings.Join(missing, ", "))
+		}
+		check("schema", err)
+	}
+
+	if app.drain.Closing() {
+		check("shutdown", fmt.Errorf("shutting down"))
+	}
+
+	workers, failed := app.workers.snapshot()
+	report.Workers = workers
+	if failed {
+		report.Ready = false
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !report.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
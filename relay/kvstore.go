@@ -0,0 +1,1358 @@
+package relay
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// kvStore is an ordered key-value store with transactions, the part of
+// LMDB and Badger that KVManager needs.
+type kvStore interface {
+	View(fn func(tx kvTx) error) error
+	Update(fn func(tx kvTx) error) error
+	Close() error
+}
+
+// kvTx reads and writes inside a kvStore transaction. Get returns nil for
+// missing keys, and Scan goes through the keys with a prefix in order.
+type kvTx interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Scan(prefix []byte, fn func(key, value []byte) error) error
+}
+
+// KVManager is the ManagementStore of the key-value backends. Every row is
+// kept as JSON under "<table>/<primary key>", shaped like the row of the
+// SQL table of the same name, so dumps move between backends.
+type KVManager struct {
+	kv kvStore
+}
+
+// NewKVManager creates a management store on kv, which it closes on Close.
+func NewKVManager(kv kvStore) *KVManager {
+	return &KVManager{kv: kv}
+}
+
+// The rows of the tables, with the columns of the SQL schema.
+type (
+	kvPubkeyRow struct {
+		PubKey    string    `json:"pubkey"`
+		Reason    string    `json:"reason"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvIDRow struct {
+		ID        string    `json:"id"`
+		Reason    string    `json:"reason"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvKindRow struct {
+		Kind      int       `json:"kind"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvIPRow struct {
+		IP        string    `json:"ip"`
+		Reason    string    `json:"reason"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvAdminRow struct {
+		PubKey    string    `json:"pubkey"`
+		Methods   []string  `json:"methods"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvDMPreferencesRow struct {
+		PubKey    string    `json:"pubkey"`
+		Types     []string  `json:"types"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	kvInfoRow struct {
+		Key       string    `json:"key"`
+		Value     string    `json:"value"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	kvDomainRow struct {
+		Domain    string    `json:"domain"`
+		Reason    string    `json:"reason"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvGroupRow struct {
+		GroupRecord
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	kvMemberRow struct {
+		GroupID   string    `json:"group_id"`
+		PubKey    string    `json:"pubkey"`
+		Roles     []string  `json:"roles"`
+		CreatedAt time.Time `json:"created_at"`
+	}
+	kvMirrorRow struct {
+		MirrorUpstream
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	// kvDelivery is the queue state kept on the rows of both delivery queues.
+	kvDelivery struct {
+		Status        string    `json:"status"`
+		Attempts      int       `json:"attempts"`
+		LastError     string    `json:"last_error"`
+		NextAttemptAt time.Time `json:"next_attempt_at"`
+		CreatedAt     time.Time `json:"created_at"`
+		UpdatedAt     time.Time `json:"updated_at"`
+	}
+	kvOutboxRow struct {
+		EventID  string          `json:"event_id"`
+		RelayURL string          `json:"relay_url"`
+		Event    json.RawMessage `json:"event"`
+		kvDelivery
+	}
+	kvWebhookRow struct {
+		ID      string          `json:"id"`
+		URL     string          `json:"url"`
+		Type    string          `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+		kvDelivery
+	}
+	kvContentRow = ContentRule
+)
+
+func kvKey(table string, parts ...string) []byte {
+	return []byte(table + "/" + strings.Join(parts, "/"))
+}
+
+// kvPrefix is the prefix of the keys of a table, or of the rows whose key
+// starts with the given parts.
+func kvPrefix(table string, parts ...string) []byte {
+	return []byte(table + "/" + strings.Join(append(parts, ""), "/"))
+}
+
+// kvGet reads a row, returning nil if there is none.
+func kvGet[T any](tx kvTx, key []byte) (*T, error) {
+	data, err := tx.Get(key)
+	if err != nil || data == nil {
+		return nil, err
+	}
+	row := new(T)
+	if err := json.Unmarshal(data, row); err != nil {
+		return nil, fmt.Errorf("invalid row %s: %w", key, err)
+	}
+	return row, nil
+}
+
+func kvPut(tx kvTx, key []byte, row any) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	return tx.Put(key, data)
+}
+
+// kvList reads every row under prefix, sorted with compare.
+func kvList[T any](tx kvTx, prefix []byte, compare func(a, b T) int) ([]T, error) {
+	var rows []T
+	err := tx.Scan(prefix, func(key, value []byte) error {
+		var row T
+		if err := json.Unmarshal(value, &row); err != nil {
+			return fmt.Errorf("invalid row %s: %w", key, err)
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if compare != nil {
+		slices.SortStableFunc(rows, compare)
+	}
+	return rows, nil
+}
+
+// kvDeletePrefix deletes every key under prefix. The keys are collected
+// first, as not every store lets a scan see its own deletes.
+func kvDeletePrefix(tx kvTx, prefix []byte) error {
+	var keys [][]byte
+	err := tx.Scan(prefix, func(key, value []byte) error {
+		keys = append(keys, bytes.Clone(key))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func kvExists(tx kvTx, key []byte) (bool, error) {
+	data, err := tx.Get(key)
+	return data != nil, err
+}
+
+func (km *KVManager) exists(key []byte) (bool, error) {
+	var exists bool
+	err := km.kv.View(func(tx kvTx) error {
+		var err error
+		exists, err = kvExists(tx, key)
+		return err
+	})
+	return exists, err
+}
+
+func (km *KVManager) delete(key []byte) error {
+	return km.kv.Update(func(tx kvTx) error {
+		return tx.Delete(key)
+	})
+}
+
+func byCreatedAt[T any](createdAt func(T) time.Time) func(a, b T) int {
+	return func(a, b T) int {
+		return createdAt(a).Compare(createdAt(b))
+	}
+}
+
+// Close closes the store.
+func (km *KVManager) Close() error {
+	return km.kv.Close()
+}
+
+// Health checks that the store can still be read.
+func (km *KVManager) Health(ctx context.Context) error {
+	return km.kv.View(func(tx kvTx) error {
+		_, err := tx.Get(kvKey("relay_info", "name"))
+		return err
+	})
+}
+
+// AddAllowedPubkey adds a pubkey to the allowed list.
+func (km *KVManager) AddAllowedPubkey(pubkey, reason string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	err := km.kv.Update(func(tx kvTx) error {
+		key := kvKey("allowed_pubkeys", pubkey)
+		if exists, err := kvExists(tx, key); err != nil || exists {
+			return err
+		}
+		return kvPut(tx, key, kvPubkeyRow{PubKey: pubkey, Reason: reason, CreatedAt: time.Now().UTC()})
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add allowed pubkey %s: %w", pubkey, err)
+	}
+	return nil
+}
+
+// RemoveAllowedPubkey removes a pubkey from the allowed list.
+func (km *KVManager) RemoveAllowedPubkey(pubkey string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("allowed_pubkeys", pubkey)
+		exists, err := kvExists(tx, key)
+		if err != nil {
+			return fmt.Errorf("failed to remove allowed pubkey %s: %w", pubkey, err)
+		}
+		if !exists {
+			return fmt.Errorf("pubkey %s not found in allowed list", pubkey)
+		}
+		return tx.Delete(key)
+	})
+}
+
+// IsAllowedPubkey checks if a pubkey is in the allowed list.
+func (km *KVManager) IsAllowedPubkey(pubkey string) (bool, error) {
+	if pubkey == "" {
+		return false, nil
+	}
+	return km.exists(kvKey("allowed_pubkeys", pubkey))
+}
+
+// GetAllowedPubkeys returns all allowed pubkeys ordered by creation time.
+func (km *KVManager) GetAllowedPubkeys() ([]string, error) {
+	rows, err := km.GetAllowedPubkeysWithReason()
+	if err != nil {
+		return nil, err
+	}
+	var pubkeys []string
+	for _, row := range rows {
+		pubkeys = append(pubkeys, row.PubKey)
+	}
+	return pubkeys, nil
+}
+
+func (km *KVManager) listPubkeys(table string) ([]nip86.PubKeyReason, error) {
+	var result []nip86.PubKeyReason
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix(table), byCreatedAt(func(r kvPubkeyRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, nip86.PubKeyReason{PubKey: row.PubKey, Reason: row.Reason})
+		}
+		return err
+	})
+	return result, err
+}
+
+// GetAllowedPubkeysWithReason returns all allowed pubkeys with reasons.
+func (km *KVManager) GetAllowedPubkeysWithReason() ([]nip86.PubKeyReason, error) {
+	return km.listPubkeys("allowed_pubkeys")
+}
+
+// BanPubKey adds a pubkey to the banned list.
+func (km *KVManager) BanPubKey(pubkey, reason string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("banned_pubkeys", pubkey)
+		row, err := kvGet[kvPubkeyRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvPubkeyRow{PubKey: pubkey, CreatedAt: time.Now().UTC()}
+		}
+		row.Reason = reason
+		return kvPut(tx, key, row)
+	})
+}
+
+// UnbanPubKey removes a pubkey from the banned list.
+func (km *KVManager) UnbanPubKey(pubkey string) error {
+	return km.delete(kvKey("banned_pubkeys", pubkey))
+}
+
+// IsBannedPubkey checks if a pubkey is banned.
+func (km *KVManager) IsBannedPubkey(pubkey string) (bool, error) {
+	return km.exists(kvKey("banned_pubkeys", pubkey))
+}
+
+// GetBannedPubkeys returns all banned pubkeys.
+func (km *KVManager) GetBannedPubkeys() ([]nip86.PubKeyReason, error) {
+	return km.listPubkeys("banned_pubkeys")
+}
+
+func (km *KVManager) listIDs(table string) ([]nip86.IDReason, error) {
+	var result []nip86.IDReason
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix(table), byCreatedAt(func(r kvIDRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, nip86.IDReason{ID: row.ID, Reason: row.Reason})
+		}
+		return err
+	})
+	return result, err
+}
+
+// AddEventNeedingModeration adds an event to the moderation queue.
+func (km *KVManager) AddEventNeedingModeration(id, reason string) error {
+	if id == "" {
+		return fmt.Errorf("event id cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("events_needing_moderation", id)
+		if exists, err := kvExists(tx, key); err != nil || exists {
+			return err
+		}
+		return kvPut(tx, key, kvIDRow{ID: id, Reason: reason, CreatedAt: time.Now().UTC()})
+	})
+}
+
+// GetEventsNeedingModeration returns all events needing moderation.
+func (km *KVManager) GetEventsNeedingModeration() ([]nip86.IDReason, error) {
+	return km.listIDs("events_needing_moderation")
+}
+
+// moderate puts an event on one list and takes it off the moderation queue
+// and the other list.
+func (km *KVManager) moderate(id, reason, table, other string) error {
+	if id == "" {
+		return fmt.Errorf("event id cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey(table, id)
+		row, err := kvGet[kvIDRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvIDRow{ID: id, CreatedAt: time.Now().UTC()}
+		}
+		row.Reason = reason
+		if err := kvPut(tx, key, row); err != nil {
+			return err
+		}
+		if err := tx.Delete(kvKey("events_needing_moderation", id)); err != nil {
+			return err
+		}
+		return tx.Delete(kvKey(other, id))
+	})
+}
+
+// AllowEvent adds an event to the allowed list and removes it from moderation queue.
+func (km *KVManager) AllowEvent(id, reason string) error {
+	return km.moderate(id, reason, "allowed_events", "banned_events")
+}
+
+// BanEvent adds an event to the banned list and removes it from moderation queue.
+func (km *KVManager) BanEvent(id, reason string) error {
+	return km.moderate(id, reason, "banned_events", "allowed_events")
+}
+
+// GetBannedEvents returns all banned events.
+func (km *KVManager) GetBannedEvents() ([]nip86.IDReason, error) {
+	return km.listIDs("banned_events")
+}
+
+// GetAllowedEvents returns all allowed events.
+func (km *KVManager) GetAllowedEvents() ([]nip86.IDReason, error) {
+	return km.listIDs("allowed_events")
+}
+
+// setKind puts a kind on one list and takes it off the other.
+func (km *KVManager) setKind(kind int, table, other string) error {
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey(table, fmt.Sprint(kind))
+		exists, err := kvExists(tx, key)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := kvPut(tx, key, kvKindRow{Kind: kind, CreatedAt: time.Now().UTC()}); err != nil {
+				return err
+			}
+		}
+		return tx.Delete(kvKey(other, fmt.Sprint(kind)))
+	})
+}
+
+func (km *KVManager) listKinds(table string) ([]int, error) {
+	var result []int
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix(table), func(a, b kvKindRow) int { return cmp.Compare(a.Kind, b.Kind) })
+		for _, row := range rows {
+			result = append(result, row.Kind)
+		}
+		return err
+	})
+	return result, err
+}
+
+// AllowKind adds a kind to the allowed list.
+func (km *KVManager) AllowKind(kind int) error {
+	return km.setKind(kind, "allowed_kinds", "disallowed_kinds")
+}
+
+// DisallowKind adds a kind to the disallowed list.
+func (km *KVManager) DisallowKind(kind int) error {
+	return km.setKind(kind, "disallowed_kinds", "allowed_kinds")
+}
+
+// GetAllowedKinds returns all allowed kinds.
+func (km *KVManager) GetAllowedKinds() ([]int, error) {
+	return km.listKinds("allowed_kinds")
+}
+
+// GetDisallowedKinds returns all disallowed kinds.
+func (km *KVManager) GetDisallowedKinds() ([]int, error) {
+	return km.listKinds("disallowed_kinds")
+}
+
+// BlockIP adds an IP to the blocked list.
+func (km *KVManager) BlockIP(ip net.IP, reason string) error {
+	if ip == nil {
+		return fmt.Errorf("ip cannot be nil")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("blocked_ips", ip.String())
+		row, err := kvGet[kvIPRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvIPRow{IP: ip.String(), CreatedAt: time.Now().UTC()}
+		}
+		row.Reason = reason
+		return kvPut(tx, key, row)
+	})
+}
+
+// UnblockIP removes an IP from the blocked list.
+func (km *KVManager) UnblockIP(ip net.IP) error {
+	if ip == nil {
+		return fmt.Errorf("ip cannot be nil")
+	}
+	return km.delete(kvKey("blocked_ips", ip.String()))
+}
+
+// GetBlockedIPs returns all blocked IPs.
+func (km *KVManager) GetBlockedIPs() ([]nip86.IPReason, error) {
+	var result []nip86.IPReason
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("blocked_ips"), byCreatedAt(func(r kvIPRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, nip86.IPReason{IP: row.IP, Reason: row.Reason})
+		}
+		return err
+	})
+	return result, err
+}
+
+// SetRelayInfo sets a relay info field (name, description, icon).
+func (km *KVManager) SetRelayInfo(key, value string) error {
+	return km.kv.Update(func(tx kvTx) error {
+		return kvPut(tx, kvKey("relay_info", key), kvInfoRow{Key: key, Value: value, UpdatedAt: time.Now().UTC()})
+	})
+}
+
+// GetRelayInfo gets a relay info field.
+func (km *KVManager) GetRelayInfo(key string) (string, error) {
+	var value string
+	err := km.kv.View(func(tx kvTx) error {
+		row, err := kvGet[kvInfoRow](tx, kvKey("relay_info", key))
+		if row != nil {
+			value = row.Value
+		}
+		return err
+	})
+	return value, err
+}
+
+// GrantAdmin grants admin permissions to a pubkey.
+func (km *KVManager) GrantAdmin(pubkey string, methods []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("admins", pubkey)
+		row, err := kvGet[kvAdminRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvAdminRow{PubKey: pubkey, CreatedAt: time.Now().UTC()}
+		}
+		row.Methods = methods
+		return kvPut(tx, key, row)
+	})
+}
+
+// RevokeAdmin revokes admin permissions from a pubkey. Without methods,
+// all of them are revoked.
+func (km *KVManager) RevokeAdmin(pubkey string, methods []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("admins", pubkey)
+		row, err := kvGet[kvAdminRow](tx, key)
+		if err != nil || row == nil {
+			return err
+		}
+		row.Methods = slices.DeleteFunc(row.Methods, func(m string) bool {
+			return slices.Contains(methods, m)
+		})
+		if len(methods) == 0 || len(row.Methods) == 0 {
+			return tx.Delete(key)
+		}
+		return kvPut(tx, key, row)
+	})
+}
+
+// IsAdmin checks if a pubkey is an admin.
+func (km *KVManager) IsAdmin(pubkey string) (bool, error) {
+	return km.exists(kvKey("admins", pubkey))
+}
+
+// GetAdminMethods returns the admin methods for a pubkey.
+func (km *KVManager) GetAdminMethods(pubkey string) ([]string, error) {
+	var methods []string
+	err := km.kv.View(func(tx kvTx) error {
+		row, err := kvGet[kvAdminRow](tx, kvKey("admins", pubkey))
+		if row != nil {
+			methods = row.Methods
+		}
+		return err
+	})
+	return methods, err
+}
+
+// GetAdmins returns all admins.
+func (km *KVManager) GetAdmins() ([]AdminMethods, error) {
+	var result []AdminMethods
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("admins"), byCreatedAt(func(r kvAdminRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, AdminMethods{PubKey: row.PubKey, Methods: row.Methods})
+		}
+		return err
+	})
+	return result, err
+}
+
+// SetDMPreferences sets the notification types a pubkey gets as DMs.
+func (km *KVManager) SetDMPreferences(pubkey string, types []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		return kvPut(tx, kvKey("dm_preferences", pubkey), kvDMPreferencesRow{PubKey: pubkey, Types: types, UpdatedAt: time.Now().UTC()})
+	})
+}
+
+// GetDMPreferences returns the notification types a pubkey gets as DMs,
+// and whether it ever set them.
+func (km *KVManager) GetDMPreferences(pubkey string) ([]string, bool, error) {
+	var row *kvDMPreferencesRow
+	err := km.kv.View(func(tx kvTx) (err error) {
+		row, err = kvGet[kvDMPreferencesRow](tx, kvKey("dm_preferences", pubkey))
+		return err
+	})
+	if err != nil || row == nil {
+		return nil, false, err
+	}
+	return row.Types, true, nil
+}
+
+// AllowNIP05Domain adds a domain whose verified NIP-05 identifiers may write.
+func (km *KVManager) AllowNIP05Domain(domain, reason string) error {
+	if domain == "" {
+		return fmt.Errorf("domain cannot be empty")
+	}
+	domain = strings.ToLower(domain)
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("allowed_nip05_domains", domain)
+		row, err := kvGet[kvDomainRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvDomainRow{Domain: domain, CreatedAt: time.Now().UTC()}
+		}
+		row.Reason = reason
+		return kvPut(tx, key, row)
+	})
+}
+
+// DisallowNIP05Domain removes a domain from the NIP-05 allowlist.
+func (km *KVManager) DisallowNIP05Domain(domain string) error {
+	if domain == "" {
+		return fmt.Errorf("domain cannot be empty")
+	}
+	return km.delete(kvKey("allowed_nip05_domains", strings.ToLower(domain)))
+}
+
+// IsAllowedNIP05Domain checks if a domain is in the NIP-05 allowlist.
+func (km *KVManager) IsAllowedNIP05Domain(domain string) (bool, error) {
+	return km.exists(kvKey("allowed_nip05_domains", strings.ToLower(domain)))
+}
+
+// GetAllowedNIP05Domains returns all allowed NIP-05 domains.
+func (km *KVManager) GetAllowedNIP05Domains() ([]DomainReason, error) {
+	var result []DomainReason
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("allowed_nip05_domains"), byCreatedAt(func(r kvDomainRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, DomainReason{Domain: row.Domain, Reason: row.Reason})
+		}
+		return err
+	})
+	return result, err
+}
+
+// AddContentRule adds a content filter rule, or changes the action and
+// reason of an existing one.
+func (km *KVManager) AddContentRule(rule ContentRule) error {
+	if rule.Type == "" || rule.Pattern == "" {
+		return fmt.Errorf("rule type and pattern cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("content_rules", rule.Type, rule.Pattern)
+		row, err := kvGet[kvContentRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvContentRow{Type: rule.Type, Pattern: rule.Pattern, CreatedAt: time.Now().UTC()}
+		}
+		row.Action, row.Reason = rule.Action, rule.Reason
+		return kvPut(tx, key, row)
+	})
+}
+
+// RemoveContentRule removes a content filter rule. It returns whether there
+// was one.
+func (km *KVManager) RemoveContentRule(kind, pattern string) (bool, error) {
+	var found bool
+	err := km.kv.Update(func(tx kvTx) (err error) {
+		key := kvKey("content_rules", kind, pattern)
+		if found, err = kvExists(tx, key); err != nil || !found {
+			return err
+		}
+		return tx.Delete(key)
+	})
+	return found, err
+}
+
+// GetContentRules returns all content filter rules.
+func (km *KVManager) GetContentRules() ([]ContentRule, error) {
+	var result []ContentRule
+	err := km.kv.View(func(tx kvTx) (err error) {
+		result, err = kvList(tx, kvPrefix("content_rules"), byCreatedAt(func(r kvContentRow) time.Time { return r.CreatedAt }))
+		return err
+	})
+	return result, err
+}
+
+// CreateGroup inserts a new group. Returns an error if the id is taken.
+func (km *KVManager) CreateGroup(group GroupRecord) error {
+	if group.ID == "" {
+		return fmt.Errorf("group id cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("groups", group.ID)
+		exists, err := kvExists(tx, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return fmt.Errorf("failed to create group %s: already exists", group.ID)
+		}
+		now := time.Now().UTC()
+		return kvPut(tx, key, kvGroupRow{GroupRecord: group, CreatedAt: now, UpdatedAt: now})
+	})
+}
+
+// UpdateGroup overwrites the metadata of an existing group.
+func (km *KVManager) UpdateGroup(group GroupRecord) error {
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("groups", group.ID)
+		row, err := kvGet[kvGroupRow](tx, key)
+		if err != nil || row == nil {
+			return err
+		}
+		row.GroupRecord = group
+		row.UpdatedAt = time.Now().UTC()
+		return kvPut(tx, key, row)
+	})
+}
+
+// DeleteGroup removes a group and its members.
+func (km *KVManager) DeleteGroup(id string) error {
+	return km.kv.Update(func(tx kvTx) error {
+		if err := tx.Delete(kvKey("groups", id)); err != nil {
+			return err
+		}
+		return kvDeletePrefix(tx, kvPrefix("group_members", id))
+	})
+}
+
+// GetGroup returns a group by id, or nil if it doesn't exist.
+func (km *KVManager) GetGroup(id string) (*GroupRecord, error) {
+	var group *GroupRecord
+	err := km.kv.View(func(tx kvTx) error {
+		row, err := kvGet[kvGroupRow](tx, kvKey("groups", id))
+		if row != nil {
+			group = &row.GroupRecord
+		}
+		return err
+	})
+	return group, err
+}
+
+// GetGroups returns all groups ordered by creation time.
+func (km *KVManager) GetGroups() ([]GroupRecord, error) {
+	var result []GroupRecord
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("groups"), byCreatedAt(func(r kvGroupRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, row.GroupRecord)
+		}
+		return err
+	})
+	return result, err
+}
+
+// PutGroupMember adds a member to a group or replaces their roles.
+func (km *KVManager) PutGroupMember(groupID, pubkey string, roles []string) error {
+	if pubkey == "" {
+		return fmt.Errorf("pubkey cannot be empty")
+	}
+	if roles == nil {
+		roles = []string{}
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		// like the foreign key, members need their group
+		if exists, err := kvExists(tx, kvKey("groups", groupID)); err != nil {
+			return err
+		} else if !exists {
+			return fmt.Errorf("group %s does not exist", groupID)
+		}
+
+		key := kvKey("group_members", groupID, pubkey)
+		row, err := kvGet[kvMemberRow](tx, key)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			row = &kvMemberRow{GroupID: groupID, PubKey: pubkey, CreatedAt: time.Now().UTC()}
+		}
+		row.Roles = roles
+		return kvPut(tx, key, row)
+	})
+}
+
+// RemoveGroupMember removes a member from a group.
+func (km *KVManager) RemoveGroupMember(groupID, pubkey string) error {
+	return km.delete(kvKey("group_members", groupID, pubkey))
+}
+
+// GetGroupMemberRoles returns the roles of a group member. The second return
+// value is false when the pubkey is not a member.
+func (km *KVManager) GetGroupMemberRoles(groupID, pubkey string) ([]string, bool, error) {
+	var row *kvMemberRow
+	err := km.kv.View(func(tx kvTx) error {
+		var err error
+		row, err = kvGet[kvMemberRow](tx, kvKey("group_members", groupID, pubkey))
+		return err
+	})
+	if err != nil || row == nil {
+		return nil, false, err
+	}
+	return row.Roles, true, nil
+}
+
+// GetGroupMembers returns every member of a group with their roles.
+func (km *KVManager) GetGroupMembers(groupID string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList[kvMemberRow](tx, kvPrefix("group_members", groupID), nil)
+		for _, row := range rows {
+			result[row.PubKey] = row.Roles
+		}
+		return err
+	})
+	return result, err
+}
+
+// AddMirrorUpstream adds an upstream relay. Existing cursors are kept.
+func (km *KVManager) AddMirrorUpstream(url string) error {
+	if url == "" {
+		return fmt.Errorf("url cannot be empty")
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("mirror_upstreams", url)
+		if exists, err := kvExists(tx, key); err != nil || exists {
+			return err
+		}
+		now := time.Now().UTC()
+		return kvPut(tx, key, kvMirrorRow{MirrorUpstream: MirrorUpstream{URL: url}, CreatedAt: now, UpdatedAt: now})
+	})
+}
+
+// RemoveMirrorUpstream removes an upstream relay and its cursors.
+func (km *KVManager) RemoveMirrorUpstream(url string) error {
+	return km.delete(kvKey("mirror_upstreams", url))
+}
+
+// GetMirrorUpstream returns an upstream by url, or nil if it doesn't exist.
+func (km *KVManager) GetMirrorUpstream(url string) (*MirrorUpstream, error) {
+	var upstream *MirrorUpstream
+	err := km.kv.View(func(tx kvTx) error {
+		row, err := kvGet[kvMirrorRow](tx, kvKey("mirror_upstreams", url))
+		if row != nil {
+			upstream = &row.MirrorUpstream
+		}
+		return err
+	})
+	return upstream, err
+}
+
+// GetMirrorUpstreams returns all upstream relays.
+func (km *KVManager) GetMirrorUpstreams() ([]MirrorUpstream, error) {
+	var result []MirrorUpstream
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("mirror_upstreams"), byCreatedAt(func(r kvMirrorRow) time.Time { return r.CreatedAt }))
+		for _, row := range rows {
+			result = append(result, row.MirrorUpstream)
+		}
+		return err
+	})
+	return result, err
+}
+
+// updateMirror changes an upstream's cursors if it exists.
+func (km *KVManager) updateMirror(url string, update func(row *kvMirrorRow)) error {
+	return km.kv.Update(func(tx kvTx) error {
+		key := kvKey("mirror_upstreams", url)
+		row, err := kvGet[kvMirrorRow](tx, key)
+		if err != nil || row == nil {
+			return err
+		}
+		update(row)
+		row.UpdatedAt = time.Now().UTC()
+		return kvPut(tx, key, row)
+	})
+}
+
+// SetMirrorBackfillCursor records how far back the historical backfill got.
+func (km *KVManager) SetMirrorBackfillCursor(url string, until int64, done bool) error {
+	return km.updateMirror(url, func(row *kvMirrorRow) {
+		row.BackfillUntil = until
+		row.BackfillDone = done
+	})
+}
+
+// SetMirrorLastSeen records the newest event timestamp seen live.
+func (km *KVManager) SetMirrorLastSeen(url string, lastSeen int64) error {
+	return km.updateMirror(url, func(row *kvMirrorRow) {
+		row.LastSeen = max(row.LastSeen, lastSeen)
+	})
+}
+
+// ResetMirrorBackfill makes the next connection redo the historical backfill.
+func (km *KVManager) ResetMirrorBackfill(url string) error {
+	return km.updateMirror(url, func(row *kvMirrorRow) {
+		row.BackfillUntil = 0
+		row.BackfillDone = false
+	})
+}
+
+// kvQueueRow is a row of a delivery queue, stored as an R.
+type kvQueueRow[R any] interface {
+	*R
+	queueKey() (id, url string)
+	state() *kvDelivery
+}
+
+func (d *kvDelivery) state() *kvDelivery { return d }
+
+// kvKey is the key of the entry of an item for a destination.
+func (t deliveryTable) kvKey(id, url string) []byte {
+	return kvKey(t.name, id, url)
+}
+
+// newKVDelivery is the state of an entry queued now.
+func newKVDelivery() kvDelivery {
+	now := time.Now().UTC()
+	return kvDelivery{Status: deliveryPending, NextAttemptAt: now, CreatedAt: now, UpdatedAt: now}
+}
+
+// kvEnqueue stores a new entry, unless it is already queued.
+func kvEnqueue[R any, P kvQueueRow[R]](tx kvTx, t deliveryTable, row P) error {
+	key := t.kvKey(row.queueKey())
+	if exists, err := kvExists(tx, key); err != nil || exists {
+		return err
+	}
+	return kvPut(tx, key, row)
+}
+
+// kvClaim picks up to limit pending entries that are due and pushes their
+// next attempt lease into the future.
+func kvClaim[R any, P kvQueueRow[R]](km *KVManager, t deliveryTable, limit int, lease time.Duration) ([]R, error) {
+	var result []R
+	err := km.kv.Update(func(tx kvTx) error {
+		now := time.Now().UTC()
+		rows, err := kvList(tx, kvPrefix(t.name), func(a, b R) int {
+			return P(&a).state().NextAttemptAt.Compare(P(&b).state().NextAttemptAt)
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if len(result) == limit {
+				break
+			}
+			state := P(&row).state()
+			if state.Status != deliveryPending || state.NextAttemptAt.After(now) {
+				continue
+			}
+			state.NextAttemptAt = now.Add(lease)
+			if err := kvPut(tx, t.kvKey(P(&row).queueKey()), row); err != nil {
+				return err
+			}
+			result = append(result, row)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// kvUpdateDelivery changes the state of an entry if it exists.
+func kvUpdateDelivery[R any, P kvQueueRow[R]](km *KVManager, t deliveryTable, id, url string, update func(state *kvDelivery)) error {
+	return km.kv.Update(func(tx kvTx) error {
+		key := t.kvKey(id, url)
+		row, err := kvGet[R](tx, key)
+		if err != nil || row == nil {
+			return err
+		}
+		state := P(row).state()
+		update(state)
+		state.UpdatedAt = time.Now().UTC()
+		return kvPut(tx, key, row)
+	})
+}
+
+// kvMarkDelivered records a successful delivery.
+func kvMarkDelivered[R any, P kvQueueRow[R]](km *KVManager, t deliveryTable, id, url string) error {
+	return kvUpdateDelivery[R, P](km, t, id, url, func(state *kvDelivery) {
+		state.Status = deliveryDelivered
+		state.Attempts++
+		state.LastError = ""
+	})
+}
+
+// kvMarkFailed records a failed attempt. The delivery is retried after
+// retryIn, or dead-lettered if dead is true.
+func kvMarkFailed[R any, P kvQueueRow[R]](km *KVManager, t deliveryTable, id, url, lastError string, retryIn time.Duration, dead bool) error {
+	return kvUpdateDelivery[R, P](km, t, id, url, func(state *kvDelivery) {
+		state.Status = deliveryPending
+		if dead {
+			state.Status = deliveryDead
+		}
+		state.Attempts++
+		state.LastError = lastError
+		state.NextAttemptAt = time.Now().UTC().Add(retryIn)
+	})
+}
+
+// kvRetry puts dead deliveries of an item back in the queue with a fresh
+// retry budget. An empty url retries all of them.
+func kvRetry[R any, P kvQueueRow[R]](km *KVManager, t deliveryTable, id, url string) (int64, error) {
+	var count int64
+	err := km.kv.Update(func(tx kvTx) error {
+		rows, err := kvList[R](tx, kvPrefix(t.name, id), nil)
+		if err != nil {
+			return err
+		}
+		now := time.Now().UTC()
+		for _, row := range rows {
+			_, rowURL := P(&row).queueKey()
+			state := P(&row).state()
+			if state.Status != deliveryDead || (url != "" && rowURL != url) {
+				continue
+			}
+			state.Status = deliveryPending
+			state.Attempts = 0
+			state.NextAttemptAt = now
+			state.UpdatedAt = now
+			if err := kvPut(tx, t.kvKey(id, rowURL), row); err != nil {
+				return err
+			}
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// kvPrune removes finished entries older than the given age.
+func kvPrune[R any, P kvQueueRow[R]](km *KVManager, t deliveryTable, olderThan time.Duration) error {
+	return km.kv.Update(func(tx kvTx) error {
+		rows, err := kvList[R](tx, kvPrefix(t.name), nil)
+		if err != nil {
+			return err
+		}
+		cutoff := time.Now().Add(-olderThan)
+		for _, row := range rows {
+			state := P(&row).state()
+			finished := state.Status == deliveryDelivered || (t.pruneDead && state.Status == deliveryDead)
+			if finished && state.UpdatedAt.Before(cutoff) {
+				if err := tx.Delete(t.kvKey(P(&row).queueKey())); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (row *kvOutboxRow) queueKey() (string, string) { return row.EventID, row.RelayURL }
+
+func (row *kvOutboxRow) delivery() (OutboxDelivery, error) {
+	d := OutboxDelivery{
+		EventID:       row.EventID,
+		RelayURL:      row.RelayURL,
+		Event:         &nostr.Event{},
+		Status:        row.Status,
+		Attempts:      row.Attempts,
+		LastError:     row.LastError,
+		NextAttemptAt: row.NextAttemptAt,
+	}
+	if err := json.Unmarshal(row.Event, d.Event); err != nil {
+		return d, fmt.Errorf("invalid queued event %s: %w", row.EventID, err)
+	}
+	return d, nil
+}
+
+// EnqueueOutboxEvent queues an event for delivery to every given relay.
+// Events that are already queued for a relay are left alone.
+func (km *KVManager) EnqueueOutboxEvent(event *nostr.Event, relayURLs []string) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return km.kv.Update(func(tx kvTx) error {
+		for _, url := range relayURLs {
+			row := &kvOutboxRow{EventID: event.ID, RelayURL: url, Event: data, kvDelivery: newKVDelivery()}
+			if err := kvEnqueue(tx, outboxTable, row); err != nil {
+				return fmt.Errorf("failed to enqueue event %s for %s: %w", event.ID, url, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ClaimOutboxDeliveries picks up to limit pending deliveries that are due and
+// pushes their next attempt lease into the future.
+func (km *KVManager) ClaimOutboxDeliveries(limit int, lease time.Duration) ([]OutboxDelivery, error) {
+	rows, err := kvClaim[kvOutboxRow](km, outboxTable, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]OutboxDelivery, 0, len(rows))
+	for _, row := range rows {
+		d, err := row.delivery()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, d)
+	}
+	return result, nil
+}
+
+// MarkOutboxDelivered records a successful delivery.
+func (km *KVManager) MarkOutboxDelivered(eventID, relayURL string) error {
+	return kvMarkDelivered[kvOutboxRow](km, outboxTable, eventID, relayURL)
+}
+
+// MarkOutboxFailed records a failed attempt. The delivery is retried after
+// retryIn, or dead-lettered if dead is true.
+func (km *KVManager) MarkOutboxFailed(eventID, relayURL, lastError string, retryIn time.Duration, dead bool) error {
+	return kvMarkFailed[kvOutboxRow](km, outboxTable, eventID, relayURL, lastError, retryIn, dead)
+}
+
+// GetDeadOutboxDeliveries returns the deliveries that ran out of retries.
+func (km *KVManager) GetDeadOutboxDeliveries() ([]OutboxDelivery, error) {
+	var result []OutboxDelivery
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("outbox_deliveries"), func(a, b kvOutboxRow) int {
+			return b.UpdatedAt.Compare(a.UpdatedAt)
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			if row.Status != OutboxDead {
+				continue
+			}
+			d, err := row.delivery()
+			if err != nil {
+				return err
+			}
+			result = append(result, d)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// RetryOutboxDeliveries puts dead deliveries of an event back in the queue
+// with a fresh retry budget. An empty relayURL retries all of them.
+func (km *KVManager) RetryOutboxDeliveries(eventID, relayURL string) (int64, error) {
+	return kvRetry[kvOutboxRow](km, outboxTable, eventID, relayURL)
+}
+
+// PruneOutboxDelivered removes delivered entries older than the given age.
+func (km *KVManager) PruneOutboxDelivered(olderThan time.Duration) error {
+	return kvPrune[kvOutboxRow](km, outboxTable, olderThan)
+}
+
+func (row *kvWebhookRow) queueKey() (string, string) { return row.ID, row.URL }
+
+func (row *kvWebhookRow) delivery() WebhookDelivery {
+	return WebhookDelivery{
+		ID:            row.ID,
+		URL:           row.URL,
+		Type:          row.Type,
+		Payload:       row.Payload,
+		Status:        row.Status,
+		Attempts:      row.Attempts,
+		LastError:     row.LastError,
+		NextAttemptAt: row.NextAttemptAt,
+		CreatedAt:     row.CreatedAt,
+		UpdatedAt:     row.UpdatedAt,
+	}
+}
+
+// EnqueueWebhook queues a notification for delivery to every given URL.
+func (km *KVManager) EnqueueWebhook(id, kind string, payload []byte, urls []string) error {
+	return km.kv.Update(func(tx kvTx) error {
+		for _, url := range urls {
+			row := &kvWebhookRow{ID: id, URL: url, Type: kind, Payload: payload, kvDelivery: newKVDelivery()}
+			if err := kvEnqueue(tx, webhookTable, row); err != nil {
+				return fmt.Errorf("failed to enqueue webhook %s for %s: %w", id, url, err)
+			}
+		}
+		return nil
+	})
+}
+
+// ClaimWebhookDeliveries picks up to limit pending deliveries that are due
+// and pushes their next attempt lease into the future.
+func (km *KVManager) ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	rows, err := kvClaim[kvWebhookRow](km, webhookTable, limit, lease)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]WebhookDelivery, len(rows))
+	for i := range rows {
+		result[i] = rows[i].delivery()
+	}
+	return result, nil
+}
+
+// MarkWebhookDelivered records a successful delivery.
+func (km *KVManager) MarkWebhookDelivered(id, url string) error {
+	return kvMarkDelivered[kvWebhookRow](km, webhookTable, id, url)
+}
+
+// MarkWebhookFailed records a failed attempt. The delivery is retried after
+// retryIn, or dead-lettered if dead is true.
+func (km *KVManager) MarkWebhookFailed(id, url, lastError string, retryIn time.Duration, dead bool) error {
+	return kvMarkFailed[kvWebhookRow](km, webhookTable, id, url, lastError, retryIn, dead)
+}
+
+// GetWebhookDeliveries returns the latest limit deliveries, newest first.
+func (km *KVManager) GetWebhookDeliveries(limit int) ([]WebhookDelivery, error) {
+	var result []WebhookDelivery
+	err := km.kv.View(func(tx kvTx) error {
+		rows, err := kvList(tx, kvPrefix("webhook_deliveries"), func(a, b kvWebhookRow) int {
+			return b.CreatedAt.Compare(a.CreatedAt)
+		})
+		if err != nil {
+			return err
+		}
+		for _, row := range rows[:min(limit, len(rows))] {
+			result = append(result, row.delivery())
+		}
+		return nil
+	})
+	return result, err
+}
+
+// RetryWebhookDeliveries puts dead deliveries of a notification back in the
+// queue with a fresh retry budget. An empty url retries all of them.
+func (km *KVManager) RetryWebhookDeliveries(id, url string) (int64, error) {
+	return kvRetry[kvWebhookRow](km, webhookTable, id, url)
+}
+
+// PruneWebhookDeliveries removes delivered and dead entries older than the
+// given age.
+func (km *KVManager) PruneWebhookDeliveries(olderThan time.Duration) error {
+	return kvPrune[kvWebhookRow](km, webhookTable, olderThan)
+}
+
+// policyTableKeys are the primary key columns of the policy tables.
+var policyTableKeys = map[string]string{
+	"allowed_pubkeys": "pubkey",
+	"banned_pubkeys":  "pubkey",
+	"banned_events":   "id",
+	"admins":          "pubkey",
+	"relay_info":      "key",
+}
+
+// DumpPolicyTables writes every row of the policy tables as JSONL.
+func (km *KVManager) DumpPolicyTables(w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	count := 0
+	err := km.kv.View(func(tx kvTx) error {
+		for _, table := range policyTables {
+			err := tx.Scan(kvPrefix(table), func(key, value []byte) error {
+				count++
+				return enc.Encode(PolicyRow{Table: table, Row: bytes.Clone(value)})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+// RestorePolicyTables reads a dump and inserts its rows. Rows that already
+// exist are kept as they are.
+func (km *KVManager) RestorePolicyTables(r io.Reader) (int, error) {
+	dec := json.NewDecoder(r)
+	count := 0
+	err := km.kv.Update(func(tx kvTx) error {
+		for {
+			var pr PolicyRow
+			if err := dec.Decode(&pr); errors.Is(err, io.EOF) {
+				return nil
+			} else if err != nil {
+				return fmt.Errorf("invalid dump line %d: %w", count+1, err)
+			}
+			if err := restoreKVRow(tx, pr); err != nil {
+				return fmt.Errorf("line %d: %w", count+1, err)
+			}
+			count++
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func restoreKVRow(tx kvTx, pr PolicyRow) error {
+	column, ok := policyTableKeys[pr.Table]
+	if !ok {
+		return fmt.Errorf("unknown table %q", pr.Table)
+	}
+
+	var row map[string]any
+	if err := json.Unmarshal(pr.Row, &row); err != nil {
+		return fmt.Errorf("invalid %s row: %w", pr.Table, err)
+	}
+	pk, ok := row[column].(string)
+	if !ok || pk == "" {
+		return fmt.Errorf("%s row without %s", pr.Table, column)
+	}
+	// timestamps of a Postgres dump have no zone, which Go's JSON decoding
+	// of time.Time doesn't take
+	for column, value := range row {
+		if text, ok := value.(string); ok && strings.HasSuffix(column, "_at") {
+			if t, ok := parsePolicyRowTime(text); ok {
+				row[column] = t
+			}
+		}
+	}
+
+	key := kvKey(pr.Table, pk)
+	if exists, err := kvExists(tx, key); err != nil || exists {
+		return err
+	}
+	if err := kvPut(tx, key, row); err != nil {
+		return fmt.Errorf("failed to restore %s row: %w", pr.Table, err)
+	}
+	return nil
+}
@@ -0,0 +1,285 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// ManagementMethod handles a custom NIP-86 method. params are the raw
+// JSON-RPC params and the returned value becomes the response result.
+type ManagementMethod func(ctx context.Context, params []any) (any, error)
+
+// ManagementExtensions serves NIP-86 methods that go-nostr's nip86 package
+// doesn't know about (and therefore khatru refuses before reaching its
+// Generic handler). Every other request is passed through to the relay.
+type ManagementExtensions struct {
+	relay   *khatru.Relay
+	methods map[string]ManagementMethod
+
+	// Authorize decides whether the authenticated pubkey may call a custom method.
+	Authorize func(ctx context.Context, pubkey string, method string) (reject bool, msg string)
+}
+
+// NewManagementExtensions wraps the relay so custom methods can be registered.
+func NewManagementExtensions(relay *khatru.Relay) *ManagementExtensions {
+	return &ManagementExtensions{
+		relay:   relay,
+		methods: make(map[string]ManagementMethod),
+	}
+}
+
+// Register adds a custom method. Method names are lowercased like the
+// standard NIP-86 ones.
+func (me *ManagementExtensions) Register(name string, method ManagementMethod) {
+	me.methods[strings.ToLower(name)] = method
+}
+
+// ServeHTTP implements http.Handler.
+func (me *ManagementExtensions) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/nostr+json+rpc" || r.Method != http.MethodPost {
+		me.relay.ServeHTTP(w, r)
+		return
+	}
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeManagementResponse(w, nip86.Response{Error: "empty request"})
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(payload))
+
+	var req nip86.Request
+	if err := json.Unmarshal(payload, &req); err != nil {
+		me.relay.ServeHTTP(w, r)
+		return
+	}
+
+	if req.Method == "supportedmethods" {
+		me.serveSupportedMethods(w, r)
+		return
+	}
+
+	method, ok := me.methods[req.Method]
+	if !ok {
+		me.relay.ServeHTTP(w, r)
+		return
+	}
+
+	pubkey, err := me.validateAuth(r, payload)
+	if err != nil {
+		writeManagementResponse(w, nip86.Response{Error: err.Error()})
+		return
+	}
+
+	ctx := context.WithValue(r.Context(), managementCallerKey{}, pubkey)
+	if me.Authorize != nil {
+		if reject, msg := me.Authorize(ctx, pubkey, req.Method); reject {
+			writeManagementResponse(w, nip86.Response{Error: msg})
+			return
+		}
+	}
+
+	var resp nip86.Response
+	if result, err := method(ctx, req.Params); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Result = result
+	}
+	writeManagementResponse(w, resp)
+}
+
+type managementCallerKey struct{}
+
+// managementCaller returns the pubkey calling a custom method.
+func managementCaller(ctx context.Context) string {
+	pubkey, _ := ctx.Value(managementCallerKey{}).(string)
+	return pubkey
+}
+
+// serveSupportedMethods lets the relay answer and appends the custom methods.
+func (me *ManagementExtensions) serveSupportedMethods(w http.ResponseWriter, r *http.Request) {
+	rec := httptest.NewRecorder()
+	me.relay.ServeHTTP(rec, r)
+
+	var resp nip86.Response
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error != "" {
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+		return
+	}
+
+	methods, _ := resp.Result.([]any)
+	for name := range me.methods {
+		methods = append(methods, name)
+	}
+	resp.Result = methods
+	writeManagementResponse(w, resp)
+}
+
+// validateAuth checks the NIP-98 Authorization header the same way khatru
+// does for the built-in methods and returns the authenticated pubkey.
+func (me *ManagementExtensions) validateAuth(r *http.Request, payload []byte) (string, error) {
+	spl := strings.Split(r.Header.Get("Authorization"), "Nostr ")
+	if len(spl) != 2 {
+		return "", fmt.Errorf("missing auth")
+	}
+
+	evtj, err := base64.StdEncoding.DecodeString(spl[1])
+	if err != nil {
+		return "", fmt.Errorf("invalid base64 auth")
+	}
+	var evt nostr.Event
+	if err := json.Unmarshal(evtj, &evt); err != nil {
+		return "", fmt.Errorf("invalid auth event json")
+	}
+	if ok, _ := evt.CheckSignature(); !ok {
+		return "", fmt.Errorf("invalid auth event")
+	}
+
+	payloadHash := sha256.Sum256(payload)
+	baseURL := nostr.NormalizeURL(me.baseURL(r))
+	if uTag := evt.Tags.Find("u"); uTag == nil || baseURL != nostr.NormalizeURL(uTag[1]) {
+		return "", fmt.Errorf("invalid 'u' tag, expected '%s'", baseURL)
+	}
+	if evt.Tags.FindWithValue("payload", hex.EncodeToString(payloadHash[:])) == nil {
+		return "", fmt.Errorf("invalid auth event payload hash")
+	}
+	if evt.CreatedAt < nostr.Now()-30 {
+		return "", fmt.Errorf("auth event is too old")
+	}
+
+	return evt.PubKey, nil
+}
+
+// baseURL mirrors khatru's own guess of the relay URL.
+func (me *ManagementExtensions) baseURL(r *http.Request) string {
+	if me.relay.ServiceURL != "" {
+		return me.relay.ServiceURL
+	}
+
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	proto := r.Header.Get("X-Forwarded-Proto")
+	if proto == "" {
+		if host == "localhost" || strings.Contains(host, ":") || strings.Trim(host, "0123456789.") == "" {
+			proto = "http"
+		} else {
+			proto = "https"
+		}
+	}
+	return proto + "://" + host
+}
+
+func writeManagementResponse(w http.ResponseWriter, resp nip86.Response) {
+	w.Header().Set("Content-Type", "application/nostr+json+rpc")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// stringParam returns the i-th param as a string, or an error naming the method.
+func stringParam(method string, params []any, i int) (string, error) {
+	if len(params) <= i {
+		return "", fmt.Errorf("invalid number of params for '%s'", method)
+	}
+	s, ok := params[i].(string)
+	if !ok {
+		return "", fmt.Errorf("invalid param %d for '%s'", i, method)
+	}
+	return s, nil
+}
+
+// stringListParam returns the i-th param as a list of strings, or an error
+// naming the method.
+func stringListParam(method string, params []any, i int) ([]string, error) {
+	if len(params) <= i {
+		return nil, fmt.Errorf("invalid number of params for '%s'", method)
+	}
+	list, ok := params[i].([]any)
+	if !ok {
+		return nil, fmt.Errorf("invalid param %d for '%s'", i, method)
+	}
+	result := make([]string, len(list))
+	for j, item := range list {
+		if result[j], ok = item.(string); !ok {
+			return nil, fmt.Errorf("invalid param %d for '%s'", i, method)
+		}
+	}
+	return result, nil
+}
+
+// optionalStringParam returns the i-th param as a string, or "" when absent.
+func optionalStringParam(params []any, i int) string {
+	if len(params) <= i {
+		return ""
+	}
+	s, _ := params[i].(string)
+	return s
+}
+
+// CallManagementAPI posts a request to a relay's NIP-86 endpoint with a
+// NIP-98 Authorization header signed by signer. relayURL may be a ws, wss,
+// http or https url.
+func CallManagementAPI(ctx context.Context, signer nostr.Signer, relayURL string, req nip86.Request) (nip86.Response, error) {
+	var resp nip86.Response
+
+	url := nostr.NormalizeURL(relayURL)
+	url = "http" + strings.TrimPrefix(url, "ws") // ws:// to http://, wss:// to https://
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	payloadHash := sha256.Sum256(body)
+
+	auth := nostr.Event{
+		Kind:      27235,
+		CreatedAt: nostr.Now(),
+		Tags: nostr.Tags{
+			{"u", url},
+			{"method", "POST"},
+			{"payload", hex.EncodeToString(payloadHash[:])},
+		},
+	}
+	if err := signer.SignEvent(ctx, &auth); err != nil {
+		return resp, fmt.Errorf("failed to sign auth event: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	httpReq.Header.Set("Content-Type", "application/nostr+json+rpc")
+	httpReq.Header.Set("Authorization", "Nostr "+base64.StdEncoding.EncodeToString([]byte(auth.String())))
+
+	httpResp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return resp, fmt.Errorf("failed to call %s: %w", url, err)
+	}
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return resp, err
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return resp, fmt.Errorf("unexpected response (%s): %s", httpResp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Metrics serves a few gauges and counters in the Prometheus text format.
+type Metrics struct {
+	db       *sql.DB
+	drain    *Drain
+	policies *PolicySet
+	started  time.Time
+
+	eventsSaved atomic.Int64
+}
+
+// NewMetrics creates the metrics handler.
+func NewMetrics(db *sql.DB, drain *Drain, policies *PolicySet) *Metrics {
+	return &Metrics{db: db, drain: drain, policies: policies, started: time.Now()}
+}
+
+// OnEventSaved counts stored events.
+func (m *Metrics) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	m.eventsSaved.Add(1)
+}
+
+// ServeHTTP implements http.Handler.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	type metric struct {
+		name, kind, help string
+		value            any
+	}
+	metrics := []metric{
+		{"okay_uptime_seconds", "gauge", "Seconds since the relay started.", int64(time.Since(m.started).Seconds())},
+		{"okay_connections", "gauge", "Open websocket connections.", m.drain.Connections()},
+		{"okay_subscriptions", "gauge", "Open subscriptions.", m.drain.Subscriptions()},
+		{"okay_events_saved_total", "counter", "Events stored since the relay started.", m.eventsSaved.Load()},
+	}
+	// only Postgres has a shared pool
+	if m.db != nil {
+		dbStats := m.db.Stats()
+		metrics = append(metrics,
+			metric{"okay_db_open_connections", "gauge", "Open connections in the shared database pool.", dbStats.OpenConnections},
+			metric{"okay_db_in_use_connections", "gauge", "Connections of the shared pool in use.", dbStats.InUse},
+			metric{"okay_db_wait_count_total", "counter", "Times a query waited for a pool connection.", dbStats.WaitCount},
+		)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, metric := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", metric.name, metric.help, metric.name, metric.kind, metric.name, metric.value)
+	}
+
+	// one series per policy, in a stable order
+	rejections := m.policies.Rejections()
+	fmt.Fprint(w, "# HELP okay_policy_rejections_total Requests rejected by each policy.\n# TYPE okay_policy_rejections_total counter\n")
+	for _, stage := range slices.Sorted(maps.Keys(rejections)) {
+		for _, name := range slices.Sorted(maps.Keys(rejections[stage])) {
+			fmt.Fprintf(w, "okay_policy_rejections_total{stage=%q,policy=%q} %d\n", stage, name, rejections[stage][name])
+		}
+	}
+}
@@ -0,0 +1,449 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// mirrorAuthorsPerFilter keeps filters under the author limits most relays enforce.
+const mirrorAuthorsPerFilter = 500
+
+// Mirror pulls events by a set of pubkeys from upstream relays: first a
+// historical backfill walking backwards in time, then a live subscription.
+// Every mirrored event goes through relay.AddEvent, so it meets the same
+// RejectEvent policies as events published to us directly.
+type Mirror struct {
+	dbm   ManagementStore
+	relay *khatru.Relay
+
+	// Pubkeys returns the authors to mirror.
+	Pubkeys func() ([]string, error)
+
+	BatchSize       int
+	MaxBackoff      time.Duration
+	RefreshInterval time.Duration
+
+	mu      sync.Mutex
+	ctx     context.Context
+	workers map[string]*mirrorWorker
+	running sync.WaitGroup
+}
+
+type mirrorWorker struct {
+	cancel context.CancelFunc
+	// done is closed when the worker has stopped
+	done chan struct{}
+
+	mu        sync.Mutex
+	connected bool
+	lastError string
+	mirrored  int64
+	rejected  int64
+}
+
+// MirrorStatus describes an upstream and its worker for management calls.
+type MirrorStatus struct {
+	MirrorUpstream
+	Connected bool   `json:"connected"`
+	LastError string `json:"last_error,omitempty"`
+	Mirrored  int64  `json:"mirrored"`
+	Rejected  int64  `json:"rejected"`
+}
+
+// NewMirror creates a mirror with default batching and backoff settings.
+func NewMirror(dbm ManagementStore, relay *khatru.Relay, pubkeys func() ([]string, error)) *Mirror {
+	return &Mirror{
+		dbm:             dbm,
+		relay:           relay,
+		Pubkeys:         pubkeys,
+		BatchSize:       500,
+		MaxBackoff:      5 * time.Minute,
+		RefreshInterval: 5 * time.Minute,
+		workers:         make(map[string]*mirrorWorker),
+	}
+}
+
+// Start launches a worker for every upstream stored in the database. Workers
+// stop when ctx is canceled.
+func (m *Mirror) Start(ctx context.Context) error {
+	m.mu.Lock()
+	m.ctx = ctx
+	m.mu.Unlock()
+
+	upstreams, err := m.dbm.GetMirrorUpstreams()
+	if err != nil {
+		return fmt.Errorf("failed to load mirror upstreams: %w", err)
+	}
+	for _, upstream := range upstreams {
+		m.startWorker(upstream.URL)
+	}
+	return nil
+}
+
+// AddUpstream stores an upstream and starts mirroring from it.
+func (m *Mirror) AddUpstream(url string) error {
+	url = nostr.NormalizeURL(url)
+	if err := m.dbm.AddMirrorUpstream(url); err != nil {
+		return err
+	}
+	m.startWorker(url)
+	return nil
+}
+
+// RemoveUpstream stops mirroring from an upstream and forgets its cursors.
+func (m *Mirror) RemoveUpstream(url string) error {
+	url = nostr.NormalizeURL(url)
+	m.stopWorker(url)
+	return m.dbm.RemoveMirrorUpstream(url)
+}
+
+// Resync restarts an upstream with a fresh historical backfill, e.g. after
+// new pubkeys were allowed.
+func (m *Mirror) Resync(url string) error {
+	url = nostr.NormalizeURL(url)
+	m.stopWorker(url)
+	if err := m.dbm.ResetMirrorBackfill(url); err != nil {
+		return err
+	}
+	m.startWorker(url)
+	return nil
+}
+
+// Status reports the cursors and worker state of every upstream.
+func (m *Mirror) Status() ([]MirrorStatus, error) {
+	upstreams, err := m.dbm.GetMirrorUpstreams()
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]MirrorStatus, 0, len(upstreams))
+	for _, upstream := range upstreams {
+		status := MirrorStatus{MirrorUpstream: upstream}
+		if w, ok := m.workers[upstream.URL]; ok {
+			w.mu.Lock()
+			status.Connected = w.connected
+			status.LastError = w.lastError
+			status.Mirrored = w.mirrored
+			status.Rejected = w.rejected
+			w.mu.Unlock()
+		}
+		result = append(result, status)
+	}
+	return result, nil
+}
+
+func (m *Mirror) startWorker(url string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.ctx == nil {
+		return // not started yet, Start will pick it up
+	}
+	if _, running := m.workers[url]; running {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(m.ctx)
+	w := &mirrorWorker{cancel: cancel, done: make(chan struct{})}
+	m.workers[url] = w
+	m.running.Add(1)
+	go func() {
+		defer m.running.Done()
+		defer close(w.done)
+		m.run(ctx, url, w)
+	}()
+}
+
+// Wait blocks until every worker has stopped after the context given to
+// Start was canceled.
+func (m *Mirror) Wait() {
+	m.running.Wait()
+}
+
+// stopWorker stops the worker of an upstream and waits for it, so a new
+// one never writes the cursors at the same time.
+func (m *Mirror) stopWorker(url string) {
+	m.mu.Lock()
+	w, ok := m.workers[url]
+	if ok {
+		w.cancel()
+		delete(m.workers, url)
+	}
+	m.mu.Unlock()
+
+	if ok {
+		<-w.done
+	}
+}
+
+// run keeps a session with the upstream alive, reconnecting with
+// exponential backoff.
+func (m *Mirror) run(ctx context.Context, url string, w *mirrorWorker) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := m.session(ctx, url, w)
+		w.setConnected(false)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			w.setError(err)
+			log.Printf("Mirror %s: %v", url, err)
+		}
+
+		// a session that lasted a while means the upstream is healthy again
+		if time.Since(started) > m.MaxBackoff {
+			backoff = time.Second
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(backoff*2, m.MaxBackoff)
+	}
+}
+
+// session does one connection's worth of work: the backfill if it isn't
+// done yet, then live mirroring until the connection drops or the pubkey
+// set changes.
+func (m *Mirror) session(ctx context.Context, url string, w *mirrorWorker) error {
+	pubkeys, err := m.Pubkeys()
+	if err != nil {
+		return fmt.Errorf("failed to load pubkeys: %w", err)
+	}
+	if len(pubkeys) == 0 {
+		// nothing to mirror yet, check again later
+		select {
+		case <-time.After(m.RefreshInterval):
+		case <-ctx.Done():
+		}
+		return nil
+	}
+
+	upstream, err := m.dbm.GetMirrorUpstream(url)
+	if err != nil {
+		return fmt.Errorf("failed to load cursors: %w", err)
+	}
+	if upstream == nil {
+		return fmt.Errorf("upstream was removed")
+	}
+
+	conn, err := nostr.RelayConnect(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	w.setConnected(true)
+
+	if upstream.LastSeen == 0 {
+		// live mirroring picks up from where the backfill starts
+		upstream.LastSeen = int64(nostr.Now())
+		if err := m.dbm.SetMirrorLastSeen(url, upstream.LastSeen); err != nil {
+			return err
+		}
+	}
+
+	if !upstream.BackfillDone {
+		if err := m.backfill(ctx, conn, w, upstream, pubkeys); err != nil {
+			return fmt.Errorf("backfill failed: %w", err)
+		}
+	}
+
+	return m.live(ctx, conn, w, upstream, pubkeys)
+}
+
+func (m *Mirror) backfill(ctx context.Context, conn *nostr.Relay, w *mirrorWorker, upstream *MirrorUpstream, pubkeys []string) error {
+	until := nostr.Timestamp(upstream.BackfillUntil)
+	if until == 0 {
+		until = nostr.Timestamp(upstream.LastSeen)
+	}
+
+	// upstreams may cap the limit below our batch size and cut a page in the
+	// middle of a second, so each page starts at the newest "oldest event"
+	// of the filters again, and the events already seen down to it are
+	// skipped, as in WalkEvents
+	seen := make(map[string]nostr.Timestamp)
+	for ctx.Err() == nil {
+		next := nostr.Timestamp(0)
+		returned, fresh := false, false
+		for _, filter := range mirrorFilters(pubkeys) {
+			filter.Until = &until
+			filter.Limit = m.BatchSize
+
+			queryCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+			events, err := conn.QuerySync(queryCtx, filter)
+			cancel()
+			if err != nil {
+				return err
+			}
+
+			oldest := until
+			for _, event := range events {
+				oldest = min(oldest, event.CreatedAt)
+				if _, ok := seen[event.ID]; ok {
+					continue
+				}
+				seen[event.ID] = event.CreatedAt
+				fresh = true
+				m.ingest(ctx, w, pubkeys, event)
+			}
+			if len(events) > 0 {
+				returned = true
+				next = max(next, oldest)
+			}
+		}
+
+		if !returned {
+			return m.dbm.SetMirrorBackfillCursor(upstream.URL, int64(until), true)
+		}
+
+		// a page of nothing new moves on below its boundary second, which
+		// only a second with more events than a page can fill
+		until = next
+		if !fresh {
+			until = next - 1
+		}
+		for id, createdAt := range seen {
+			if createdAt > until {
+				delete(seen, id)
+			}
+		}
+		if err := m.dbm.SetMirrorBackfillCursor(upstream.URL, int64(until), false); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (m *Mirror) live(ctx context.Context, conn *nostr.Relay, w *mirrorWorker, upstream *MirrorUpstream, pubkeys []string) error {
+	since := nostr.Timestamp(upstream.LastSeen)
+	filters := mirrorFilters(pubkeys)
+	for i := range filters {
+		filters[i].Since = &since
+	}
+
+	sub, err := conn.Subscribe(ctx, filters)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe: %w", err)
+	}
+	defer sub.Unsub()
+
+	refresh := time.NewTicker(m.RefreshInterval)
+	defer refresh.Stop()
+	persist := time.NewTicker(10 * time.Second)
+	defer persist.Stop()
+
+	lastSeen := upstream.LastSeen
+	saved := lastSeen
+	defer func() {
+		if lastSeen > saved {
+			m.dbm.SetMirrorLastSeen(upstream.URL, lastSeen)
+		}
+	}()
+
+	for {
+		select {
+		case event, ok := <-sub.Events:
+			if !ok {
+				return fmt.Errorf("subscription ended")
+			}
+			m.ingest(ctx, w, pubkeys, event)
+			lastSeen = max(lastSeen, int64(event.CreatedAt))
+		case reason := <-sub.ClosedReason:
+			return fmt.Errorf("subscription closed: %s", reason)
+		case <-conn.Context().Done():
+			return fmt.Errorf("connection lost")
+		case <-ctx.Done():
+			return nil
+		case <-persist.C:
+			if lastSeen > saved {
+				if err := m.dbm.SetMirrorLastSeen(upstream.URL, lastSeen); err != nil {
+					return err
+				}
+				saved = lastSeen
+			}
+		case <-refresh.C:
+			current, err := m.Pubkeys()
+			if err == nil && !sameStrings(current, pubkeys) {
+				return nil // reconnect with the new set
+			}
+		}
+	}
+}
+
+// ingest verifies an upstream event and adds it through the relay's pipeline.
+func (m *Mirror) ingest(ctx context.Context, w *mirrorWorker, pubkeys []string, event *nostr.Event) {
+	if !slices.Contains(pubkeys, event.PubKey) || !event.CheckID() {
+		w.countRejected()
+		return
+	}
+	if ok, _ := event.CheckSignature(); !ok {
+		w.countRejected()
+		return
+	}
+
+	skipBroadcast, err := m.relay.AddEvent(ctx, event)
+	if err != nil {
+		w.countRejected()
+		return
+	}
+	w.countMirrored()
+	if !skipBroadcast {
+		m.relay.BroadcastEvent(event)
+	}
+}
+
+// mirrorFilters splits the authors over as many filters as needed.
+func mirrorFilters(pubkeys []string) nostr.Filters {
+	filters := make(nostr.Filters, 0, len(pubkeys)/mirrorAuthorsPerFilter+1)
+	for chunk := range slices.Chunk(pubkeys, mirrorAuthorsPerFilter) {
+		filters = append(filters, nostr.Filter{Authors: chunk})
+	}
+	return filters
+}
+
+func sameStrings(a, b []string) bool {
+	a = slices.Sorted(slices.Values(a))
+	b = slices.Sorted(slices.Values(b))
+	return slices.Equal(a, b)
+}
+
+func (w *mirrorWorker) setConnected(connected bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.connected = connected
+	if connected {
+		w.lastError = ""
+	}
+}
+
+func (w *mirrorWorker) setError(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.lastError = err.Error()
+}
+
+func (w *mirrorWorker) countMirrored() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.mirrored++
+}
+
+func (w *mirrorWorker) countRejected() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rejected++
+}
@@ -0,0 +1,161 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Negentropy backs khatru's NIP-77 support with a query that only reads
+// (created_at, id) from the event table, and guards it with limits on how
+// many sessions a connection may open and how many events a session covers.
+// khatru runs RejectFilter before every NEG-OPEN, so the relay's read access
+// rules apply here exactly as they do for REQs.
+type Negentropy struct {
+	db *sql.DB
+
+	// MaxRecords is the largest set a single session may reconcile.
+	MaxRecords int
+	// MaxSessions is how many sessions a connection may open per SessionWindow.
+	MaxSessions   int
+	SessionWindow time.Duration
+
+	mu       sync.Mutex
+	sessions map[*khatru.WebSocket][]time.Time
+}
+
+// NewNegentropy creates the negentropy helper.
+func NewNegentropy(db *sql.DB, maxRecords, maxSessions int, sessionWindow time.Duration) *Negentropy {
+	return &Negentropy{
+		db:            db,
+		MaxRecords:    maxRecords,
+		MaxSessions:   maxSessions,
+		SessionWindow: sessionWindow,
+		sessions:      make(map[*khatru.WebSocket][]time.Time),
+	}
+}
+
+// RejectFilter enforces the session and size limits on NEG-OPEN. It does
+// nothing for normal REQs.
+func (n *Negentropy) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	if !eventstore.IsNegentropySession(ctx) {
+		return false, ""
+	}
+
+	if conn := khatru.GetConnection(ctx); conn != nil && !n.allowSession(conn) {
+		return true, "rate-limited: too many negentropy sessions, slow down"
+	}
+
+	// without Postgres the sessions are answered by the eventstore, whose
+	// own result limit bounds them
+	if n.db == nil {
+		return false, ""
+	}
+
+	var params sqlParams
+	conditions, ok := filterConditions(filter, &params)
+	if !ok {
+		return false, ""
+	}
+	query := `SELECT COUNT(*) FROM (SELECT 1 FROM event WHERE ` + strings.Join(conditions, " AND ") +
+		` LIMIT ` + params.add(n.MaxRecords+1) + `) sub`
+
+	var count int
+	if err := n.db.QueryRowContext(ctx, query, params...).Scan(&count); err != nil {
+		log.Printf("Error sizing negentropy session: %v", err)
+		return true, "error: failed to prepare negentropy session"
+	}
+	if count > n.MaxRecords {
+		return true, fmt.Sprintf("blocked: filter matches more than %d events, split it up", n.MaxRecords)
+	}
+	return false, ""
+}
+
+// OnDisconnect forgets the sessions of a closed connection.
+func (n *Negentropy) OnDisconnect(ctx context.Context) {
+	if conn := khatru.GetConnection(ctx); conn != nil {
+		n.mu.Lock()
+		delete(n.sessions, conn)
+		n.mu.Unlock()
+	}
+}
+
+func (n *Negentropy) allowSession(conn *khatru.WebSocket) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	cutoff := time.Now().Add(-n.SessionWindow)
+	recent := n.sessions[conn][:0]
+	for _, opened := range n.sessions[conn] {
+		if opened.After(cutoff) {
+			recent = append(recent, opened)
+		}
+	}
+	if len(recent) >= n.MaxSessions {
+		n.sessions[conn] = recent
+		return false
+	}
+	n.sessions[conn] = append(recent, time.Now())
+	return true
+}
+
+// WrapQuery answers negentropy sessions from the (created_at, id) columns,
+// without the eventstore's usual result limit, and leaves REQs to the
+// wrapped query function. Only 'h' tags are loaded so that the groups
+// visibility filter still works on the results.
+func (n *Negentropy) WrapQuery(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if !eventstore.IsNegentropySession(ctx) {
+			return query(ctx, filter)
+		}
+		return n.queryIDs(ctx, filter)
+	}
+}
+
+func (n *Negentropy) queryIDs(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	ch := make(chan *nostr.Event)
+
+	var params sqlParams
+	conditions, ok := filterConditions(filter, &params)
+	if !ok {
+		close(ch)
+		return ch, nil
+	}
+	query := `SELECT id, created_at,
+			COALESCE((SELECT jsonb_agg(t) FROM jsonb_array_elements(tags) t WHERE t->>0 = 'h'), '[]'::jsonb)
+		FROM event WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY created_at, id LIMIT ` + params.add(n.MaxRecords)
+
+	rows, err := n.db.QueryContext(ctx, query, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query negentropy set: %w", err)
+	}
+
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+		for rows.Next() {
+			var evt nostr.Event
+			var timestamp int64
+			if err := rows.Scan(&evt.ID, &timestamp, &evt.Tags); err != nil {
+				log.Printf("Error scanning negentropy row: %v", err)
+				return
+			}
+			evt.CreatedAt = nostr.Timestamp(timestamp)
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
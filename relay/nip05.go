@@ -0,0 +1,203 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip05"
+)
+
+const (
+	// nip05NegativeTTL is how long failed and negative lookups are cached,
+	// so a fixed nostr.json is picked up soon.
+	nip05NegativeTTL = time.Minute
+	nip05CacheSize   = 10000
+)
+
+// NIP05Verifier resolves the nip05 field of an author's kind 0 profile
+// against /.well-known/nostr.json and caches the outcome per pubkey. Only
+// domains that AllowedDomain accepts are fetched, so a profile can't make
+// the relay send requests to any host it names.
+type NIP05Verifier struct {
+	// HTTPClient is used for the well-known lookups. Tests can point it at a
+	// local stub together with URLFor.
+	HTTPClient *http.Client
+
+	// URLFor builds the well-known URL for a domain and name.
+	URLFor func(domain, name string) string
+
+	// QueryProfile returns the latest kind 0 event for a pubkey, or nil.
+	QueryProfile func(ctx context.Context, pubkey string) (*nostr.Event, error)
+
+	// AllowedDomain tells whether identifiers on a domain are looked up.
+	AllowedDomain func(domain string) (bool, error)
+
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]nip05CacheEntry
+}
+
+type nip05CacheEntry struct {
+	identifier string
+	valid      bool
+	expires    time.Time
+}
+
+// NewNIP05Verifier creates a verifier with sane defaults for production use.
+func NewNIP05Verifier(ttl time.Duration, queryProfile func(ctx context.Context, pubkey string) (*nostr.Event, error), allowedDomain func(domain string) (bool, error)) *NIP05Verifier {
+	return &NIP05Verifier{
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Second,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		URLFor: func(domain, name string) string {
+			return fmt.Sprintf("https://%s/.well-known/nostr.json?name=%s", domain, url.QueryEscape(name))
+		},
+		QueryProfile:  queryProfile,
+		AllowedDomain: allowedDomain,
+		TTL:           ttl,
+		cache:         make(map[string]nip05CacheEntry),
+	}
+}
+
+// VerifiedDomain returns the domain of the author's NIP-05 identifier if it
+// is allowed and resolves back to their pubkey, or "" otherwise. When event
+// is itself a kind 0 its content is used, so a first profile publish can be
+// accepted.
+func (v *NIP05Verifier) VerifiedDomain(ctx context.Context, event *nostr.Event) (string, error) {
+	identifier, err := v.identifierFor(ctx, event)
+	if err != nil || identifier == "" {
+		return "", err
+	}
+
+	name, domain, err := nip05.ParseIdentifier(identifier)
+	if err != nil {
+		return "", nil
+	}
+	if v.AllowedDomain != nil {
+		allowed, err := v.AllowedDomain(domain)
+		if err != nil || !allowed {
+			return "", err
+		}
+	}
+
+	if entry, ok := v.cached(event.PubKey); ok && entry.identifier == identifier {
+		if entry.valid {
+			return domain, nil
+		}
+		return "", nil
+	}
+
+	valid, err := v.lookup(ctx, name, domain, event.PubKey)
+	ttl := v.TTL
+	if !valid {
+		ttl = min(ttl, nip05NegativeTTL)
+	}
+	v.store(event.PubKey, nip05CacheEntry{identifier: identifier, valid: valid, expires: time.Now().Add(ttl)})
+
+	if valid {
+		return domain, nil
+	}
+	return "", err
+}
+
+// Forget drops the cached result for a pubkey.
+func (v *NIP05Verifier) Forget(pubkey string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	delete(v.cache, pubkey)
+}
+
+func (v *NIP05Verifier) identifierFor(ctx context.Context, event *nostr.Event) (string, error) {
+	profile := event
+	if event.Kind != nostr.KindProfileMetadata {
+		if v.QueryProfile == nil {
+			return "", nil
+		}
+		var err error
+		profile, err = v.QueryProfile(ctx, event.PubKey)
+		if err != nil {
+			return "", fmt.Errorf("failed to query profile for %s: %w", event.PubKey, err)
+		}
+		if profile == nil {
+			return "", nil
+		}
+	}
+
+	var metadata struct {
+		NIP05 string `json:"nip05"`
+	}
+	if err := json.Unmarshal([]byte(profile.Content), &metadata); err != nil {
+		return "", nil
+	}
+	return strings.ToLower(strings.TrimSpace(metadata.NIP05)), nil
+}
+
+func (v *NIP05Verifier) lookup(ctx context.Context, name, domain, pubkey string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.URLFor(domain, name), nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create nip05 request: %w", err)
+	}
+
+	res, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("nip05 request to %s failed: %w", domain, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, nil
+	}
+
+	var wellKnown nip05.WellKnownResponse
+	if err := json.NewDecoder(res.Body).Decode(&wellKnown); err != nil {
+		return false, nil
+	}
+	return wellKnown.Names[name] == pubkey, nil
+}
+
+func (v *NIP05Verifier) cached(pubkey string) (nip05CacheEntry, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	entry, ok := v.cache[pubkey]
+	if !ok || time.Now().After(entry.expires) {
+		return nip05CacheEntry{}, false
+	}
+	return entry, true
+}
+
+func (v *NIP05Verifier) store(pubkey string, entry nip05CacheEntry) {
+	if v.TTL <= 0 {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if len(v.cache) >= nip05CacheSize {
+		now := time.Now()
+		for k, cached := range v.cache {
+			if now.After(cached.expires) {
+				delete(v.cache, k)
+			}
+		}
+		// still full: make room by dropping an arbitrary entry
+		for k := range v.cache {
+			if len(v.cache) < nip05CacheSize {
+				break
+			}
+			delete(v.cache, k)
+		}
+	}
+	v.cache[pubkey] = entry
+}
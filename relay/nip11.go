@@ -0,0 +1,38 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+)
+
+// withNIP11Self adds the relay's own pubkey as the "self" field of the NIP-11
+// document, which go-nostr's nip11 type doesn't model yet.
+func withNIP11Self(next http.Handler, self string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != "application/nostr+json" || r.Header.Get("Upgrade") == "websocket" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rec := httptest.NewRecorder()
+		next.ServeHTTP(rec, r)
+
+		var info map[string]any
+		if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &info) != nil {
+			for k, v := range rec.Header() {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes())
+			return
+		}
+		info["self"] = self
+
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.Header().Del("Content-Length")
+		json.NewEncoder(w).Encode(info)
+	})
+}
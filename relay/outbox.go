@@ -0,0 +1,120 @@
+package relay
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Outbox forwards events published to us by trusted authors to a set of
+// downstream relays. Deliveries are queued in outbox_deliveries, one row per
+// event and destination, so they survive restarts; failed ones are retried
+// with exponential backoff and dead-lettered after MaxAttempts.
+type Outbox struct {
+	dbm    ManagementStore
+	events eventstore.Store
+	relays []string
+	pool   *nostr.SimplePool
+
+	// Eligible decides which saved events are forwarded.
+	Eligible func(event *nostr.Event) bool
+
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	PollInterval time.Duration
+	// Retention is how long delivered entries are kept around.
+	Retention time.Duration
+
+	wake chan struct{}
+}
+
+// NewOutbox creates an outbox delivering to the given relays the events
+// saved in events.
+func NewOutbox(dbm ManagementStore, events eventstore.Store, relays []string, eligible func(event *nostr.Event) bool) *Outbox {
+	normalized := make([]string, len(relays))
+	for i, url := range relays {
+		normalized[i] = nostr.NormalizeURL(url)
+	}
+	return &Outbox{
+		dbm:          dbm,
+		events:       events,
+		relays:       normalized,
+		Eligible:     eligible,
+		MaxAttempts:  10,
+		BaseBackoff:  10 * time.Second,
+		MaxBackoff:   6 * time.Hour,
+		PollInterval: 5 * time.Second,
+		Retention:    24 * time.Hour,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// OnEventSaved queues events that were published over a connection (not
+// mirrored or generated by the relay itself) by an eligible author.
+func (o *Outbox) OnEventSaved(ctx context.Context, event *nostr.Event) {
+	if khatru.GetConnection(ctx) == nil || !o.Eligible(event) {
+		return
+	}
+	// khatru calls this for replaceable events older than the stored one
+	// too, which aren't saved and mustn't replace the newer one downstream
+	if !nostr.IsRegularKind(event.Kind) && !o.stored(ctx, event) {
+		return
+	}
+	if err := o.dbm.EnqueueOutboxEvent(event, o.relays); err != nil {
+		log.Printf("Error queueing event %s for the outbox: %v", event.ID, err)
+		return
+	}
+	o.queue().signal()
+}
+
+// stored tells whether event is in the eventstore.
+func (o *Outbox) stored(ctx context.Context, event *nostr.Event) bool {
+	ch, err := o.events.QueryEvents(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		log.Printf("Error looking up %s for the outbox: %v", event.ID, err)
+		return false
+	}
+	found := false
+	for range ch {
+		found = true
+	}
+	return found
+}
+
+// Run delivers queued events until ctx is canceled.
+func (o *Outbox) Run(ctx context.Context) {
+	o.pool = nostr.NewSimplePool(ctx)
+	o.queue().run(ctx)
+}
+
+// queue is the outbox's delivery loop over outbox_deliveries.
+func (o *Outbox) queue() *deliveryQueue[OutboxDelivery] {
+	return &deliveryQueue[OutboxDelivery]{
+		name:      "outbox delivery",
+		claim:     o.dbm.ClaimOutboxDeliveries,
+		send:      o.publish,
+		delivered: o.dbm.MarkOutboxDelivered,
+		failed:    o.dbm.MarkOutboxFailed,
+		prune:     func() error { return o.dbm.PruneOutboxDelivered(o.Retention) },
+		retries: func() (int, time.Duration, time.Duration) {
+			return o.MaxAttempts, o.BaseBackoff, o.MaxBackoff
+		},
+		pollInterval: o.PollInterval,
+		wake:         o.wake,
+	}
+}
+
+func (o *Outbox) publish(ctx context.Context, d OutboxDelivery) error {
+	conn, err := o.pool.EnsureRelay(d.RelayURL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, 15*time.Second)
+	defer cancel()
+	return conn.Publish(ctx, *d.Event)
+}
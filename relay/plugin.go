@@ -0,0 +1,393 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// What a plugin can answer, as in strfry's write policy plugins.
+const (
+	PluginAccept       = "accept"
+	PluginReject       = "reject"
+	PluginShadowReject = "shadowReject"
+)
+
+const (
+	defaultPluginTimeout      = 2 * time.Second
+	defaultPluginConcurrency  = 8
+	defaultPluginRestartDelay = time.Second
+	// pluginStopTimeout is how long a plugin has to exit after its stdin is
+	// closed before it's killed.
+	pluginStopTimeout = 5 * time.Second
+	maxPluginLine     = 1024 * 1024
+)
+
+// PluginParams configure the plugin policy.
+type PluginParams struct {
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+	// Timeout is how long an event waits for the plugin's answer, after
+	// which Fallback decides: accept or reject.
+	Timeout  time.Duration `yaml:"timeout"`
+	Fallback string        `yaml:"fallback"`
+	// Concurrency is how many events may wait for an answer at once.
+	Concurrency int `yaml:"concurrency"`
+	// RestartDelay is the least time between starts of the plugin after it
+	// exited.
+	RestartDelay time.Duration `yaml:"restart_delay"`
+}
+
+// pluginRequest is a line written to the plugin.
+type pluginRequest struct {
+	Type       string       `json:"type"`
+	Event      *nostr.Event `json:"event"`
+	ReceivedAt int64        `json:"receivedAt"`
+	SourceType string       `json:"sourceType"`
+	SourceInfo string       `json:"sourceInfo"`
+	// Authed is the pubkey the connection authenticated as, if any.
+	Authed string `json:"authed,omitempty"`
+}
+
+// PluginResponse is a line the plugin answers with.
+type PluginResponse struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Msg    string `json:"msg"`
+}
+
+// Plugin runs an external write policy program that speaks strfry's plugin
+// protocol: an event per line on its stdin, a decision per line on its
+// stdout, matched by event id. Its stderr goes to the log. When it exits it
+// is started again on the next event, at most once per RestartDelay; while
+// it's down the fallback decides.
+type Plugin struct {
+	params PluginParams
+	slots  chan struct{}
+
+	mu      sync.Mutex
+	proc    *pluginProcess
+	started time.Time
+	closed  bool
+}
+
+// pluginProcess is a running plugin and the events waiting for its answer.
+type pluginProcess struct {
+	cmd     *exec.Cmd
+	writeMu sync.Mutex
+	stdin   io.WriteCloser
+	done    chan struct{}
+
+	mu      sync.Mutex
+	pending map[string][]chan PluginResponse
+}
+
+// NewPlugin starts the plugin.
+func NewPlugin(p PluginParams) (*Plugin, error) {
+	if p.Command == "" {
+		return nil, fmt.Errorf("command is required")
+	}
+	switch p.Fallback {
+	case "":
+		p.Fallback = PluginReject
+	case PluginAccept, PluginReject:
+	default:
+		return nil, fmt.Errorf("invalid fallback %q, must be accept or reject", p.Fallback)
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultPluginTimeout
+	}
+	if p.Concurrency <= 0 {
+		p.Concurrency = defaultPluginConcurrency
+	}
+	if p.RestartDelay <= 0 {
+		p.RestartDelay = defaultPluginRestartDelay
+	}
+
+	pl := &Plugin{params: p, slots: make(chan struct{}, p.Concurrency)}
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	if err := pl.start(); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+func (pl *Plugin) start() error {
+	pl.started = time.Now()
+	cmd := exec.Command(pl.params.Command, pl.params.Args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("starting plugin: %w", err)
+	}
+
+	proc := &pluginProcess{
+		cmd:     cmd,
+		stdin:   stdin,
+		done:    make(chan struct{}),
+		pending: make(map[string][]chan PluginResponse),
+	}
+	pl.proc = proc
+
+	var logging sync.WaitGroup
+	logging.Add(1)
+	go func() {
+		defer logging.Done()
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			log.Printf("plugin %s: %s", pl.params.Command, scanner.Text())
+		}
+	}()
+	go func() {
+		proc.read(stdout)
+		logging.Wait()
+		err := cmd.Wait()
+		proc.mu.Lock()
+		close(proc.done)
+		proc.pending = nil
+		proc.mu.Unlock()
+
+		pl.mu.Lock()
+		defer pl.mu.Unlock()
+		if !pl.closed {
+			if err == nil {
+				err = errors.New("exited")
+			}
+			log.Printf("Error running plugin %s: %v", pl.params.Command, err)
+		}
+		if pl.proc == proc {
+			pl.proc = nil
+		}
+	}()
+	return nil
+}
+
+// read hands the plugin's answers to the events waiting for them.
+func (proc *pluginProcess) read(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(nil, maxPluginLine)
+	for scanner.Scan() {
+		var resp PluginResponse
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			log.Printf("Error decoding plugin output %q: %v", scanner.Text(), err)
+			continue
+		}
+		proc.mu.Lock()
+		if waiting := proc.pending[resp.ID]; len(waiting) > 0 {
+			waiting[0] <- resp
+			if len(waiting) == 1 {
+				delete(proc.pending, resp.ID)
+			} else {
+				proc.pending[resp.ID] = waiting[1:]
+			}
+		}
+		proc.mu.Unlock()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading plugin output: %v", err)
+	}
+}
+
+// process returns the running plugin, starting it again if it exited and
+// the restart delay has passed.
+func (pl *Plugin) process() (*pluginProcess, error) {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+	switch {
+	case pl.closed:
+		return nil, errors.New("plugin closed")
+	case pl.proc != nil:
+		return pl.proc, nil
+	case time.Since(pl.started) < pl.params.RestartDelay:
+		return nil, errors.New("plugin not running")
+	}
+	if err := pl.start(); err != nil {
+		return nil, err
+	}
+	log.Printf("plugin %s restarted", pl.params.Command)
+	return pl.proc, nil
+}
+
+// Check asks the plugin about event. When the plugin doesn't answer in
+// time, or isn't running, the fallback decides and the error says why. A
+// plugin that doesn't read the event in time is killed.
+func (pl *Plugin) Check(ctx context.Context, event *nostr.Event) (PluginResponse, error) {
+	fallback := PluginResponse{ID: event.ID, Action: pl.params.Fallback}
+	if fallback.Action == PluginReject {
+		fallback.Msg = "error: write policy unavailable"
+	}
+
+	timer := time.NewTimer(pl.params.Timeout)
+	defer timer.Stop()
+	select {
+	case pl.slots <- struct{}{}:
+		defer func() { <-pl.slots }()
+	case <-timer.C:
+		return fallback, errors.New("too many events waiting for the plugin")
+	case <-ctx.Done():
+		return fallback, ctx.Err()
+	}
+
+	proc, err := pl.process()
+	if err != nil {
+		return fallback, err
+	}
+	answer := make(chan PluginResponse, 1)
+	proc.mu.Lock()
+	if proc.pending == nil {
+		proc.mu.Unlock()
+		return fallback, errors.New("plugin not running")
+	}
+	proc.pending[event.ID] = append(proc.pending[event.ID], answer)
+	proc.mu.Unlock()
+
+	line, err := json.Marshal(pluginRequest{
+		Type:       "new",
+		Event:      event,
+		ReceivedAt: time.Now().Unix(),
+		SourceType: sourceType(khatru.GetIP(ctx)),
+		SourceInfo: khatru.GetIP(ctx),
+		Authed:     khatru.GetAuthed(ctx),
+	})
+	if err != nil {
+		proc.forget(event.ID, answer)
+		return fallback, err
+	}
+	// a plugin that stops reading its input blocks the write once the pipe
+	// is full, so the write is covered by the timeout too
+	written := make(chan error, 1)
+	go func() {
+		proc.writeMu.Lock()
+		defer proc.writeMu.Unlock()
+		_, err := proc.stdin.Write(append(line, '\n'))
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		if err != nil {
+			proc.forget(event.ID, answer)
+			return fallback, fmt.Errorf("writing to plugin: %w", err)
+		}
+	case <-proc.done:
+		return fallback, errors.New("plugin exited")
+	case <-timer.C:
+		proc.forget(event.ID, answer)
+		// it's started again on the next event
+		proc.cmd.Process.Kill()
+		return fallback, errors.New("plugin stopped reading its input, killed")
+	case <-ctx.Done():
+		proc.forget(event.ID, answer)
+		return fallback, ctx.Err()
+	}
+
+	select {
+	case resp := <-answer:
+		return resp, nil
+	case <-proc.done:
+		return fallback, errors.New("plugin exited")
+	case <-timer.C:
+		proc.forget(event.ID, answer)
+		return fallback, errors.New("plugin timed out")
+	case <-ctx.Done():
+		proc.forget(event.ID, answer)
+		return fallback, ctx.Err()
+	}
+}
+
+// forget stops waiting for an answer about id.
+func (proc *pluginProcess) forget(id string, answer chan PluginResponse) {
+	proc.mu.Lock()
+	defer proc.mu.Unlock()
+	waiting := proc.pending[id]
+	for i, ch := range waiting {
+		if ch == answer {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(proc.pending, id)
+	} else {
+		proc.pending[id] = waiting
+	}
+}
+
+// Close stops the plugin: its stdin is closed, and it's killed if it
+// doesn't exit soon after.
+func (pl *Plugin) Close() {
+	pl.mu.Lock()
+	pl.closed = true
+	proc := pl.proc
+	pl.mu.Unlock()
+	if proc == nil {
+		return
+	}
+	proc.stdin.Close()
+	select {
+	case <-proc.done:
+	case <-time.After(pluginStopTimeout):
+		proc.cmd.Process.Kill()
+	}
+}
+
+// sourceType is strfry's name for where an event came from.
+func sourceType(ip string) string {
+	addr := net.ParseIP(ip)
+	switch {
+	case addr == nil:
+		return "Import"
+	case addr.To4() != nil:
+		return "IP4"
+	}
+	return "IP6"
+}
+
+func init() {
+	RegisterPolicy("plugin", func(app *App, p PluginParams) (Policy, error) {
+		pl, err := NewPlugin(p)
+		if err != nil {
+			return Policy{}, err
+		}
+		return Policy{
+			Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+				resp, err := pl.Check(ctx, event)
+				if err != nil {
+					log.Printf("Error checking event %s with plugin: %v", event.ID, err)
+				}
+				switch resp.Action {
+				case PluginAccept:
+					return false, ""
+				case PluginShadowReject:
+					return app.ShadowReject(event)
+				case PluginReject:
+					return true, resp.Msg
+				}
+				log.Printf("Error checking event %s with plugin: unknown action %q", event.ID, resp.Action)
+				return true, "error: write policy failed"
+			},
+			Close: pl.Close,
+		}, nil
+	})
+}
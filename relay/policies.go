@@ -0,0 +1,416 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/fiatjaf/khatru/policies"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip13"
+	"gopkg.in/yaml.v3"
+)
+
+// Policy stages, the places in handling a request where a policy chain runs.
+const (
+	// StageConnection runs before a websocket is upgraded.
+	StageConnection = "connection"
+	// StageEvent runs on every event before it's stored.
+	StageEvent = "event"
+	// StageFilter runs on every REQ and COUNT filter.
+	StageFilter = "filter"
+	// StageAPICall runs on every NIP-86 call, after the caller is authorized.
+	StageAPICall = "api"
+)
+
+var policyStages = []string{StageConnection, StageEvent, StageFilter, StageAPICall}
+
+// Policy is a configured policy. It has a hook for each stage it can run in.
+type Policy struct {
+	Connection func(r *http.Request) (reject bool, msg string)
+	Event      func(ctx context.Context, event *nostr.Event) (reject bool, msg string)
+	Filter     func(ctx context.Context, filter nostr.Filter) (reject bool, msg string)
+	APICall    func(ctx context.Context, pubkey, method string) (reject bool, msg string)
+
+	// Close, when set, releases what the policy holds once it's no longer
+	// configured or the relay shuts down.
+	Close func()
+}
+
+// runsIn tells whether the policy has a hook for stage.
+func (p Policy) runsIn(stage string) bool {
+	switch stage {
+	case StageConnection:
+		return p.Connection != nil
+	case StageEvent:
+		return p.Event != nil
+	case StageFilter:
+		return p.Filter != nil
+	case StageAPICall:
+		return p.APICall != nil
+	}
+	return false
+}
+
+// ShadowReject makes the relay answer OK to event without storing or
+// broadcasting it. Event policies call it and let the event through.
+// Ephemeral events are never stored, so those it tells to reject instead.
+func (app *App) ShadowReject(event *nostr.Event) (reject bool, msg string) {
+	if nostr.IsEphemeralKind(event.Kind) {
+		return true, "blocked: not accepted"
+	}
+	app.shadowed.add(event.ID)
+	return false, ""
+}
+
+// shadowRejects are the ids of the events to drop when they get to be
+// stored. Events rejected further down the pipeline never get there, so
+// ids are forgotten after a while.
+type shadowRejects struct {
+	mu        sync.Mutex
+	ids       map[string]time.Time
+	lastPrune time.Time
+}
+
+func (sr *shadowRejects) add(id string) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	now := time.Now()
+	if sr.ids == nil {
+		sr.ids = make(map[string]time.Time)
+	}
+	if now.Sub(sr.lastPrune) > time.Minute {
+		for id, added := range sr.ids {
+			if now.Sub(added) > time.Minute {
+				delete(sr.ids, id)
+			}
+		}
+		sr.lastPrune = now
+	}
+	sr.ids[id] = now
+}
+
+// check is a StoreEvent hook. For a shadow rejected event it returns
+// ErrDupEvent, which has khatru answer OK and skip the broadcast.
+func (sr *shadowRejects) check(ctx context.Context, event *nostr.Event) error {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if _, ok := sr.ids[event.ID]; ok {
+		delete(sr.ids, event.ID)
+		return eventstore.ErrDupEvent
+	}
+	return nil
+}
+
+// registeredPolicy builds a policy from the params of its config entry.
+type registeredPolicy struct {
+	// check decodes the params without building anything
+	check func(params map[string]any) error
+	build func(app *App, params map[string]any) (Policy, error)
+}
+
+var (
+	policyRegistryMu sync.RWMutex
+	policyRegistry   = make(map[string]registeredPolicy)
+)
+
+// RegisterPolicy makes a policy available to the config under name. The
+// params of its config entries are decoded into a P, and unknown params are
+// an error. Programs embedding the relay can register their own policies
+// before calling New.
+func RegisterPolicy[P any](name string, build func(app *App, params P) (Policy, error)) {
+	policyRegistryMu.Lock()
+	defer policyRegistryMu.Unlock()
+	if _, ok := policyRegistry[name]; ok {
+		panic(fmt.Sprintf("policy %q registered twice", name))
+	}
+	policyRegistry[name] = registeredPolicy{
+		check: func(params map[string]any) error {
+			_, err := decodePolicyParams[P](params)
+			return err
+		},
+		build: func(app *App, params map[string]any) (Policy, error) {
+			p, err := decodePolicyParams[P](params)
+			if err != nil {
+				return Policy{}, err
+			}
+			return build(app, p)
+		},
+	}
+}
+
+// RegisteredPolicies returns the names of all registered policies.
+func RegisteredPolicies() []string {
+	policyRegistryMu.RLock()
+	defer policyRegistryMu.RUnlock()
+	names := make([]string, 0, len(policyRegistry))
+	for name := range policyRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPolicy(name string) (registeredPolicy, bool) {
+	policyRegistryMu.RLock()
+	defer policyRegistryMu.RUnlock()
+	p, ok := policyRegistry[name]
+	return p, ok
+}
+
+// decodePolicyParams goes through YAML so params get the same decoding
+// (durations, lists) whether they come from the config file or from Go.
+func decodePolicyParams[P any](params map[string]any) (P, error) {
+	var p P
+	if len(params) == 0 {
+		return p, nil
+	}
+	data, err := yaml.Marshal(params)
+	if err != nil {
+		return p, err
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&p); err != nil {
+		return p, fmt.Errorf("invalid params: %w", err)
+	}
+	return p, nil
+}
+
+// RateLimitParams configure the rate limiting policies: every key (an IP
+// or a pubkey) may do Burst requests at once, and gets Tokens more every
+// Interval.
+type RateLimitParams struct {
+	Tokens   int           `yaml:"tokens"`
+	Interval time.Duration `yaml:"interval"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (p RateLimitParams) limiter() (*rateLimiter, error) {
+	if p.Tokens <= 0 || p.Interval <= 0 {
+		return nil, fmt.Errorf("tokens and interval must be positive")
+	}
+	return newRateLimiter(p.Tokens, p.Interval, max(p.Burst, p.Tokens)), nil
+}
+
+// rateLimiter is a token bucket per key. Buckets are refilled when they're
+// used, so unlike khatru's limiters it has no goroutine that outlives it.
+type rateLimiter struct {
+	mu        sync.Mutex
+	rate      float64 // tokens per second
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(tokens int, interval time.Duration, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    float64(tokens) / interval.Seconds(),
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from key's bucket, if there is one left.
+func (rl *rateLimiter) allow(key string) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	// buckets that have filled up again are as good as new ones
+	if full := time.Duration(rl.burst / rl.rate * float64(time.Second)); now.Sub(rl.lastPrune) > full {
+		for k, b := range rl.buckets {
+			if now.Sub(b.last) > full {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastPrune = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// noParams is for policies without settings.
+type noParams struct{}
+
+// eventPolicy registers a khatru event policy that takes no params.
+func eventPolicy(name string, hook func(ctx context.Context, event *nostr.Event) (bool, string)) {
+	RegisterPolicy(name, func(app *App, _ noParams) (Policy, error) {
+		return Policy{Event: hook}, nil
+	})
+}
+
+// filterPolicy registers a khatru filter policy that takes no params.
+func filterPolicy(name string, hook func(ctx context.Context, filter nostr.Filter) (bool, string)) {
+	RegisterPolicy(name, func(app *App, _ noParams) (Policy, error) {
+		return Policy{Filter: hook}, nil
+	})
+}
+
+func init() {
+	eventPolicy("validate_kind", policies.ValidateKind)
+	eventPolicy("reject_base64_media", policies.RejectEventsWithBase64Media)
+	eventPolicy("only_protected_events", policies.OnlyAllowNIP70ProtectedEvents)
+	filterPolicy("no_complex_filters", policies.NoComplexFilters)
+	filterPolicy("no_empty_filters", policies.NoEmptyFilters)
+	filterPolicy("no_search_queries", policies.NoSearchQueries)
+
+	RegisterPolicy("prevent_large_tags", func(app *App, p struct {
+		MaxLength int `yaml:"max_length"`
+	}) (Policy, error) {
+		if p.MaxLength <= 0 {
+			return Policy{}, fmt.Errorf("max_length must be positive")
+		}
+		return Policy{Event: policies.PreventLargeTags(p.MaxLength)}, nil
+	})
+
+	RegisterPolicy("prevent_too_many_indexable_tags", func(app *App, p struct {
+		Max         int   `yaml:"max"`
+		IgnoreKinds []int `yaml:"ignore_kinds"`
+		OnlyKinds   []int `yaml:"only_kinds"`
+	}) (Policy, error) {
+		if p.Max <= 0 {
+			return Policy{}, fmt.Errorf("max must be positive")
+		}
+		return Policy{Event: policies.PreventTooManyIndexableTags(p.Max, p.IgnoreKinds, p.OnlyKinds)}, nil
+	})
+
+	RegisterPolicy("prevent_timestamps_in_the_past", func(app *App, p struct {
+		MaxAge time.Duration `yaml:"max_age"`
+	}) (Policy, error) {
+		if p.MaxAge <= 0 {
+			return Policy{}, fmt.Errorf("max_age must be positive")
+		}
+		return Policy{Event: policies.PreventTimestampsInThePast(p.MaxAge)}, nil
+	})
+
+	RegisterPolicy("prevent_timestamps_in_the_future", func(app *App, p struct {
+		MaxAhead time.Duration `yaml:"max_ahead"`
+	}) (Policy, error) {
+		if p.MaxAhead <= 0 {
+			return Policy{}, fmt.Errorf("max_ahead must be positive")
+		}
+		return Policy{Event: policies.PreventTimestampsInTheFuture(p.MaxAhead)}, nil
+	})
+
+	// NIP-13 proof of work on the event id
+	RegisterPolicy("pow", func(app *App, p struct {
+		Difficulty int   `yaml:"difficulty"`
+		Kinds      []int `yaml:"kinds"`
+	}) (Policy, error) {
+		if p.Difficulty <= 0 {
+			return Policy{}, fmt.Errorf("difficulty must be positive")
+		}
+		return Policy{Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+			if len(p.Kinds) > 0 && !slices.Contains(p.Kinds, event.Kind) {
+				return false, ""
+			}
+			if err := nip13.Check(event.ID, p.Difficulty); err != nil {
+				return true, fmt.Sprintf("pow: difficulty %d is required", p.Difficulty)
+			}
+			return false, ""
+		}}, nil
+	})
+
+	// only the owner, allowlisted pubkeys and allowed NIP-05 domains may
+	// write, whatever the access mode
+	RegisterPolicy("allowlist", func(app *App, _ noParams) (Policy, error) {
+		return Policy{Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+			ok, err := app.IsMember(ctx, event)
+			if err != nil {
+				return true, "error checking authorization"
+			}
+			if !ok {
+				return true, "restricted: only allowlisted authors can write here"
+			}
+			return false, ""
+		}}, nil
+	})
+
+	RegisterPolicy("connection_rate_limit", func(app *App, p RateLimitParams) (Policy, error) {
+		rl, err := p.limiter()
+		if err != nil {
+			return Policy{}, err
+		}
+		return Policy{Connection: func(r *http.Request) (bool, string) {
+			return !rl.allow(khatru.GetIPFromRequest(r)), "rate-limited: too many connections"
+		}}, nil
+	})
+
+	RegisterPolicy("event_rate_limit", func(app *App, p struct {
+		RateLimitParams `yaml:",inline"`
+		// By is ip or pubkey.
+		By string `yaml:"by"`
+	}) (Policy, error) {
+		rl, err := p.limiter()
+		if err != nil {
+			return Policy{}, err
+		}
+		switch p.By {
+		case "", "ip":
+			return Policy{Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+				return !rl.allow(khatru.GetIP(ctx)), "rate-limited: slow down, please"
+			}}, nil
+		case "pubkey":
+			return Policy{Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+				return !rl.allow(event.PubKey), "rate-limited: slow down, please"
+			}}, nil
+		}
+		return Policy{}, fmt.Errorf("invalid by %q, must be ip or pubkey", p.By)
+	})
+
+	RegisterPolicy("filter_rate_limit", func(app *App, p RateLimitParams) (Policy, error) {
+		rl, err := p.limiter()
+		if err != nil {
+			return Policy{}, err
+		}
+		return Policy{Filter: func(ctx context.Context, filter nostr.Filter) (bool, string) {
+			return !rl.allow(khatru.GetIP(ctx)), "rate-limited: too many requests"
+		}}, nil
+	})
+
+	RegisterPolicy("api_rate_limit", func(app *App, p RateLimitParams) (Policy, error) {
+		rl, err := p.limiter()
+		if err != nil {
+			return Policy{}, err
+		}
+		return Policy{APICall: func(ctx context.Context, pubkey, method string) (bool, string) {
+			return !rl.allow(pubkey), "rate-limited: too many calls"
+		}}, nil
+	})
+
+	// limits the management API to some methods, for everyone
+	RegisterPolicy("api_methods", func(app *App, p struct {
+		Allow []string `yaml:"allow"`
+	}) (Policy, error) {
+		return Policy{APICall: func(ctx context.Context, pubkey, method string) (bool, string) {
+			if method == "supportedmethods" || slices.Contains(p.Allow, method) {
+				return false, ""
+			}
+			return true, fmt.Sprintf("%s is disabled on this relay", method)
+		}}, nil
+	})
+}
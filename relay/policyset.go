@@ -0,0 +1,220 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// PolicySet runs the configured policy chains of every stage. Update swaps
+// them atomically, so a config reload applies to connections that are
+// already open, and it counts which policy rejected what.
+type PolicySet struct {
+	app     *App
+	current atomic.Pointer[policyChains]
+
+	mu sync.Mutex
+	// built keeps the policies of the last Update, so the ones whose config
+	// didn't change keep their state (e.g. rate limits) across reloads
+	built      map[string]Policy
+	rejections map[string]map[string]*atomic.Int64
+}
+
+// namedPolicy is a policy in a chain, with the counter of its rejections.
+type namedPolicy struct {
+	name     string
+	policy   Policy
+	rejected *atomic.Int64
+}
+
+type policyChains map[string][]namedPolicy
+
+// NewPolicySet creates an empty policy set for app.
+func NewPolicySet(app *App) *PolicySet {
+	ps := &PolicySet{
+		app:        app,
+		built:      make(map[string]Policy),
+		rejections: make(map[string]map[string]*atomic.Int64),
+	}
+	ps.current.Store(&policyChains{})
+	return ps
+}
+
+// Update replaces the policies with the ones described by cfg. When one of
+// them can't be built, the current ones stay.
+func (ps *PolicySet) Update(cfg PolicyConfig) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	chains := make(policyChains)
+	built := make(map[string]Policy)
+	for _, stage := range policyStages {
+		for _, entry := range cfg.chain(stage) {
+			params, _ := json.Marshal(entry.Params)
+			key := stage + "/" + entry.Name + "/" + string(params)
+
+			policy, ok := ps.built[key]
+			if !ok {
+				if policy, ok = built[key]; !ok {
+					var err error
+					if policy, err = buildPolicy(ps.app, stage, entry); err != nil {
+						closePolicies(built, ps.built)
+						return err
+					}
+				}
+			}
+			built[key] = policy
+
+			chains[stage] = append(chains[stage], namedPolicy{entry.Name, policy, ps.counter(stage, entry.Name)})
+		}
+	}
+	old := ps.built
+	ps.built = built
+	ps.current.Store(&chains)
+	closePolicies(old, built)
+	return nil
+}
+
+func buildPolicy(app *App, stage string, entry PolicyEntry) (Policy, error) {
+	registered, found := lookupPolicy(entry.Name)
+	if !found {
+		return Policy{}, fmt.Errorf("unknown %s policy %q", stage, entry.Name)
+	}
+	policy, err := registered.build(app, entry.Params)
+	if err != nil {
+		return Policy{}, fmt.Errorf("%s policy %s: %w", stage, entry.Name, err)
+	}
+	if !policy.runsIn(stage) {
+		if policy.Close != nil {
+			policy.Close()
+		}
+		return Policy{}, fmt.Errorf("policy %s doesn't run on %s", entry.Name, stage)
+	}
+	return policy, nil
+}
+
+// closePolicies closes the policies of built that aren't in keep.
+func closePolicies(built, keep map[string]Policy) {
+	for key, policy := range built {
+		if _, ok := keep[key]; !ok && policy.Close != nil {
+			policy.Close()
+		}
+	}
+}
+
+// Close closes all policies. The set rejects nothing afterwards.
+func (ps *PolicySet) Close() {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.current.Store(&policyChains{})
+	closePolicies(ps.built, nil)
+	ps.built = make(map[string]Policy)
+}
+
+// counter returns the rejection counter of a policy in a stage. Counters
+// are kept when the policy is removed, for the stats.
+func (ps *PolicySet) counter(stage, name string) *atomic.Int64 {
+	if ps.rejections[stage] == nil {
+		ps.rejections[stage] = make(map[string]*atomic.Int64)
+	}
+	c, ok := ps.rejections[stage][name]
+	if !ok {
+		c = &atomic.Int64{}
+		ps.rejections[stage][name] = c
+	}
+	return c
+}
+
+// Rejections returns how many times each policy rejected something, by
+// stage and policy name.
+func (ps *PolicySet) Rejections() map[string]map[string]int64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	result := make(map[string]map[string]int64, len(ps.rejections))
+	for stage, counters := range ps.rejections {
+		result[stage] = make(map[string]int64, len(counters))
+		for name, c := range counters {
+			result[stage][name] = c.Load()
+		}
+	}
+	return result
+}
+
+func (ps *PolicySet) chain(stage string) []namedPolicy {
+	return (*ps.current.Load())[stage]
+}
+
+// notify tells about a rejection: rate limiting counts towards the admin
+// DMs about offenders, and a policy.rejected webhook is sent when an
+// endpoint asked for them.
+func (ps *PolicySet) notify(stage, policy, msg string, details map[string]any) {
+	if ps.app.dms != nil && strings.HasPrefix(msg, "rate-limited:") {
+		key, _ := details["ip"].(string)
+		if stage == StageAPICall {
+			key, _ = details["pubkey"].(string)
+		}
+		ps.app.dms.RateLimited(key, policy)
+	}
+	if ps.app.webhooks == nil || !ps.app.webhooks.Subscribed(WebhookPolicyRejected) {
+		return
+	}
+	details["stage"], details["policy"], details["message"] = stage, policy, msg
+	ps.app.webhooks.Notify(WebhookPolicyRejected, details)
+}
+
+// RejectConnection runs the connection policies.
+func (ps *PolicySet) RejectConnection(r *http.Request) bool {
+	for _, p := range ps.chain(StageConnection) {
+		if reject, msg := p.policy.Connection(r); reject {
+			p.rejected.Add(1)
+			ps.notify(StageConnection, p.name, msg, map[string]any{"ip": khatru.GetIPFromRequest(r)})
+			return true
+		}
+	}
+	return false
+}
+
+// RejectEvent runs the event policies.
+func (ps *PolicySet) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	for _, p := range ps.chain(StageEvent) {
+		if reject, msg := p.policy.Event(ctx, event); reject {
+			p.rejected.Add(1)
+			ps.notify(StageEvent, p.name, msg, map[string]any{
+				"ip": khatru.GetIP(ctx), "event_id": event.ID, "pubkey": event.PubKey, "kind": event.Kind,
+			})
+			return true, msg
+		}
+	}
+	return false, ""
+}
+
+// RejectFilter runs the filter policies.
+func (ps *PolicySet) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	for _, p := range ps.chain(StageFilter) {
+		if reject, msg := p.policy.Filter(ctx, filter); reject {
+			p.rejected.Add(1)
+			ps.notify(StageFilter, p.name, msg, map[string]any{"ip": khatru.GetIP(ctx), "filter": filter})
+			return true, msg
+		}
+	}
+	return false, ""
+}
+
+// RejectAPICall runs the management API policies.
+func (ps *PolicySet) RejectAPICall(ctx context.Context, pubkey, method string) (reject bool, msg string) {
+	for _, p := range ps.chain(StageAPICall) {
+		if reject, msg := p.policy.APICall(ctx, pubkey, method); reject {
+			p.rejected.Add(1)
+			ps.notify(StageAPICall, p.name, msg, map[string]any{"pubkey": pubkey, "method": method})
+			return true, msg
+		}
+	}
+	return false, ""
+}
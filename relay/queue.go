@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Delivery states shared by the outbox and webhook queues.
+const (
+	deliveryPending   = "pending"
+	deliveryDelivered = "delivered"
+	deliveryDead      = "dead"
+)
+
+// queuedItem is an entry of a delivery queue: one item (an event or a
+// notification) for one destination.
+type queuedItem interface {
+	queueKey() (id, url string)
+	attempts() int
+}
+
+// deliveryQueue is the delivery loop shared by the outbox and the webhooks.
+// Both queue one entry per item and destination in the management store;
+// the loop claims the due entries batch by batch, sends them, and retries
+// failures with exponential backoff until they're dead-lettered.
+type deliveryQueue[D queuedItem] struct {
+	// name is what the entries are called in log messages.
+	name string
+
+	claim     func(limit int, lease time.Duration) ([]D, error)
+	send      func(ctx context.Context, d D) error
+	delivered func(id, url string) error
+	failed    func(id, url, lastError string, retryIn time.Duration, dead bool) error
+	prune     func() error
+	// retries is read on every failure, so it may follow config reloads.
+	retries func() (maxAttempts int, base, max time.Duration)
+
+	pollInterval time.Duration
+	wake         chan struct{}
+}
+
+// giveUp wraps the error of a delivery that must be dead-lettered without
+// retrying it.
+type giveUp struct{ error }
+
+func (q *deliveryQueue[D]) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers queued entries until ctx is canceled, pruning old ones every
+// hour.
+func (q *deliveryQueue[D]) run(ctx context.Context) {
+	ticker := time.NewTicker(q.pollInterval)
+	defer ticker.Stop()
+	prune := time.NewTicker(time.Hour)
+	defer prune.Stop()
+
+	for {
+		q.deliverDue(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-q.wake:
+		case <-ticker.C:
+		case <-prune.C:
+			if err := q.prune(); err != nil {
+				log.Printf("Error pruning %s queue: %v", q.name, err)
+			}
+		}
+	}
+}
+
+// deliverDue sends everything that is due, batch by batch.
+func (q *deliveryQueue[D]) deliverDue(ctx context.Context) {
+	for ctx.Err() == nil {
+		deliveries, err := q.claim(100, 2*time.Minute)
+		if err != nil {
+			log.Printf("Error claiming %s deliveries: %v", q.name, err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+		for _, d := range deliveries {
+			q.deliver(ctx, d)
+		}
+	}
+}
+
+func (q *deliveryQueue[D]) deliver(ctx context.Context, d D) {
+	id, url := d.queueKey()
+	err := q.send(ctx, d)
+	if err == nil {
+		if err := q.delivered(id, url); err != nil {
+			log.Printf("Error marking %s %s to %s: %v", q.name, id, url, err)
+		}
+		return
+	}
+
+	maxAttempts, base, max := q.retries()
+	attempts := d.attempts() + 1
+	dead := attempts >= maxAttempts || errors.As(err, new(giveUp))
+	var retryIn time.Duration
+	if dead {
+		log.Printf("Giving up on %s %s to %s after %d attempts: %v", q.name, id, url, attempts, err)
+	} else {
+		retryIn = retryBackoff(base, max, attempts)
+	}
+	if err := q.failed(id, url, err.Error(), retryIn, dead); err != nil {
+		log.Printf("Error marking %s %s to %s: %v", q.name, id, url, err)
+	}
+	if !dead && retryIn < q.pollInterval {
+		time.AfterFunc(retryIn, q.signal)
+	}
+}
+
+// retryBackoff is base, doubled for every attempt after the first, up to max.
+func retryBackoff(base, max time.Duration, attempts int) time.Duration {
+	wait := base
+	for i := 1; i < attempts && wait < max; i++ {
+		wait *= 2
+	}
+	return min(wait, max)
+}
@@ -0,0 +1,500 @@
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// testRelay is the full relay served by httptest, on the memory backend or,
+// when OKAY_TEST_DATABASE_URL is set, on a schema of that Postgres database
+// made for the test. TestEmbeddedBackends runs it on the embedded stores.
+type testRelay struct {
+	app     *App
+	url     string
+	httpURL string
+	ownerSK string
+}
+
+// testBackend is the embedded backend newTestRelay uses instead, in a
+// directory of the test, when set.
+var testBackend string
+
+// newTestRelay starts the relay with the default config changed by
+// configure, owned by a fresh key.
+func newTestRelay(t *testing.T, configure func(cfg *Config)) *testRelay {
+	t.Helper()
+
+	ownerSK := nostr.GeneratePrivateKey()
+	ownerPK, _ := nostr.GetPublicKey(ownerSK)
+
+	cfg := DefaultConfig()
+	cfg.Database.Backend = BackendMemory
+	if testBackend != "" {
+		cfg.Database.Backend = testBackend
+		cfg.Database.Path = filepath.Join(t.TempDir(), testBackend)
+	} else if url := testDatabaseURL(t); url != "" {
+		cfg.Database.Backend = BackendPostgres
+		cfg.Database.URL = url
+	}
+	cfg.Key.SecretKey = nostr.GeneratePrivateKey()
+	cfg.Info.PubKey = ownerPK
+	if configure != nil {
+		configure(cfg)
+	}
+	app, err := New(Options{Config: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Start(context.Background())
+	server := httptest.NewServer(app.Handler)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := app.Shutdown(ctx); err != nil {
+			t.Errorf("shutdown: %v", err)
+		}
+		server.Close()
+	})
+
+	return &testRelay{
+		app:     app,
+		url:     "ws" + strings.TrimPrefix(server.URL, "http"),
+		httpURL: server.URL,
+		ownerSK: ownerSK,
+	}
+}
+
+// TestEmbeddedBackends runs the relay tests on every embedded store compiled
+// into the build: SQLite with cgo, LMDB with the lmdb tag, and Badger.
+func TestEmbeddedBackends(t *testing.T) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T)
+	}{
+		{"OwnerPublishesAndReads", TestOwnerPublishesAndReads},
+		{"PrivateRelayAccess", TestPrivateRelayAccess},
+		{"PublicRelayBans", TestPublicRelayBans},
+		{"RelayInformation", TestRelayInformation},
+		{"Readyz", TestReadyz},
+		{"AllowAndBanOverRPC", TestAllowAndBanOverRPC},
+		{"KindRules", TestKindRules},
+		{"IPBlocks", TestIPBlocks},
+		{"AdminGrants", TestAdminGrants},
+		{"RevokeAdminMethods", TestRevokeAdminMethods},
+		{"RelayInfoPersists", TestRelayInfoPersists},
+		{"PolicyChains", TestPolicyChains},
+		{"PolicyConfig", TestPolicyConfig},
+		{"ScriptPolicy", TestScriptPolicy},
+		{"Plugin", TestPlugin},
+		{"Webhooks", TestWebhooks},
+		{"AdminDMs", TestAdminDMs},
+		{"ContentFilter", TestContentFilter},
+		{"NIP05Domains", TestNIP05Domains},
+		{"GroupPermissions", TestGroupPermissions},
+		{"Mirror", TestMirror},
+		{"CountHidesPrivateGroups", TestCountHidesPrivateGroups},
+		{"DrainForgetsClosedSubscriptions", TestDrainForgetsClosedSubscriptions},
+		{"Outbox", TestOutbox},
+		{"ExportEvents", TestExportEvents},
+		{"Negentropy", TestNegentropy},
+	}
+	for _, backend := range []string{BackendSQLite, BackendLMDB, BackendBadger} {
+		t.Run(backend, func(t *testing.T) {
+			if _, ok := backends[backend]; !ok {
+				t.Skipf("%s is not compiled in", backend)
+			}
+			testBackend = backend
+			defer func() { testBackend = "" }()
+			for _, test := range tests {
+				t.Run(test.name, test.run)
+			}
+		})
+	}
+}
+
+// openTestStorage opens the storage newTestRelay would use, closed with the
+// test.
+func openTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	cfg := DatabaseConfig{Backend: BackendMemory}
+	if testBackend != "" {
+		cfg = DatabaseConfig{Backend: testBackend, Path: filepath.Join(t.TempDir(), testBackend)}
+	} else if url := testDatabaseURL(t); url != "" {
+		cfg = DatabaseConfig{Backend: BackendPostgres, URL: url}
+	}
+	st, err := OpenStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(st.Close)
+	return st
+}
+
+// testDatabaseURL makes a schema in the database of OKAY_TEST_DATABASE_URL,
+// dropped after the test, and returns the URL that uses it; empty when the
+// variable isn't set. DATABASE_URL is never used, so running the tests where
+// a relay is configured doesn't touch its data.
+func testDatabaseURL(t *testing.T) string {
+	t.Helper()
+	base := os.Getenv("OKAY_TEST_DATABASE_URL")
+	if base == "" {
+		return ""
+	}
+
+	db, err := sql.Open("postgres", base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	schema := "okay_test_" + hex.EncodeToString(suffix)
+	if _, err := db.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if _, err := db.Exec(`DROP SCHEMA ` + schema + ` CASCADE`); err != nil {
+			t.Errorf("dropping schema %s: %v", schema, err)
+		}
+		db.Close()
+	})
+
+	// lib/pq sends the parameters it doesn't know to the server
+	if u, err := url.Parse(base); err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql") {
+		query := u.Query()
+		query.Set("search_path", schema)
+		u.RawQuery = query.Encode()
+		return u.String()
+	}
+	return base + " search_path=" + schema
+}
+
+// connect opens a client connection that is closed with the test.
+func (tr *testRelay) connect(t *testing.T) *nostr.Relay {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	relay, err := nostr.RelayConnect(ctx, tr.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { relay.Close() })
+	return relay
+}
+
+func signedNote(t *testing.T, sk, content string) nostr.Event {
+	t.Helper()
+	event := nostr.Event{Kind: 1, CreatedAt: nostr.Now(), Tags: nostr.Tags{}, Content: content}
+	if err := event.Sign(sk); err != nil {
+		t.Fatal(err)
+	}
+	return event
+}
+
+func publish(relay *nostr.Relay, event nostr.Event) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return relay.Publish(ctx, event)
+}
+
+func TestOwnerPublishesAndReads(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	relay := tr.connect(t)
+
+	event := signedNote(t, tr.ownerSK, "hello")
+	if err := publish(relay, event); err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	events, err := relay.QuerySync(ctx, nostr.Filter{IDs: []string{event.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Content != "hello" {
+		t.Fatalf("got %v, want the published event", events)
+	}
+}
+
+func TestPrivateRelayAccess(t *testing.T) {
+	tr := newTestRelay(t, nil)
+	relay := tr.connect(t)
+
+	sk := nostr.GeneratePrivateKey()
+	err := publish(relay, signedNote(t, sk, "stranger"))
+	if err == nil || !strings.Contains(err.Error(), "private relay") {
+		t.Fatalf("got %v, want a private relay rejection", err)
+	}
+
+	pk, _ := nostr.GetPublicKey(sk)
+	if err := tr.app.dbManager.AddAllowedPubkey(pk, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := publish(relay, signedNote(t, sk, "member")); err != nil {
+		t.Fatalf("allowlisted pubkey: %v", err)
+	}
+}
+
+func TestPublicRelayBans(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) { cfg.Access.Mode = AccessPublic })
+	relay := tr.connect(t)
+
+	sk := nostr.GeneratePrivateKey()
+	if err := publish(relay, signedNote(t, sk, "anyone")); err != nil {
+		t.Fatalf("public relay: %v", err)
+	}
+
+	pk, _ := nostr.GetPublicKey(sk)
+	if err := tr.app.dbManager.BanPubKey(pk, "spam"); err != nil {
+		t.Fatal(err)
+	}
+	err := publish(relay, signedNote(t, sk, "again"))
+	if err == nil || !strings.Contains(err.Error(), "banned") {
+		t.Fatalf("got %v, want a ban rejection", err)
+	}
+}
+
+func TestRelayInformation(t *testing.T) {
+	tr := newTestRelay(t, func(cfg *Config) { cfg.Info.Name = "test relay" })
+
+	req, _ := http.NewRequest(http.MethodGet, tr.httpURL, nil)
+	req.Header.Set("Accept", "application/nostr+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var info map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info["name"] != "test relay" {
+		t.Errorf("name = %v, want test relay", info["name"])
+	}
+	if self, _ := info["self"].(string); len(self) != 64 {
+		t.Errorf("self = %v, want the relay's pubkey", info["self"])
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	tr := newTestRelay(t, nil)
+
+	resp, err := http.Get(tr.httpURL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var report readyReport
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || !report.Ready {
+		t.Fatalf("status %d, report %+v", resp.StatusCode, report)
+	}
+}
+
+func TestMemoryKVDiscardsFailedUpdates(t *testing.T) {
+	kv := &memoryKV{data: make(map[string][]byte)}
+	err := kv.Update(func(tx kvTx) error {
+		if err := tx.Put([]byte("a/1"), []byte("x")); err != nil {
+			return err
+		}
+		return errors.New("fail")
+	})
+	if err == nil {
+		t.Fatal("update should fail")
+	}
+
+	kv.View(func(tx kvTx) error {
+		if value, _ := tx.Get([]byte("a/1")); value != nil {
+			t.Errorf("failed update left %q behind", value)
+		}
+		return nil
+	})
+}
+
+func TestEmbeddedOptions(t *testing.T) {
+	st, err := OpenStorage(DatabaseConfig{Backend: BackendMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := DefaultConfig()
+	cfg.Key.SecretKey = nostr.GeneratePrivateKey()
+
+	app, err := New(Options{
+		Config: cfg,
+		Store:  NewStorage(st.Events(), st.Management()),
+		Info:   &InfoConfig{Name: "embedded"},
+		Access: &AccessConfig{Mode: AccessPublic},
+		RejectEvent: []func(ctx context.Context, event *nostr.Event) (bool, string){
+			func(ctx context.Context, event *nostr.Event) (bool, string) {
+				return event.Content == "nope", "blocked: not here"
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(app.Handler)
+	t.Cleanup(func() {
+		app.Shutdown(context.Background())
+		server.Close()
+	})
+
+	// the overrides survive a reload of the config they replace
+	if err := app.Reload(DefaultConfig()); err != nil {
+		t.Fatal(err)
+	}
+	if app.Config().Access.Mode != AccessPublic || app.Relay.Info.Name != "embedded" {
+		t.Fatalf("reload dropped the overrides: %+v, %q", app.Config().Access, app.Relay.Info.Name)
+	}
+
+	tr := &testRelay{app: app, url: "ws" + strings.TrimPrefix(server.URL, "http")}
+	relay := tr.connect(t)
+	sk := nostr.GeneratePrivateKey()
+	if err := publish(relay, signedNote(t, sk, "hello")); err != nil {
+		t.Fatalf("public relay: %v", err)
+	}
+	err = publish(relay, signedNote(t, sk, "nope"))
+	if err == nil || !strings.Contains(err.Error(), "not here") {
+		t.Fatalf("got %v, want the embedder's rejection", err)
+	}
+}
+
+func TestExportEvents(t *testing.T) {
+	st := openTestStorage(t)
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	for i := range 5 {
+		event := signedNote(t, sk, "note")
+		event.CreatedAt = now - nostr.Timestamp(i)
+		event.Sign(sk)
+		if err := st.Events().SaveEvent(context.Background(), &event); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out strings.Builder
+	count, err := st.ExportEvents(context.Background(), &out, nostr.Filter{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if count != 2 || len(lines) != 2 {
+		t.Fatalf("exported %d events in %d lines, want 2", count, len(lines))
+	}
+	var newest, next nostr.Event
+	json.Unmarshal([]byte(lines[0]), &newest)
+	json.Unmarshal([]byte(lines[1]), &next)
+	if newest.CreatedAt != now || next.CreatedAt != now-1 {
+		t.Errorf("got %d then %d, want the newest two, newest first", newest.CreatedAt-now, next.CreatedAt-now)
+	}
+
+	if _, err := st.ExportEvents(context.Background(), &out, nostr.Filter{Search: "note"}); err == nil {
+		t.Error("search filter should be refused")
+	}
+}
+
+func TestWalkEvents(t *testing.T) {
+	// more events in one second than a page, and older ones after them
+	sk := nostr.GeneratePrivateKey()
+	now := nostr.Now()
+	save := func(t *testing.T, store eventstore.Store, crowded int) map[string]bool {
+		t.Helper()
+		saved := make(map[string]bool)
+		for i := range crowded + 5 {
+			event := nostr.Event{Kind: 1, CreatedAt: now, Tags: nostr.Tags{}, Content: strconv.Itoa(i)}
+			if i >= crowded {
+				event.CreatedAt = now - nostr.Timestamp(i)
+			}
+			event.Sign(sk)
+			if err := store.SaveEvent(context.Background(), &event); err != nil {
+				t.Fatal(err)
+			}
+			saved[event.ID] = true
+		}
+		return saved
+	}
+	walk := func(store eventstore.Store, saved map[string]bool) error {
+		return WalkEvents(context.Background(), store, nostr.Filter{}, func(event *nostr.Event) error {
+			if !saved[event.ID] {
+				t.Errorf("%s walked twice", event.ID)
+			}
+			delete(saved, event.ID)
+			return nil
+		})
+	}
+
+	for _, backend := range []string{BackendMemory, BackendLMDB, BackendBadger} {
+		t.Run(backend, func(t *testing.T) {
+			if _, ok := backends[backend]; !ok {
+				t.Skipf("%s is not compiled in", backend)
+			}
+			st, err := OpenStorage(DatabaseConfig{Backend: backend, Path: filepath.Join(t.TempDir(), backend)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer st.Close()
+
+			saved := save(t, st.Events(), 3*walkPageSize)
+			if err := walk(st.Events(), saved); err != nil {
+				t.Fatal(err)
+			}
+			if len(saved) != 0 {
+				t.Errorf("%d events not walked", len(saved))
+			}
+		})
+	}
+
+	// a store that can't count and caps its results (500 in memory) can't
+	// be walked through a second with more; that's an error, not the end
+	st, err := OpenStorage(DatabaseConfig{Backend: BackendMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	saved := save(t, st.Events(), 600)
+	if err := walk(struct{ eventstore.Store }{st.Events()}, saved); err == nil {
+		t.Errorf("walk ended without an error, %d events not walked", len(saved))
+	}
+}
+
+func TestParseSearch(t *testing.T) {
+	tests := []struct {
+		search, terms string
+		extensions    map[string]string
+	}{
+		{"nostr relays", "nostr relays", map[string]string{}},
+		{"Haus language:DE", "Haus", map[string]string{"language": "de"}},
+		{"see https://example.com/post", "see https://example.com/post", map[string]string{}},
+		{"nostr:npub1abc at 10:30", "nostr:npub1abc at 10:30", map[string]string{}},
+		{"include:spam sats", "include:spam sats", map[string]string{}},
+		{"language: empty", "language: empty", map[string]string{}},
+	}
+	for _, test := range tests {
+		terms, extensions := parseSearch(test.search)
+		if terms != test.terms || !maps.Equal(extensions, test.extensions) {
+			t.Errorf("parseSearch(%q) = %q, %v, want %q, %v", test.search, terms, extensions, test.terms, test.extensions)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+	"github.com/nbd-wtf/go-nostr/nip44"
+	"github.com/nbd-wtf/go-nostr/nip49"
+	"github.com/nbd-wtf/go-nostr/nip59"
+)
+
+// RelayKey is the relay's own signing identity. It is distinct from
+// RELAY_PUBKEY, which identifies the relay owner.
+type RelayKey struct {
+	secretKey string
+	PublicKey string
+}
+
+// LoadRelayKey returns the relay key from, in order of preference, the
+// secretKey value (hex or nsec), the key file, or a freshly generated key
+// that is then written to the key file. When passphrase is set the key file
+// is stored NIP-49 encrypted (ncryptsec).
+func LoadRelayKey(secretKey, keyFile, passphrase string) (*RelayKey, error) {
+	if secretKey != "" {
+		return newRelayKey(secretKey)
+	}
+	if keyFile == "" {
+		return nil, fmt.Errorf("either a relay secret key or a key file is required")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return generateRelayKey(keyFile, passphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read relay key file %s: %w", keyFile, err)
+	}
+
+	stored := strings.TrimSpace(string(data))
+	if strings.HasPrefix(stored, "ncryptsec1") {
+		if passphrase == "" {
+			return nil, fmt.Errorf("relay key file %s is encrypted but no passphrase was given", keyFile)
+		}
+		sk, err := nip49.Decrypt(stored, passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt relay key file %s: %w", keyFile, err)
+		}
+		return newRelayKey(sk)
+	}
+	return newRelayKey(stored)
+}
+
+func generateRelayKey(keyFile, passphrase string) (*RelayKey, error) {
+	sk := nostr.GeneratePrivateKey()
+
+	stored := sk
+	if passphrase != "" {
+		var err error
+		stored, err = nip49.Encrypt(sk, passphrase, 16, nip49.ClientDoesNotTrackThisData)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encrypt relay key: %w", err)
+		}
+	}
+
+	if dir := filepath.Dir(keyFile); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, fmt.Errorf("failed to create relay key directory: %w", err)
+		}
+	}
+	if err := os.WriteFile(keyFile, []byte(stored+"\n"), 0o600); err != nil {
+		return nil, fmt.Errorf("failed to write relay key file %s: %w", keyFile, err)
+	}
+
+	return newRelayKey(sk)
+}
+
+func newRelayKey(sk string) (*RelayKey, error) {
+	sk, err := ParseSecretKey(sk)
+	if err != nil {
+		return nil, fmt.Errorf("relay secret key must be 64 hex characters or an nsec: %w", err)
+	}
+
+	pubkey, err := nostr.GetPublicKey(sk)
+	if err != nil {
+		return nil, fmt.Errorf("invalid relay secret key: %w", err)
+	}
+	return &RelayKey{secretKey: sk, PublicKey: pubkey}, nil
+}
+
+// Sign sets the relay's pubkey on the event and signs it.
+func (rk *RelayKey) Sign(event *nostr.Event) error {
+	return event.Sign(rk.secretKey)
+}
+
+// SignNew builds and signs a new event authored by the relay.
+func (rk *RelayKey) SignNew(kind int, tags nostr.Tags, content string) (*nostr.Event, error) {
+	event := &nostr.Event{
+		Kind:      kind,
+		CreatedAt: nostr.Now(),
+		Tags:      tags,
+		Content:   content,
+	}
+	if err := rk.Sign(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// DirectMessage builds a NIP-17 direct message from the relay to
+// recipient: a kind 14 rumor, sealed with the relay key and gift wrapped.
+func (rk *RelayKey) DirectMessage(recipient, content string) (*nostr.Event, error) {
+	conversationKey, err := nip44.GenerateConversationKey(recipient, rk.secretKey)
+	if err != nil {
+		return nil, err
+	}
+	rumor := nostr.Event{
+		Kind:      nostr.KindDirectMessage,
+		PubKey:    rk.PublicKey,
+		CreatedAt: nostr.Now(),
+		Tags:      nostr.Tags{{"p", recipient}},
+		Content:   content,
+	}
+	rumor.ID = rumor.GetID()
+	wrap, err := nip59.GiftWrap(rumor, recipient, func(plaintext string) (string, error) {
+		return nip44.Encrypt(plaintext, conversationKey)
+	}, rk.Sign, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wrap, nil
+}
+
+// ParseSecretKey accepts a hex secret key or an nsec.
+func ParseSecretKey(value string) (string, error) {
+	if strings.HasPrefix(value, "nsec1") {
+		prefix, data, err := nip19.Decode(value)
+		if err != nil || prefix != "nsec" {
+			return "", fmt.Errorf("invalid nsec")
+		}
+		return data.(string), nil
+	}
+	if !nostr.IsValid32ByteHex(value) {
+		return "", fmt.Errorf("invalid secret key")
+	}
+	return value, nil
+}
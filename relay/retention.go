@@ -0,0 +1,118 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// Retention deletes events that are older than the configured age for their
+// kind. It deletes straight from the event table in small batches, so it
+// doesn't hold long locks; the config is read on every run and can change
+// in between. Without a Postgres database it goes through the eventstore
+// instead, one event at a time.
+type Retention struct {
+	db     *sql.DB
+	store  eventstore.Store
+	config func() RetentionConfig
+}
+
+// NewRetention creates the retention worker. db may be nil.
+func NewRetention(db *sql.DB, store eventstore.Store, config func() RetentionConfig) *Retention {
+	return &Retention{db: db, store: store, config: config}
+}
+
+// Run runs the cleanup every configured interval until ctx is canceled.
+func (r *Retention) Run(ctx context.Context) {
+	for {
+		r.run(ctx)
+		select {
+		case <-time.After(r.config().Interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Retention) run(ctx context.Context) {
+	cfg := r.config()
+
+	if r.db == nil {
+		for kind, maxAge := range cfg.Kinds {
+			if maxAge > 0 {
+				r.deleteOlderFromStore(ctx, nostr.Filter{Kinds: []int{kind}}, nil, maxAge)
+			}
+		}
+		if cfg.MaxAge > 0 {
+			r.deleteOlderFromStore(ctx, nostr.Filter{}, cfg.Kinds, cfg.MaxAge)
+		}
+		return
+	}
+
+	overridden := make([]int, 0, len(cfg.Kinds))
+	for kind, maxAge := range cfg.Kinds {
+		overridden = append(overridden, kind)
+		if maxAge > 0 {
+			r.deleteOlder(ctx, `kind = $2`, kind, maxAge)
+		}
+	}
+	if cfg.MaxAge > 0 {
+		r.deleteOlder(ctx, `NOT (kind = ANY($2))`, pq.Array(overridden), cfg.MaxAge)
+	}
+}
+
+// deleteOlderFromStore deletes the events matching filter, except those of
+// the skipped kinds, that were created more than maxAge ago.
+func (r *Retention) deleteOlderFromStore(ctx context.Context, filter nostr.Filter, skip map[int]time.Duration, maxAge time.Duration) {
+	cutoff := nostr.Timestamp(time.Now().Add(-maxAge).Unix())
+	filter.Until = &cutoff
+
+	total := 0
+	err := WalkEvents(ctx, r.store, filter, func(event *nostr.Event) error {
+		if _, ok := skip[event.Kind]; ok {
+			return nil
+		}
+		if err := r.store.DeleteEvent(ctx, event); err != nil {
+			return err
+		}
+		total++
+		return nil
+	})
+	if err != nil && ctx.Err() == nil {
+		log.Printf("Error applying retention: %v", err)
+	}
+	if total > 0 {
+		log.Printf("retention deleted %d events older than %s", total, maxAge)
+	}
+}
+
+// deleteOlder deletes the events matching condition (with $2 as its
+// argument) that were created more than maxAge ago.
+func (r *Retention) deleteOlder(ctx context.Context, condition string, arg any, maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge).Unix()
+	query := `DELETE FROM event WHERE id IN (
+		SELECT id FROM event WHERE created_at < $1 AND ` + condition + ` LIMIT 1000
+	)`
+
+	total := int64(0)
+	for ctx.Err() == nil {
+		result, err := r.db.ExecContext(ctx, query, cutoff, arg)
+		if err != nil {
+			log.Printf("Error applying retention: %v", err)
+			return
+		}
+		n, _ := result.RowsAffected()
+		total += n
+		if n == 0 {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("retention deleted %d events older than %s", total, maxAge)
+	}
+}
@@ -0,0 +1,322 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+	"go.starlark.net/syntax"
+)
+
+// What a policy script can decide about an event.
+const (
+	ScriptAccept = "accept"
+	ScriptReject = "reject"
+	// ScriptFlag accepts the event and puts it on the moderation queue.
+	ScriptFlag = "flag"
+)
+
+const (
+	scriptExt            = ".star"
+	scriptReloadInterval = 2 * time.Second
+	defaultScriptTimeout = 100 * time.Millisecond
+	defaultScriptSteps   = 1_000_000
+)
+
+// ScriptParams configure the script policy.
+type ScriptParams struct {
+	// Dir holds the scripts, every *.star file in it, run in name order.
+	Dir string `yaml:"dir"`
+	// Timeout and MaxSteps limit a single run of a script.
+	Timeout  time.Duration `yaml:"timeout"`
+	MaxSteps uint64        `yaml:"max_steps"`
+	// DryRun only logs what the scripts decide.
+	DryRun bool `yaml:"dry_run"`
+}
+
+// ScriptDecision is what the scripts decided about an event, and which
+// script decided it.
+type ScriptDecision struct {
+	Action  string
+	Message string
+	Script  string
+}
+
+// ScriptRunner runs the Starlark policy scripts of a directory. Each script
+// defines check(event, conn), which returns accept(), reject(msg) or
+// flag(msg); None accepts too. The scripts are loaded again when the
+// directory changes.
+type ScriptRunner struct {
+	params ScriptParams
+	store  ManagementStore
+
+	mu      sync.Mutex
+	scripts []policyScript
+	stamp   string
+	checked time.Time
+}
+
+type policyScript struct {
+	name  string
+	check starlark.Callable
+}
+
+// NewScriptRunner loads the scripts of p.Dir. The allowlist and banlist
+// lookups of the scripts go to store.
+func NewScriptRunner(store ManagementStore, p ScriptParams) (*ScriptRunner, error) {
+	if p.Dir == "" {
+		return nil, fmt.Errorf("dir is required")
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultScriptTimeout
+	}
+	if p.MaxSteps == 0 {
+		p.MaxSteps = defaultScriptSteps
+	}
+	sr := &ScriptRunner{params: p, store: store}
+	stamp, err := sr.dirStamp()
+	if err != nil {
+		return nil, err
+	}
+	if sr.scripts, err = sr.load(); err != nil {
+		return nil, err
+	}
+	sr.stamp, sr.checked = stamp, time.Now()
+	return sr, nil
+}
+
+// dirStamp describes the scripts in the directory, so a change to any of
+// them is noticed.
+func (sr *ScriptRunner) dirStamp() (string, error) {
+	entries, err := os.ReadDir(sr.params.Dir)
+	if err != nil {
+		return "", err
+	}
+	var stamp strings.Builder
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != scriptExt {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&stamp, "%s:%d:%d;", entry.Name(), info.Size(), info.ModTime().UnixNano())
+	}
+	return stamp.String(), nil
+}
+
+func (sr *ScriptRunner) load() ([]policyScript, error) {
+	paths, err := filepath.Glob(filepath.Join(sr.params.Dir, "*"+scriptExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	scripts := make([]policyScript, 0, len(paths))
+	for _, path := range paths {
+		name := filepath.Base(path)
+		thread, done := sr.thread(context.Background(), name)
+		globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, path, nil, sr.builtins())
+		done()
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %w", name, err)
+		}
+		check, ok := globals["check"].(starlark.Callable)
+		if !ok {
+			return nil, fmt.Errorf("loading %s: no check function", name)
+		}
+		globals.Freeze()
+		scripts = append(scripts, policyScript{name, check})
+	}
+	return scripts, nil
+}
+
+// current returns the loaded scripts, loading them again first when the
+// directory changed. A script that doesn't load keeps the previous ones in
+// place.
+func (sr *ScriptRunner) current() []policyScript {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if time.Since(sr.checked) < scriptReloadInterval {
+		return sr.scripts
+	}
+	sr.checked = time.Now()
+
+	stamp, err := sr.dirStamp()
+	if err != nil {
+		log.Printf("Error reading policy scripts: %v", err)
+		return sr.scripts
+	}
+	if stamp == sr.stamp {
+		return sr.scripts
+	}
+	sr.stamp = stamp
+	scripts, err := sr.load()
+	if err != nil {
+		log.Printf("Error reloading policy scripts: %v", err)
+		return sr.scripts
+	}
+	sr.scripts = scripts
+	log.Printf("policy scripts reloaded: %d scripts", len(scripts))
+	return sr.scripts
+}
+
+// thread makes a thread with the step and time limits. done must be called
+// when it's no longer used.
+func (sr *ScriptRunner) thread(ctx context.Context, name string) (thread *starlark.Thread, done func()) {
+	thread = &starlark.Thread{
+		Name: name,
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Printf("script %s: %s", name, msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(sr.params.MaxSteps)
+	timer := time.AfterFunc(sr.params.Timeout, func() {
+		thread.Cancel("timed out")
+	})
+	stop := context.AfterFunc(ctx, func() {
+		thread.Cancel("canceled")
+	})
+	return thread, func() {
+		timer.Stop()
+		stop()
+	}
+}
+
+// Check runs event through the scripts. The first one that doesn't accept
+// it decides. A script that fails is skipped, and its error returned along
+// with the decision of the others.
+func (sr *ScriptRunner) Check(ctx context.Context, event *nostr.Event) (ScriptDecision, error) {
+	args := starlark.Tuple{eventValue(event), starlarkstruct.FromStringDict(starlark.String("conn"), starlark.StringDict{
+		"ip":     starlark.String(khatru.GetIP(ctx)),
+		"authed": starlark.String(khatru.GetAuthed(ctx)),
+	})}
+
+	var errs []error
+	for _, script := range sr.current() {
+		thread, done := sr.thread(ctx, script.name)
+		result, err := starlark.Call(thread, script.check, args, nil)
+		done()
+		if err == nil {
+			var decision ScriptDecision
+			if decision, err = scriptDecision(result); err == nil && decision.Action != ScriptAccept {
+				decision.Script = script.name
+				return decision, errors.Join(errs...)
+			}
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", script.name, err))
+		}
+	}
+	return ScriptDecision{Action: ScriptAccept}, errors.Join(errs...)
+}
+
+func eventValue(event *nostr.Event) starlark.Value {
+	tags := make([]starlark.Value, len(event.Tags))
+	for i, tag := range event.Tags {
+		values := make(starlark.Tuple, len(tag))
+		for j, v := range tag {
+			values[j] = starlark.String(v)
+		}
+		tags[i] = values
+	}
+	return starlarkstruct.FromStringDict(starlark.String("event"), starlark.StringDict{
+		"id":         starlark.String(event.ID),
+		"pubkey":     starlark.String(event.PubKey),
+		"kind":       starlark.MakeInt(event.Kind),
+		"created_at": starlark.MakeInt64(int64(event.CreatedAt)),
+		"content":    starlark.String(event.Content),
+		"tags":       starlark.Tuple(tags),
+	})
+}
+
+var decisionConstructor = starlark.String("decision")
+
+func scriptDecision(v starlark.Value) (ScriptDecision, error) {
+	if v == starlark.None {
+		return ScriptDecision{Action: ScriptAccept}, nil
+	}
+	s, ok := v.(*starlarkstruct.Struct)
+	if !ok || s.Constructor() != decisionConstructor {
+		return ScriptDecision{}, fmt.Errorf("check returned %s, want accept(), reject() or flag()", v.Type())
+	}
+	action, _ := s.Attr("action")
+	message, _ := s.Attr("message")
+	return ScriptDecision{
+		Action:  string(action.(starlark.String)),
+		Message: string(message.(starlark.String)),
+	}, nil
+}
+
+func (sr *ScriptRunner) builtins() starlark.StringDict {
+	decision := func(action string) *starlark.Builtin {
+		return starlark.NewBuiltin(action, func(_ *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var message string
+			if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "message?", &message); err != nil {
+				return nil, err
+			}
+			return starlarkstruct.FromStringDict(decisionConstructor, starlark.StringDict{
+				"action":  starlark.String(action),
+				"message": starlark.String(message),
+			}), nil
+		})
+	}
+	lookup := func(name string, fn func(pubkey string) (bool, error)) *starlark.Builtin {
+		return starlark.NewBuiltin(name, func(_ *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var pubkey string
+			if err := starlark.UnpackArgs(b.Name(), args, kwargs, "pubkey", &pubkey); err != nil {
+				return nil, err
+			}
+			ok, err := fn(pubkey)
+			return starlark.Bool(ok), err
+		})
+	}
+	return starlark.StringDict{
+		ScriptAccept: decision(ScriptAccept),
+		ScriptReject: decision(ScriptReject),
+		ScriptFlag:   decision(ScriptFlag),
+		"is_allowed": lookup("is_allowed", sr.store.IsAllowedPubkey),
+		"is_banned":  lookup("is_banned", sr.store.IsBannedPubkey),
+	}
+}
+
+func init() {
+	RegisterPolicy("script", func(app *App, p ScriptParams) (Policy, error) {
+		sr, err := NewScriptRunner(app.Management(), p)
+		if err != nil {
+			return Policy{}, err
+		}
+		return Policy{Event: func(ctx context.Context, event *nostr.Event) (bool, string) {
+			decision, err := sr.Check(ctx, event)
+			if err != nil {
+				log.Printf("Error running policy scripts: %v", err)
+			}
+			if decision.Action == ScriptAccept {
+				return false, ""
+			}
+			if p.DryRun {
+				log.Printf("script %s would %s event %s: %s", decision.Script, decision.Action, event.ID, decision.Message)
+				return false, ""
+			}
+			if decision.Action == ScriptFlag {
+				if err := app.FlagEvent(event, decision.Message); err != nil {
+					log.Printf("Error flagging event %s: %v", event.ID, err)
+				}
+				return false, ""
+			}
+			return true, decision.Message
+		}}, nil
+	})
+}
@@ -0,0 +1,274 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// searchLanguages maps ISO-639-1 codes to PostgreSQL text search configs.
+var searchLanguages = map[string]string{
+	"ar": "arabic",
+	"da": "danish",
+	"de": "german",
+	"el": "greek",
+	"en": "english",
+	"es": "spanish",
+	"fi": "finnish",
+	"fr": "french",
+	"hu": "hungarian",
+	"id": "indonesian",
+	"it": "italian",
+	"nl": "dutch",
+	"no": "norwegian",
+	"pt": "portuguese",
+	"ro": "romanian",
+	"ru": "russian",
+	"sv": "swedish",
+	"tr": "turkish",
+}
+
+// Search implements NIP-50 on top of the eventstore's event table using
+// PostgreSQL full-text search. A trigger keeps a tsvector column up to date
+// for the configured kinds.
+type Search struct {
+	db    *sql.DB
+	kinds []int
+
+	// QueryLimit caps the number of results of a single search.
+	QueryLimit int
+}
+
+// NewSearch creates the search columns, trigger and index on the event table.
+// It must run after the eventstore has created that table.
+func NewSearch(db *sql.DB, kinds []int) (*Search, error) {
+	s := &Search{db: db, kinds: kinds, QueryLimit: 100}
+	if err := s.initSchema(); err != nil {
+		return nil, fmt.Errorf("failed to initialize search: %w", err)
+	}
+	return s, nil
+}
+
+func (s *Search) initSchema() error {
+	var cases strings.Builder
+	for code, config := range searchLanguages {
+		fmt.Fprintf(&cases, "\n\t\t\tWHEN '%s' THEN '%s'::regconfig", code, config)
+	}
+
+	statements := []string{
+		`ALTER TABLE event ADD COLUMN IF NOT EXISTS search_language TEXT`,
+		`ALTER TABLE event ADD COLUMN IF NOT EXISTS search_tsv TSVECTOR`,
+		`CREATE TABLE IF NOT EXISTS search_indexed_kinds (
+			kind INTEGER PRIMARY KEY
+		)`,
+		`CREATE OR REPLACE FUNCTION okay_search_config(lang TEXT) RETURNS regconfig AS $$
+			SELECT CASE lower(lang)` + cases.String() + `
+			ELSE 'simple'::regconfig END
+		$$ LANGUAGE SQL IMMUTABLE`,
+		`CREATE OR REPLACE FUNCTION okay_event_search_update() RETURNS trigger AS $$
+		DECLARE
+			lang TEXT;
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM search_indexed_kinds WHERE kind = NEW.kind) THEN
+				NEW.search_language := NULL;
+				NEW.search_tsv := NULL;
+				RETURN NEW;
+			END IF;
+
+			SELECT lower(t->>1) INTO lang FROM jsonb_array_elements(NEW.tags) t
+				WHERE t->>0 = 'l' AND t->>2 = 'ISO-639-1' LIMIT 1;
+
+			NEW.search_language := lang;
+			-- the 'simple' vector matches exact words in any language, the
+			-- language-specific one adds stemming when the language is known
+			NEW.search_tsv := to_tsvector('simple', NEW.content);
+			IF okay_search_config(lang) <> 'simple'::regconfig THEN
+				NEW.search_tsv := NEW.search_tsv || to_tsvector(okay_search_config(lang), NEW.content);
+			END IF;
+			RETURN NEW;
+		END
+		$$ LANGUAGE plpgsql`,
+		`CREATE OR REPLACE TRIGGER okay_event_search BEFORE INSERT OR UPDATE OF content, tags, kind
+			ON event FOR EACH ROW EXECUTE FUNCTION okay_event_search_update()`,
+		`CREATE INDEX IF NOT EXISTS event_search_tsv ON event USING gin (search_tsv)`,
+		`CREATE INDEX IF NOT EXISTS event_search_language ON event (search_language) WHERE search_language IS NOT NULL`,
+	}
+	for _, statement := range statements {
+		if _, err := s.db.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM search_indexed_kinds WHERE NOT (kind = ANY($1))`, pq.Array(s.kinds)); err != nil {
+		return err
+	}
+	for _, kind := range s.kinds {
+		if _, err := tx.Exec(`INSERT INTO search_indexed_kinds (kind) VALUES ($1) ON CONFLICT (kind) DO NOTHING`, kind); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Backfill indexes rows stored before search was enabled (or before their
+// kind was added), in batches so it can run next to live traffic.
+func (s *Search) Backfill(ctx context.Context, batchSize int) error {
+	total := int64(0)
+	for {
+		// touching content fires the trigger, which fills in search_tsv
+		result, err := s.db.ExecContext(ctx, `UPDATE event SET content = content WHERE id IN (
+			SELECT id FROM event WHERE search_tsv IS NULL AND kind = ANY($1) LIMIT $2
+		)`, pq.Array(s.kinds), batchSize)
+		if err != nil {
+			return fmt.Errorf("search backfill failed after %d rows: %w", total, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			break
+		}
+		total += n
+	}
+
+	// rows of kinds that are no longer indexed don't need their vectors
+	if _, err := s.db.ExecContext(ctx, `UPDATE event SET search_tsv = NULL, search_language = NULL
+		WHERE search_tsv IS NOT NULL AND NOT (kind = ANY($1))`, pq.Array(s.kinds)); err != nil {
+		return fmt.Errorf("failed to clear search vectors: %w", err)
+	}
+
+	if total > 0 {
+		log.Printf("search backfill indexed %d events", total)
+	}
+	return nil
+}
+
+// WrapQuery sends filters with a search term to the full-text index and
+// everything else to the wrapped query function.
+func (s *Search) WrapQuery(query func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error)) func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	return func(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+		if filter.Search == "" {
+			return query(ctx, filter)
+		}
+		return s.QueryEvents(ctx, filter)
+	}
+}
+
+// QueryEvents runs a NIP-50 search, ordered by relevance.
+func (s *Search) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	sqlQuery, params, ok := s.buildQuery(filter)
+	ch := make(chan *nostr.Event)
+	if !ok {
+		close(ch)
+		return ch, nil
+	}
+
+	rows, err := s.db.QueryContext(ctx, sqlQuery, params...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run search: %w", err)
+	}
+
+	go func() {
+		defer rows.Close()
+		defer close(ch)
+		for rows.Next() {
+			var evt nostr.Event
+			var timestamp int64
+			if err := rows.Scan(&evt.ID, &evt.PubKey, &timestamp, &evt.Kind, &evt.Tags, &evt.Content, &evt.Sig); err != nil {
+				log.Printf("Error scanning search result: %v", err)
+				return
+			}
+			evt.CreatedAt = nostr.Timestamp(timestamp)
+			select {
+			case ch <- &evt:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// buildQuery turns a filter into SQL. It returns false when the filter can't
+// match anything, e.g. it only asks for kinds that aren't indexed.
+func (s *Search) buildQuery(filter nostr.Filter) (string, []any, bool) {
+	terms, extensions := parseSearch(filter.Search)
+	if terms == "" {
+		return "", nil, false
+	}
+
+	var params sqlParams
+
+	config := "simple"
+	if lang, ok := extensions["language"]; ok {
+		if c, known := searchLanguages[lang]; known {
+			config = c
+		}
+	}
+	tsquery := fmt.Sprintf("websearch_to_tsquery(%s::regconfig, %s)", params.add(config), params.add(terms))
+
+	// only indexed kinds can ever match
+	if len(filter.Kinds) > 0 {
+		kinds := make([]int, 0, len(filter.Kinds))
+		for _, kind := range filter.Kinds {
+			if slices.Contains(s.kinds, kind) {
+				kinds = append(kinds, kind)
+			}
+		}
+		if len(kinds) == 0 {
+			return "", nil, false
+		}
+		filter.Kinds = kinds
+	}
+
+	conditions, ok := filterConditions(filter, &params)
+	if !ok {
+		return "", nil, false
+	}
+	conditions = append(conditions, "search_tsv @@ "+tsquery)
+	if lang, ok := extensions["language"]; ok {
+		conditions = append(conditions, "search_language = "+params.add(lang))
+	}
+
+	limit := filter.Limit
+	if limit < 1 || limit > s.QueryLimit {
+		limit = s.QueryLimit
+	}
+
+	query := `SELECT id, pubkey, created_at, kind, tags, content, sig FROM event
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY ts_rank(search_tsv, ` + tsquery + `) DESC, created_at DESC
+		LIMIT ` + params.add(limit)
+	return query, params, true
+}
+
+// searchExtensions are the NIP-50 key:value extensions search supports.
+var searchExtensions = map[string]bool{"language": true}
+
+// parseSearch splits a NIP-50 search string into free text and the
+// supported key:value extensions, such as language:en. Other words with a
+// colon, like URLs, nostr: links or times, stay search terms.
+func parseSearch(search string) (string, map[string]string) {
+	extensions := make(map[string]string)
+	terms := make([]string, 0)
+	for _, word := range strings.Fields(search) {
+		if key, value, ok := strings.Cut(word, ":"); ok && value != "" && searchExtensions[strings.ToLower(key)] {
+			extensions[strings.ToLower(key)] = strings.ToLower(value)
+			continue
+		}
+		terms = append(terms, word)
+	}
+	return strings.Join(terms, " "), extensions
+}
@@ -0,0 +1,184 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/fasthttp/websocket"
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/khatru"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// shuttingDown is the reason given to clients while the relay stops.
+const shuttingDown = "error: relay is shutting down"
+
+// errShuttingDown is returned by writes attempted after Close began.
+var errShuttingDown = errors.New(shuttingDown)
+
+// Drain tracks open websocket connections, their subscriptions and the
+// event writes in flight, so the relay can stop without cutting them off:
+// subscribers get a CLOSED and a close frame, and pending writes finish
+// before the database is closed.
+type Drain struct {
+	mu      sync.Mutex
+	closing bool
+	conns   map[*khatru.WebSocket]map[string]int
+	writes  sync.WaitGroup
+}
+
+// NewDrain creates an empty tracker.
+func NewDrain() *Drain {
+	return &Drain{conns: make(map[*khatru.WebSocket]map[string]int)}
+}
+
+// OnConnect registers a new connection.
+func (d *Drain) OnConnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	if ws == nil {
+		return
+	}
+	d.mu.Lock()
+	d.conns[ws] = make(map[string]int)
+	d.mu.Unlock()
+}
+
+// OnDisconnect forgets a connection and its subscriptions.
+func (d *Drain) OnDisconnect(ctx context.Context) {
+	ws := khatru.GetConnection(ctx)
+	d.mu.Lock()
+	delete(d.conns, ws)
+	d.mu.Unlock()
+}
+
+// Closing tells whether Close has begun.
+func (d *Drain) Closing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.closing
+}
+
+// Connections returns the number of open connections.
+func (d *Drain) Connections() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.conns)
+}
+
+// RejectFilter must be the last RejectFilter hook: it refuses new
+// subscriptions while shutting down and records the ones that were accepted.
+// khatru has no hook for CLOSE, but it cancels the context of the REQ when
+// the client closes it, replaces it or one of its filters is rejected, so
+// the subscription is forgotten then. NEG-OPEN runs the hook too, but
+// without a subscription id, and its sessions aren't drained.
+func (d *Drain) RejectFilter(ctx context.Context, filter nostr.Filter) (reject bool, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closing {
+		return true, shuttingDown
+	}
+	if eventstore.IsNegentropySession(ctx) {
+		return false, ""
+	}
+	ws := khatru.GetConnection(ctx)
+	id := khatru.GetSubscriptionID(ctx)
+	if subs, ok := d.conns[ws]; ok && id != "" {
+		// counted per filter, as a client may reuse the id of a subscription
+		// it closed before khatru cancels the old one
+		subs[id]++
+		context.AfterFunc(ctx, func() { d.forget(ws, id) })
+	}
+	return false, ""
+}
+
+// forget removes a subscription recorded by RejectFilter.
+func (d *Drain) forget(ws *khatru.WebSocket, id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	subs, ok := d.conns[ws]
+	if !ok {
+		return
+	}
+	if subs[id]--; subs[id] <= 0 {
+		delete(subs, id)
+	}
+}
+
+// Subscriptions returns the number of open subscriptions.
+func (d *Drain) Subscriptions() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n := 0
+	for _, subs := range d.conns {
+		n += len(subs)
+	}
+	return n
+}
+
+// RejectEvent refuses events while shutting down.
+func (d *Drain) RejectEvent(ctx context.Context, event *nostr.Event) (reject bool, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closing {
+		return true, shuttingDown
+	}
+	return false, ""
+}
+
+// Track wraps a StoreEvent, ReplaceEvent or DeleteEvent function so Close
+// waits for its calls to finish.
+func (d *Drain) Track(write func(ctx context.Context, event *nostr.Event) error) func(ctx context.Context, event *nostr.Event) error {
+	return func(ctx context.Context, event *nostr.Event) error {
+		d.mu.Lock()
+		if d.closing {
+			d.mu.Unlock()
+			return errShuttingDown
+		}
+		d.writes.Add(1)
+		d.mu.Unlock()
+		defer d.writes.Done()
+
+		return write(ctx, event)
+	}
+}
+
+// Close stops accepting events and subscriptions, sends a CLOSED for every
+// open subscription, closes the connections and waits for the writes in
+// flight until ctx is done.
+func (d *Drain) Close(ctx context.Context) error {
+	d.mu.Lock()
+	d.closing = true
+	conns := make(map[*khatru.WebSocket][]string, len(d.conns))
+	for ws, subs := range d.conns {
+		conns[ws] = slices.Collect(maps.Keys(subs))
+	}
+	d.mu.Unlock()
+
+	closeFrame := websocket.FormatCloseMessage(websocket.CloseGoingAway, "relay is shutting down")
+	for ws, subs := range conns {
+		for _, id := range subs {
+			ws.WriteJSON(nostr.ClosedEnvelope{SubscriptionID: id, Reason: shuttingDown})
+		}
+		// the client answers the close frame, which ends khatru's read loop
+		if err := ws.WriteMessage(websocket.CloseMessage, closeFrame); err != nil {
+			log.Printf("Error closing connection: %v", err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.writes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.New("timed out waiting for pending writes")
+	}
+}
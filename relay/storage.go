@@ -0,0 +1,305 @@
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/fiatjaf/eventstore"
+	"github.com/fiatjaf/eventstore/postgresql"
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip86"
+)
+
+// Storage backends.
+const (
+	BackendPostgres = "postgresql"
+	BackendSQLite   = "sqlite3"
+	BackendLMDB     = "lmdb"
+	BackendBadger   = "badger"
+	BackendMemory   = "memory"
+)
+
+// ManagementStore keeps the relay's own data: access lists, moderation,
+// admins, relay info, NIP-05 domains, groups, mirror cursors and the outbox
+// and webhook queues. DBManager implements it on SQL databases and KVManager
+// on key-value stores.
+type ManagementStore interface {
+	Close() error
+	Health(ctx context.Context) error
+
+	AddAllowedPubkey(pubkey, reason string) error
+	RemoveAllowedPubkey(pubkey string) error
+	IsAllowedPubkey(pubkey string) (bool, error)
+	GetAllowedPubkeys() ([]string, error)
+	GetAllowedPubkeysWithReason() ([]nip86.PubKeyReason, error)
+
+	BanPubKey(pubkey, reason string) error
+	UnbanPubKey(pubkey string) error
+	IsBannedPubkey(pubkey string) (bool, error)
+	GetBannedPubkeys() ([]nip86.PubKeyReason, error)
+
+	AddEventNeedingModeration(id, reason string) error
+	GetEventsNeedingModeration() ([]nip86.IDReason, error)
+	AllowEvent(id, reason string) error
+	BanEvent(id, reason string) error
+	GetBannedEvents() ([]nip86.IDReason, error)
+	GetAllowedEvents() ([]nip86.IDReason, error)
+
+	AllowKind(kind int) error
+	DisallowKind(kind int) error
+	GetAllowedKinds() ([]int, error)
+	GetDisallowedKinds() ([]int, error)
+
+	BlockIP(ip net.IP, reason string) error
+	UnblockIP(ip net.IP) error
+	GetBlockedIPs() ([]nip86.IPReason, error)
+
+	SetRelayInfo(key, value string) error
+	GetRelayInfo(key string) (string, error)
+
+	GrantAdmin(pubkey string, methods []string) error
+	RevokeAdmin(pubkey string, methods []string) error
+	IsAdmin(pubkey string) (bool, error)
+	GetAdminMethods(pubkey string) ([]string, error)
+	GetAdmins() ([]AdminMethods, error)
+	SetDMPreferences(pubkey string, types []string) error
+	GetDMPreferences(pubkey string) ([]string, bool, error)
+
+	AllowNIP05Domain(domain, reason string) error
+	DisallowNIP05Domain(domain string) error
+	IsAllowedNIP05Domain(domain string) (bool, error)
+	GetAllowedNIP05Domains() ([]DomainReason, error)
+
+	AddContentRule(rule ContentRule) error
+	RemoveContentRule(kind, pattern string) (bool, error)
+	GetContentRules() ([]ContentRule, error)
+
+	CreateGroup(group GroupRecord) error
+	UpdateGroup(group GroupRecord) error
+	DeleteGroup(id string) error
+	GetGroup(id string) (*GroupRecord, error)
+	GetGroups() ([]GroupRecord, error)
+	PutGroupMember(groupID, pubkey string, roles []string) error
+	RemoveGroupMember(groupID, pubkey string) error
+	GetGroupMemberRoles(groupID, pubkey string) ([]string, bool, error)
+	GetGroupMembers(groupID string) (map[string][]string, error)
+
+	AddMirrorUpstream(url string) error
+	RemoveMirrorUpstream(url string) error
+	GetMirrorUpstream(url string) (*MirrorUpstream, error)
+	GetMirrorUpstreams() ([]MirrorUpstream, error)
+	SetMirrorBackfillCursor(url string, until int64, done bool) error
+	SetMirrorLastSeen(url string, lastSeen int64) error
+	ResetMirrorBackfill(url string) error
+
+	EnqueueOutboxEvent(event *nostr.Event, relayURLs []string) error
+	ClaimOutboxDeliveries(limit int, lease time.Duration) ([]OutboxDelivery, error)
+	MarkOutboxDelivered(eventID, relayURL string) error
+	MarkOutboxFailed(eventID, relayURL, lastError string, retryIn time.Duration, dead bool) error
+	GetDeadOutboxDeliveries() ([]OutboxDelivery, error)
+	RetryOutboxDeliveries(eventID, relayURL string) (int64, error)
+	PruneOutboxDelivered(olderThan time.Duration) error
+
+	EnqueueWebhook(id, kind string, payload []byte, urls []string) error
+	ClaimWebhookDeliveries(limit int, lease time.Duration) ([]WebhookDelivery, error)
+	MarkWebhookDelivered(id, url string) error
+	MarkWebhookFailed(id, url, lastError string, retryIn time.Duration, dead bool) error
+	GetWebhookDeliveries(limit int) ([]WebhookDelivery, error)
+	RetryWebhookDeliveries(id, url string) (int64, error)
+	PruneWebhookDeliveries(olderThan time.Duration) error
+
+	DumpPolicyTables(w io.Writer) (int, error)
+	RestorePolicyTables(r io.Reader) (int, error)
+}
+
+// Storage holds the event store and the management store, plus the
+// Postgres pool when there is one.
+type Storage struct {
+	backend string
+	// sharedDB is the Postgres pool behind full-text search, negentropy,
+	// HLL counts and SQL retention. It's nil for the other backends, which
+	// run without those or with slower generic versions.
+	sharedDB  *sql.DB
+	db        eventstore.Store
+	dbManager ManagementStore
+}
+
+// backends open the storage for each backend name. Postgres, memory and
+// badger are always there; sqlite3 needs cgo, and lmdb is compiled in with
+// the build tag of the same name (and cgo). The Docker image has them all.
+var backends = map[string]func(cfg DatabaseConfig) (*Storage, error){
+	BackendPostgres: openPostgres,
+	BackendMemory:   openMemory,
+}
+
+// OpenStorage opens the configured backend and makes sure all tables exist.
+func OpenStorage(cfg DatabaseConfig) (*Storage, error) {
+	open, ok := backends[cfg.Backend]
+	if !ok {
+		available := slices.Sorted(maps.Keys(backends))
+		return nil, fmt.Errorf("storage backend %q is not available in this build, available: %v", cfg.Backend, available)
+	}
+	st, err := open(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s storage: %w", cfg.Backend, err)
+	}
+	return st, nil
+}
+
+// NewStorage combines an event store and a management store the caller
+// has opened, e.g. to embed the relay over an existing database. Features
+// that need the Postgres pool (search, SQL negentropy, HLL counts) are off.
+func NewStorage(events eventstore.Store, management ManagementStore) *Storage {
+	return &Storage{backend: "custom", db: events, dbManager: management}
+}
+
+// Backend is the name of the storage backend.
+func (s *Storage) Backend() string { return s.backend }
+
+// Events is the event store.
+func (s *Storage) Events() eventstore.Store { return s.db }
+
+// Management is the store of the relay's own data.
+func (s *Storage) Management() ManagementStore { return s.dbManager }
+
+// SQL is the Postgres pool, or nil on the other backends.
+func (s *Storage) SQL() *sql.DB { return s.sharedDB }
+
+func openPostgres(cfg DatabaseConfig) (*Storage, error) {
+	sharedDB, err := sql.Open("postgres", cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
+	}
+
+	sharedDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sharedDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sharedDB.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+
+	if err := sharedDB.Ping(); err != nil {
+		sharedDB.Close()
+		return nil, fmt.Errorf("failed to ping database: %w", err)
+	}
+
+	// Initialize the event store database (it manages its own pool)
+	db := &postgresql.PostgresBackend{DatabaseURL: cfg.URL}
+	if err := db.Init(); err != nil {
+		sharedDB.Close()
+		return nil, err
+	}
+
+	// Initialize the normal database manager for other data
+	dbManager, err := NewDBManager(sharedDB)
+	if err != nil {
+		db.Close()
+		sharedDB.Close()
+		return nil, fmt.Errorf("failed to initialize database manager: %w", err)
+	}
+
+	return &Storage{backend: BackendPostgres, sharedDB: sharedDB, db: db, dbManager: dbManager}, nil
+}
+
+// Close closes the management store, the eventstore and the shared pool.
+func (s *Storage) Close() {
+	s.dbManager.Close()
+	s.db.Close()
+	if s.sharedDB != nil {
+		s.sharedDB.Close()
+	}
+}
+
+// walkPageSize is how many events WalkEvents asks for at a time. It's no
+// more than any eventstore returns for one query (100 on Postgres and
+// SQLite), so a shorter page means there were no more events.
+const walkPageSize = 100
+
+// WalkEvents calls fn for every stored event matching filter, newest first,
+// paging with until so that backends that cap their result size still go
+// through all of them. fn may delete the event it's given.
+func WalkEvents(ctx context.Context, store eventstore.Store, filter nostr.Filter, fn func(event *nostr.Event) error) error {
+	filter.Limit = walkPageSize
+	// events at the oldest timestamp of a page may continue on the next one,
+	// so that timestamp is queried again and the ones already seen skipped
+	var boundary map[string]struct{}
+	for ctx.Err() == nil {
+		ch, err := store.QueryEvents(ctx, filter)
+		if err != nil {
+			return err
+		}
+
+		var page []*nostr.Event
+		returned := 0
+		for event := range ch {
+			returned++
+			if _, ok := boundary[event.ID]; !ok {
+				page = append(page, event)
+			}
+		}
+		if len(page) == 0 {
+			if returned < filter.Limit && filter.Limit == walkPageSize {
+				return nil
+			}
+			// only events of the boundary second came back, and it may hold
+			// more than a page
+			done, err := secondDone(ctx, store, filter, len(boundary))
+			if err != nil {
+				return err
+			}
+			switch {
+			case done:
+				until := *filter.Until - 1
+				filter.Until = &until
+				filter.Limit = walkPageSize
+				boundary = nil
+			case returned == filter.Limit:
+				filter.Limit *= 2
+			default:
+				return fmt.Errorf("more than %d events at %d, the store doesn't return them all", returned, *filter.Until)
+			}
+			continue
+		}
+
+		oldest := page[0].CreatedAt
+		for _, event := range page {
+			oldest = min(oldest, event.CreatedAt)
+		}
+		next := make(map[string]struct{})
+		if boundary != nil && *filter.Until == oldest {
+			next = boundary
+		} else {
+			filter.Limit = walkPageSize
+		}
+		for _, event := range page {
+			if event.CreatedAt == oldest {
+				next[event.ID] = struct{}{}
+			}
+			if err := fn(event); err != nil {
+				return err
+			}
+		}
+		boundary = next
+		filter.Until = &oldest
+	}
+	return ctx.Err()
+}
+
+// secondDone tells whether the events of filter at its until second are
+// all seen. Only stores that count can tell; for the others it's false.
+func secondDone(ctx context.Context, store eventstore.Store, filter nostr.Filter, seen int) (bool, error) {
+	counter, ok := store.(eventstore.Counter)
+	if !ok {
+		return false, nil
+	}
+	filter.Since = filter.Until
+	filter.Limit = 0
+	count, err := counter.CountEvents(ctx, filter)
+	if err != nil {
+		return false, err
+	}
+	return count <= int64(seen), nil
+}
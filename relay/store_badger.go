@@ -0,0 +1,93 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v4"
+	eventbadger "github.com/fiatjaf/eventstore/badger"
+)
+
+func init() {
+	backends[BackendBadger] = openBadger
+}
+
+// openBadger keeps events and the management data in two Badger databases
+// under the configured directory.
+func openBadger(cfg DatabaseConfig) (*Storage, error) {
+	path := cfg.path()
+
+	db := &eventbadger.BadgerBackend{Path: filepath.Join(path, "events")}
+	if err := db.Init(); err != nil {
+		return nil, err
+	}
+
+	management, err := badger.Open(badger.DefaultOptions(filepath.Join(path, "management")).WithLogger(nil))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open management database: %w", err)
+	}
+
+	return &Storage{backend: BackendBadger, db: db, dbManager: NewKVManager(badgerKV{management})}, nil
+}
+
+// badgerKV is a kvStore on a Badger database.
+type badgerKV struct {
+	db *badger.DB
+}
+
+func (kv badgerKV) View(fn func(tx kvTx) error) error {
+	return kv.db.View(func(txn *badger.Txn) error {
+		return fn(badgerTx{txn})
+	})
+}
+
+func (kv badgerKV) Update(fn func(tx kvTx) error) error {
+	return kv.db.Update(func(txn *badger.Txn) error {
+		return fn(badgerTx{txn})
+	})
+}
+
+func (kv badgerKV) Close() error {
+	return kv.db.Close()
+}
+
+type badgerTx struct {
+	txn *badger.Txn
+}
+
+func (tx badgerTx) Get(key []byte) ([]byte, error) {
+	item, err := tx.txn.Get(key)
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (tx badgerTx) Put(key, value []byte) error {
+	return tx.txn.Set(key, value)
+}
+
+func (tx badgerTx) Delete(key []byte) error {
+	return tx.txn.Delete(key)
+}
+
+func (tx badgerTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	it := tx.txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true})
+	defer it.Close()
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(item.KeyCopy(nil), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
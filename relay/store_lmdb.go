@@ -0,0 +1,170 @@
+//go:build lmdb
+
+package relay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/PowerDNS/lmdb-go/lmdb"
+	eventlmdb "github.com/fiatjaf/eventstore/lmdb"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// lmdbManagementMapSize is the map size of the management environment,
+// which holds lists and queues, not events.
+const lmdbManagementMapSize = 1 << 30
+
+func init() {
+	backends[BackendLMDB] = openLMDB
+}
+
+// openLMDB keeps events and the management data in two LMDB environments
+// under the configured directory.
+func openLMDB(cfg DatabaseConfig) (*Storage, error) {
+	path := cfg.path()
+
+	db := &eventlmdb.LMDBBackend{Path: filepath.Join(path, "events")}
+	if err := db.Init(); err != nil {
+		return nil, err
+	}
+
+	management, err := openLMDBKV(filepath.Join(path, "management"))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open management database: %w", err)
+	}
+
+	return &Storage{backend: BackendLMDB, db: lmdbEvents{db}, dbManager: NewKVManager(management)}, nil
+}
+
+// lmdbEvents is the LMDB eventstore with counts made by walking the
+// matching events: its own CountEvents doesn't move past an event that
+// matches and never returns.
+type lmdbEvents struct {
+	*eventlmdb.LMDBBackend
+}
+
+func (s lmdbEvents) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	var count int64
+	if filter.Since != nil && filter.Until != nil && *filter.Since == *filter.Until {
+		// a single second, as WalkEvents asks about: one query returns all
+		// of its events up to MaxLimit
+		filter.Limit = s.MaxLimit
+		ch, err := s.QueryEvents(ctx, filter)
+		if err != nil {
+			return 0, err
+		}
+		for range ch {
+			count++
+		}
+		if count >= int64(s.MaxLimit) {
+			return 0, fmt.Errorf("%d or more events at %d", s.MaxLimit, *filter.Since)
+		}
+		return count, nil
+	}
+
+	err := WalkEvents(ctx, s, filter, func(*nostr.Event) error {
+		count++
+		return nil
+	})
+	return count, err
+}
+
+// lmdbKV is a kvStore on the root database of an LMDB environment.
+type lmdbKV struct {
+	env *lmdb.Env
+	dbi lmdb.DBI
+}
+
+func openLMDBKV(path string) (*lmdbKV, error) {
+	if err := os.MkdirAll(path, 0o755); err != nil {
+		return nil, err
+	}
+	env, err := lmdb.NewEnv()
+	if err != nil {
+		return nil, err
+	}
+	if err := env.SetMapSize(lmdbManagementMapSize); err != nil {
+		env.Close()
+		return nil, err
+	}
+	if err := env.Open(path, lmdb.NoTLS, 0o644); err != nil {
+		env.Close()
+		return nil, err
+	}
+
+	kv := &lmdbKV{env: env}
+	err = env.Update(func(txn *lmdb.Txn) error {
+		kv.dbi, err = txn.OpenRoot(0)
+		return err
+	})
+	if err != nil {
+		env.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+func (kv *lmdbKV) View(fn func(tx kvTx) error) error {
+	return kv.env.View(func(txn *lmdb.Txn) error {
+		return fn(lmdbTx{txn, kv.dbi})
+	})
+}
+
+func (kv *lmdbKV) Update(fn func(tx kvTx) error) error {
+	return kv.env.Update(func(txn *lmdb.Txn) error {
+		return fn(lmdbTx{txn, kv.dbi})
+	})
+}
+
+func (kv *lmdbKV) Close() error {
+	return kv.env.Close()
+}
+
+type lmdbTx struct {
+	txn *lmdb.Txn
+	dbi lmdb.DBI
+}
+
+func (tx lmdbTx) Get(key []byte) ([]byte, error) {
+	value, err := tx.txn.Get(tx.dbi, key)
+	if lmdb.IsNotFound(err) {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (tx lmdbTx) Put(key, value []byte) error {
+	return tx.txn.Put(tx.dbi, key, value, 0)
+}
+
+func (tx lmdbTx) Delete(key []byte) error {
+	err := tx.txn.Del(tx.dbi, key, nil)
+	if lmdb.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (tx lmdbTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	cursor, err := tx.txn.OpenCursor(tx.dbi)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+
+	key, value, err := cursor.Get(prefix, nil, lmdb.SetRange)
+	for ; err == nil && bytes.HasPrefix(key, prefix); key, value, err = cursor.Get(nil, nil, lmdb.Next) {
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	if err != nil && !lmdb.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
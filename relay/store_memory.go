@@ -0,0 +1,170 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fiatjaf/eventstore/slicestore"
+	"github.com/nbd-wtf/go-nostr"
+)
+
+// openMemory keeps events and the management data in memory. Nothing
+// survives a restart, which is what tests and ephemeral relays want.
+func openMemory(cfg DatabaseConfig) (*Storage, error) {
+	events := &slicestore.SliceStore{}
+	if err := events.Init(); err != nil {
+		return nil, err
+	}
+	db := &memoryEvents{store: events}
+	dbManager := NewKVManager(&memoryKV{data: make(map[string][]byte)})
+	return &Storage{backend: BackendMemory, db: db, dbManager: dbManager}, nil
+}
+
+// memoryEvents makes a SliceStore safe for the relay's concurrent use. The
+// results of a query are collected under the lock, as the slice store reads
+// its slice while sending them.
+type memoryEvents struct {
+	mu    sync.RWMutex
+	store *slicestore.SliceStore
+}
+
+func (m *memoryEvents) Init() error {
+	return nil
+}
+
+func (m *memoryEvents) Close() {}
+
+func (m *memoryEvents) QueryEvents(ctx context.Context, filter nostr.Filter) (chan *nostr.Event, error) {
+	m.mu.RLock()
+	results, err := m.store.QueryEvents(ctx, filter)
+	if err != nil {
+		m.mu.RUnlock()
+		return nil, err
+	}
+	var events []*nostr.Event
+	for event := range results {
+		events = append(events, event)
+	}
+	m.mu.RUnlock()
+
+	ch := make(chan *nostr.Event)
+	go func() {
+		defer close(ch)
+		for _, event := range events {
+			select {
+			case ch <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (m *memoryEvents) CountEvents(ctx context.Context, filter nostr.Filter) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.store.CountEvents(ctx, filter)
+}
+
+func (m *memoryEvents) SaveEvent(ctx context.Context, event *nostr.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.SaveEvent(ctx, event)
+}
+
+func (m *memoryEvents) DeleteEvent(ctx context.Context, event *nostr.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.DeleteEvent(ctx, event)
+}
+
+func (m *memoryEvents) ReplaceEvent(ctx context.Context, event *nostr.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store.ReplaceEvent(ctx, event)
+}
+
+// memoryKV is a kvStore on a map. Updates are written to the map only when
+// they succeed, so a failed one leaves nothing behind.
+type memoryKV struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func (kv *memoryKV) View(fn func(tx kvTx) error) error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+	return fn(&memoryTx{kv: kv})
+}
+
+func (kv *memoryKV) Update(fn func(tx kvTx) error) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	tx := &memoryTx{kv: kv, writes: make(map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for key, value := range tx.writes {
+		if value == nil {
+			delete(kv.data, key)
+		} else {
+			kv.data[key] = value
+		}
+	}
+	return nil
+}
+
+func (kv *memoryKV) Close() error {
+	return nil
+}
+
+// memoryTx sees the map with its own pending writes on top; a nil value
+// there is a delete.
+type memoryTx struct {
+	kv     *memoryKV
+	writes map[string][]byte
+}
+
+func (tx *memoryTx) Get(key []byte) ([]byte, error) {
+	if value, ok := tx.writes[string(key)]; ok {
+		return value, nil
+	}
+	return tx.kv.data[string(key)], nil
+}
+
+func (tx *memoryTx) Put(key, value []byte) error {
+	tx.writes[string(key)] = bytes.Clone(value)
+	return nil
+}
+
+func (tx *memoryTx) Delete(key []byte) error {
+	tx.writes[string(key)] = nil
+	return nil
+}
+
+func (tx *memoryTx) Scan(prefix []byte, fn func(key, value []byte) error) error {
+	var keys []string
+	for key := range tx.kv.data {
+		if _, ok := tx.writes[key]; !ok && strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	for key, value := range tx.writes {
+		if value != nil && strings.HasPrefix(key, string(prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		value, _ := tx.Get([]byte(key))
+		if err := fn([]byte(key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+//go:build cgo
+
+package relay
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/fiatjaf/eventstore/sqlite3"
+	sqlite "github.com/mattn/go-sqlite3"
+)
+
+// sqliteDriver is the driver DBManager uses on SQLite. It takes the
+// Postgres-style $1 placeholders of DBManager's queries, which SQLite would
+// number by their order of appearance, and turns them into ?1, which it
+// binds by number like Postgres does.
+const sqliteDriver = "okay-sqlite3"
+
+// sqliteOptions are added to the management connection: foreign keys for
+// the cascades, and WAL with a busy timeout so it can write next to the
+// eventstore's own connections to the same file.
+const sqliteOptions = "_foreign_keys=1&_busy_timeout=5000&_journal_mode=WAL"
+
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+func init() {
+	sql.Register(sqliteDriver, rebindDriver{})
+	backends[BackendSQLite] = openSQLite
+}
+
+// openSQLite keeps events and the management tables in one SQLite file.
+func openSQLite(cfg DatabaseConfig) (*Storage, error) {
+	path := cfg.path()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create database directory: %w", err)
+	}
+
+	db := &sqlite3.SQLite3Backend{DatabaseURL: path + "?_busy_timeout=5000&_journal_mode=WAL"}
+	if err := db.Init(); err != nil {
+		return nil, err
+	}
+
+	managementDB, err := sql.Open(sqliteDriver, path+"?"+sqliteOptions)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open database connection: %w", err)
+	}
+	dbManager, err := newDBManager(managementDB, dialectSQLite)
+	if err != nil {
+		managementDB.Close()
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize database manager: %w", err)
+	}
+	dbManager.ownsDB = true
+
+	return &Storage{backend: BackendSQLite, db: db, dbManager: dbManager}, nil
+}
+
+type rebindDriver struct{}
+
+func (rebindDriver) Open(dsn string) (driver.Conn, error) {
+	conn, err := (&sqlite.SQLiteDriver{}).Open(dsn)
+	if err != nil {
+		return nil, err
+	}
+	return rebindConn{conn.(*sqlite.SQLiteConn)}, nil
+}
+
+// rebindConn rewrites the placeholders of every query that goes through it.
+type rebindConn struct {
+	*sqlite.SQLiteConn
+}
+
+func rebind(query string) string {
+	return placeholder.ReplaceAllString(query, "?$1")
+}
+
+func (c rebindConn) Prepare(query string) (driver.Stmt, error) {
+	return c.SQLiteConn.Prepare(rebind(query))
+}
+
+func (c rebindConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	return c.SQLiteConn.PrepareContext(ctx, rebind(query))
+}
+
+func (c rebindConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.SQLiteConn.Exec(rebind(query), args)
+}
+
+func (c rebindConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	return c.SQLiteConn.ExecContext(ctx, rebind(query), args)
+}
+
+func (c rebindConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	return c.SQLiteConn.Query(rebind(query), args)
+}
+
+func (c rebindConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	return c.SQLiteConn.QueryContext(ctx, rebind(query), args)
+}
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Notification types sent to webhooks.
+const (
+	WebhookModerationFlagged = "moderation.flagged"
+	WebhookPubkeyBanned      = "pubkey.banned"
+	WebhookEventBanned       = "event.banned"
+	WebhookIPBlocked         = "ip.blocked"
+	WebhookAdminGranted      = "admin.granted"
+	WebhookAdminRevoked      = "admin.revoked"
+	// WebhookPolicyRejected is sent for every rejection by a policy chain,
+	// and only to the endpoints that ask for it.
+	WebhookPolicyRejected = "policy.rejected"
+)
+
+var webhookTypes = []string{
+	WebhookModerationFlagged, WebhookPubkeyBanned, WebhookEventBanned, WebhookIPBlocked,
+	WebhookAdminGranted, WebhookAdminRevoked, WebhookPolicyRejected,
+}
+
+// WebhookNotification is the body of a webhook request.
+type WebhookNotification struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	CreatedAt int64  `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+// WebhookSignature is the X-Okay-Signature header of a request with body:
+// sha256= and the hex HMAC-SHA256 of the body with the endpoint's secret.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhooks posts notifications of moderation and admin changes to the
+// configured endpoints. Like the outbox, deliveries are queued in
+// webhook_deliveries, one row per notification and endpoint, retried with
+// exponential backoff and dead-lettered after max_attempts. The rows are
+// the delivery log.
+type Webhooks struct {
+	dbm    ManagementStore
+	config func() WebhooksConfig
+	client *http.Client
+
+	PollInterval time.Duration
+	MaxBackoff   time.Duration
+	// Retention is how long delivered and dead entries are kept in the log.
+	Retention time.Duration
+
+	wake chan struct{}
+}
+
+// NewWebhooks creates webhooks queued in dbm. config is read on every
+// notification and delivery, so endpoints follow config reloads.
+func NewWebhooks(dbm ManagementStore, config func() WebhooksConfig) *Webhooks {
+	return &Webhooks{
+		dbm:          dbm,
+		config:       config,
+		client:       &http.Client{},
+		PollInterval: 5 * time.Second,
+		MaxBackoff:   6 * time.Hour,
+		Retention:    7 * 24 * time.Hour,
+		wake:         make(chan struct{}, 1),
+	}
+}
+
+// wants tells whether an endpoint gets a type of notification.
+func (e WebhookEndpoint) wants(kind string) bool {
+	if len(e.Events) == 0 {
+		return kind != WebhookPolicyRejected
+	}
+	return slices.Contains(e.Events, kind)
+}
+
+// Subscribed tells whether any endpoint gets a type of notification.
+func (wh *Webhooks) Subscribed(kind string) bool {
+	for _, e := range wh.config().Endpoints {
+		if e.wants(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues a notification for the endpoints that get its type.
+func (wh *Webhooks) Notify(kind string, data any) {
+	var urls []string
+	for _, e := range wh.config().Endpoints {
+		if e.wants(kind) {
+			urls = append(urls, e.URL)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	notification := WebhookNotification{
+		ID:        hex.EncodeToString(id),
+		Type:      kind,
+		CreatedAt: time.Now().Unix(),
+		Data:      data,
+	}
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Error encoding %s webhook: %v", kind, err)
+		return
+	}
+	if err := wh.dbm.EnqueueWebhook(notification.ID, kind, payload, urls); err != nil {
+		log.Printf("Error queueing %s webhook: %v", kind, err)
+		return
+	}
+	wh.queue().signal()
+}
+
+// Run delivers queued notifications until ctx is canceled.
+func (wh *Webhooks) Run(ctx context.Context) {
+	wh.queue().run(ctx)
+}
+
+// queue is the webhooks' delivery loop over webhook_deliveries.
+func (wh *Webhooks) queue() *deliveryQueue[WebhookDelivery] {
+	return &deliveryQueue[WebhookDelivery]{
+		name: "webhook",
+		// without endpoints the queue waits for the config to get some back
+		claim: func(limit int, lease time.Duration) ([]WebhookDelivery, error) {
+			if len(wh.config().Endpoints) == 0 {
+				return nil, nil
+			}
+			return wh.dbm.ClaimWebhookDeliveries(limit, lease)
+		},
+		send:      wh.post,
+		delivered: wh.dbm.MarkWebhookDelivered,
+		failed:    wh.dbm.MarkWebhookFailed,
+		prune:     func() error { return wh.dbm.PruneWebhookDeliveries(wh.Retention) },
+		retries: func() (int, time.Duration, time.Duration) {
+			cfg := wh.config()
+			return cfg.MaxAttempts, cfg.Backoff, wh.MaxBackoff
+		},
+		pollInterval: wh.PollInterval,
+		wake:         wh.wake,
+	}
+}
+
+func (wh *Webhooks) post(ctx context.Context, d WebhookDelivery) error {
+	cfg := wh.config()
+	i := slices.IndexFunc(cfg.Endpoints, func(e WebhookEndpoint) bool { return e.URL == d.URL })
+	if i < 0 {
+		return giveUp{errors.New("endpoint no longer configured")}
+	}
+	endpoint := cfg.Endpoints[i]
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "okay-webhooks")
+	req.Header.Set("X-Okay-Event", d.Type)
+	req.Header.Set("X-Okay-Delivery", d.ID)
+	if endpoint.Secret != "" {
+		req.Header.Set("X-Okay-Signature", WebhookSignature(endpoint.Secret, d.Payload))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// webhookStore sends a notification after each moderation and admin change
+// that succeeds.
+type webhookStore struct {
+	ManagementStore
+	webhooks *Webhooks
+}
+
+// NotifyWebhooks has the management store send notifications of its
+// moderation and admin changes to webhooks, whoever makes them: the
+// management API, policies or the admin command.
+func (s *Storage) NotifyWebhooks(webhooks *Webhooks) {
+	if ws, ok := s.dbManager.(*webhookStore); ok {
+		ws.webhooks = webhooks
+		return
+	}
+	s.dbManager = &webhookStore{s.dbManager, webhooks}
+}
+
+// unwrapStore returns the store under the webhook notifications, if any.
+func unwrapStore(store ManagementStore) ManagementStore {
+	if ws, ok := store.(*webhookStore); ok {
+		return ws.ManagementStore
+	}
+	return store
+}
+
+func (ws *webhookStore) AddEventNeedingModeration(id, reason string) error {
+	if err := ws.ManagementStore.AddEventNeedingModeration(id, reason); err != nil {
+		return err
+	}
+	ws.webhooks.Notify(WebhookModerationFlagged, map[string]string{"event_id": id, "reason": reason})
+	return nil
+}
+
+func (ws *webhookStore) BanPubKey(pubkey, reason string) error {
+	if err := ws.ManagementStore.BanPubKey(pubkey, reason); err != nil {
+		return err
+	}
+	ws.webhooks.Notify(WebhookPubkeyBanned, map[string]string{"pubkey": pubkey, "reason": reason})
+	return nil
+}
+
+func (ws *webhookStore) BanEvent(id, reason string) error {
+	if err := ws.ManagementStore.BanEvent(id, reason); err != nil {
+		return err
+	}
+	ws.webhooks.Notify(WebhookEventBanned, map[string]string{"event_id": id, "reason": reason})
+	return nil
+}
+
+func (ws *webhookStore) BlockIP(ip net.IP, reason string) error {
+	if err := ws.ManagementStore.BlockIP(ip, reason); err != nil {
+		return err
+	}
+	ws.webhooks.Notify(WebhookIPBlocked, map[string]string{"ip": ip.String(), "reason": reason})
+	return nil
+}
+
+func (ws *webhookStore) GrantAdmin(pubkey string, methods []string) error {
+	if err := ws.ManagementStore.GrantAdmin(pubkey, methods); err != nil {
+		return err
+	}
+	ws.webhooks.Notify(WebhookAdminGranted, map[string]any{"pubkey": pubkey, "methods": methods})
+	return nil
+}
+
+func (ws *webhookStore) RevokeAdmin(pubkey string, methods []string) error {
+	if err := ws.ManagementStore.RevokeAdmin(pubkey, methods); err != nil {
+		return err
+	}
+	ws.webhooks.Notify(WebhookAdminRevoked, map[string]any{"pubkey": pubkey, "methods": methods})
+	return nil
+}
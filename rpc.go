@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/keyer"
+	"github.com/nbd-wtf/go-nostr/nip46"
+	"github.com/nbd-wtf/go-nostr/nip86"
+
+	"github.com/mroxso/okay/relay"
+)
+
+// rpcMethods describes the params of the NIP-86 methods okay supports, so
+// that command line arguments can be turned into a JSON-RPC body. "kind"
+// params are sent as numbers, "methods" and "types" as lists split on
+// commas and bracketed params are optional.
+var rpcMethods = map[string]string{
+	"supportedmethods":            "",
+	"banpubkey":                   "pubkey [reason]",
+	"listbannedpubkeys":           "",
+	"allowpubkey":                 "pubkey [reason]",
+	"listallowedpubkeys":          "",
+	"listeventsneedingmoderation": "",
+	"allowevent":                  "id [reason]",
+	"banevent":                    "id [reason]",
+	"listbannedevents":            "",
+	"listallowedevents":           "",
+	"changerelayname":             "name",
+	"changerelaydescription":      "description",
+	"changerelayicon":             "url",
+	"allowkind":                   "kind",
+	"disallowkind":                "kind",
+	"listallowedkinds":            "",
+	"listdisallowedkinds":         "",
+	"blockip":                     "ip [reason]",
+	"unblockip":                   "ip [reason]",
+	"listblockedips":              "",
+	"grantadmin":                  "pubkey methods",
+	"revokeadmin":                 "pubkey [methods]",
+	"listadmins":                  "",
+	"getdmpreferences":            "",
+	"setdmpreferences":            "types",
+	"stats":                       "",
+	"allownip05domain":            "domain [reason]",
+	"disallownip05domain":         "domain",
+	"listallowednip05domains":     "",
+	"addcontentrule":              "type pattern action [reason]",
+	"removecontentrule":           "type pattern",
+	"listcontentrules":            "",
+	"addmirrorupstream":           "url",
+	"removemirrorupstream":        "url",
+	"resyncmirrorupstream":        "url",
+	"listmirrorupstreams":         "",
+	"listfailedoutboxdeliveries":  "",
+	"retryoutboxdelivery":         "id [url]",
+	"listwebhookdeliveries":       "[limit]",
+	"retrywebhookdelivery":        "id [url]",
+}
+
+// runRPC handles `okay rpc [flags] <method> [params...]`, calling the NIP-86
+// endpoint of any relay with a NIP-98 signed request.
+func runRPC(args []string) error {
+	flags := flag.NewFlagSet("rpc", flag.ExitOnError)
+	relayURL := flags.String("relay", getEnv("OKAY_RELAY_URL", "http://localhost:3334"), "relay to call (ws, wss, http or https url)")
+	secretKey := flags.String("key", getEnv("NOSTR_SECRET_KEY", ""), "secret key to sign with, hex or nsec")
+	bunkerURL := flags.String("bunker", getEnv("NOSTR_BUNKER", ""), "NIP-46 bunker url to sign with instead of a local key")
+	bunkerClientKey := flags.String("bunker-client-key", getEnv("NOSTR_BUNKER_CLIENT_KEY", ""), "client key to talk to the bunker with, generated when empty")
+	jsonOutput := flags.Bool("json", false, "print the raw JSON-RPC response")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: okay rpc [flags] <method> [params...]")
+		flags.PrintDefaults()
+		fmt.Fprintln(flags.Output(), "methods:")
+		for _, name := range slices.Sorted(maps.Keys(rpcMethods)) {
+			fmt.Fprintf(flags.Output(), "  %s %s\n", name, rpcMethods[name])
+		}
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("missing method")
+	}
+	method := strings.ToLower(flags.Arg(0))
+	params, err := buildRPCParams(method, flags.Args()[1:])
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	var signer nostr.Signer
+	switch {
+	case *bunkerURL != "":
+		clientKey := *bunkerClientKey
+		if clientKey == "" {
+			clientKey = nostr.GeneratePrivateKey()
+		}
+		bunker, err := nip46.ConnectBunker(ctx, clientKey, *bunkerURL, nil, func(url string) {
+			fmt.Fprintf(os.Stderr, "authorize this request at %s\n", url)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to connect to bunker: %w", err)
+		}
+		signer = keyer.NewBunkerSignerFromBunkerClient(bunker)
+	case *secretKey != "":
+		sk, err := relay.ParseSecretKey(*secretKey)
+		if err != nil {
+			return err
+		}
+		if signer, err = keyer.NewPlainKeySigner(sk); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("a --key or a --bunker is needed to sign the request")
+	}
+
+	resp, err := relay.CallManagementAPI(ctx, signer, *relayURL, nip86.Request{Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(resp)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("%s", resp.Error)
+	}
+	return printRPCResult(os.Stdout, resp.Result)
+}
+
+// buildRPCParams turns command line arguments into JSON-RPC params. Methods
+// that aren't in rpcMethods (e.g. added by a newer relay) get every argument
+// that parses as JSON as such, and the rest as strings.
+func buildRPCParams(method string, args []string) ([]any, error) {
+	spec, known := rpcMethods[method]
+	if !known {
+		params := make([]any, len(args))
+		for i, arg := range args {
+			if err := json.Unmarshal([]byte(arg), &params[i]); err != nil {
+				params[i] = arg
+			}
+		}
+		return params, nil
+	}
+
+	names := strings.Fields(spec)
+	required := 0
+	for _, name := range names {
+		if !strings.HasPrefix(name, "[") {
+			required++
+		}
+	}
+	if len(args) < required || len(args) > len(names) {
+		return nil, fmt.Errorf("usage: okay rpc %s %s", method, spec)
+	}
+
+	params := make([]any, len(args))
+	for i, arg := range args {
+		switch strings.Trim(names[i], "[]") {
+		case "kind":
+			kind, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid kind: %w", err)
+			}
+			params[i] = kind
+		case "limit":
+			limit, err := strconv.Atoi(arg)
+			if err != nil {
+				return nil, fmt.Errorf("invalid limit: %w", err)
+			}
+			params[i] = limit
+		case "methods":
+			params[i] = strings.Split(arg, ",")
+		case "types":
+			// an empty list turns them all off
+			types := []string{}
+			if arg != "" {
+				types = strings.Split(arg, ",")
+			}
+			params[i] = types
+		case "pubkey":
+			pubkey, err := parsePubkey(arg)
+			if err != nil {
+				return nil, err
+			}
+			params[i] = pubkey
+		default:
+			params[i] = arg
+		}
+	}
+	return params, nil
+}
+
+// printRPCResult prints lists of objects as tables, lists of values one per
+// line and everything else as indented JSON.
+func printRPCResult(w io.Writer, result any) error {
+	list, ok := result.([]any)
+	if !ok {
+		if _, isObject := result.(map[string]any); !isObject {
+			_, err := fmt.Fprintln(w, result)
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(result)
+	}
+
+	if len(list) == 0 {
+		return nil
+	}
+	first, ok := list[0].(map[string]any)
+	if !ok {
+		for _, item := range list {
+			fmt.Fprintln(w, item)
+		}
+		return nil
+	}
+
+	columns := slices.Sorted(maps.Keys(first))
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.ToUpper(strings.Join(columns, "\t")))
+	for _, item := range list {
+		row, _ := item.(map[string]any)
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			if value, ok := row[column]; ok && value != nil {
+				values[i] = fmt.Sprint(value)
+			}
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	return tw.Flush()
+}
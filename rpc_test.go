@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nbd-wtf/go-nostr"
+	"github.com/nbd-wtf/go-nostr/nip19"
+)
+
+func TestBuildRPCParams(t *testing.T) {
+	pubkey, _ := nostr.GetPublicKey(nostr.GeneratePrivateKey())
+	npub, _ := nip19.EncodePublicKey(pubkey)
+
+	for _, tc := range []struct {
+		method string
+		args   []string
+		want   []any
+		err    string
+	}{
+		{method: "allowkind", args: []string{"30023"}, want: []any{30023}},
+		{method: "allowkind", args: []string{"long"}, err: "invalid kind"},
+		{method: "listwebhookdeliveries", args: []string{"20"}, want: []any{20}},
+		{method: "listwebhookdeliveries", args: []string{}, want: []any{}},
+		{method: "listwebhookdeliveries", args: []string{"all"}, err: "invalid limit"},
+		{method: "grantadmin", args: []string{pubkey, "banpubkey,allowpubkey"}, want: []any{pubkey, []string{"banpubkey", "allowpubkey"}}},
+		{method: "setdmpreferences", args: []string{"pubkey.banned,ip.blocked"}, want: []any{[]string{"pubkey.banned", "ip.blocked"}}},
+		// an empty list turns every notification off
+		{method: "setdmpreferences", args: []string{""}, want: []any{[]string{}}},
+		{method: "banpubkey", args: []string{npub, "spam"}, want: []any{pubkey, "spam"}},
+		{method: "banpubkey", args: []string{"npub1nope"}, err: "invalid npub"},
+		{method: "banpubkey", args: []string{"alice"}, err: "invalid pubkey"},
+		{method: "blockip", args: []string{"10.0.0.1"}, want: []any{"10.0.0.1"}},
+		// arity: required params must be there, and nothing past the optional ones
+		{method: "banpubkey", args: []string{}, err: "usage: okay rpc banpubkey pubkey [reason]"},
+		{method: "banpubkey", args: []string{pubkey, "spam", "extra"}, err: "usage: okay rpc banpubkey"},
+		{method: "addcontentrule", args: []string{"word", "spam"}, err: "usage: okay rpc addcontentrule"},
+		{method: "listadmins", args: []string{"x"}, err: "usage: okay rpc listadmins"},
+		// methods it doesn't know take JSON where it parses
+		{method: "newermethod", args: []string{"3", "[1,2]", "text"}, want: []any{float64(3), []any{float64(1), float64(2)}, "text"}},
+	} {
+		got, err := buildRPCParams(tc.method, tc.args)
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s %q: got error %v, want %q", tc.method, tc.args, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %q: %v", tc.method, tc.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s %q: got %#v, want %#v", tc.method, tc.args, got, tc.want)
+		}
+	}
+}
+
+func TestPrintRPCResult(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		result any
+		want   string
+	}{
+		{"value", true, "true\n"},
+		{"empty list", []any{}, ""},
+		{"values", []any{"a", float64(1)}, "a\n1\n"},
+		{"object", map[string]any{"events": float64(3)}, "{\n  \"events\": 3\n}\n"},
+		{
+			"table",
+			[]any{
+				map[string]any{"pubkey": "abc", "reason": "spam"},
+				map[string]any{"pubkey": "defghi", "reason": nil},
+			},
+			"PUBKEY  REASON\nabc     spam\ndefghi  \n",
+		},
+	} {
+		var out bytes.Buffer
+		if err := printRPCResult(&out, tc.result); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, out.String(), tc.want)
+		}
+	}
+}